@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/crolbar/lekvc/lekvcs/cmdline"
+)
+
+// the line being typed, Prompt draws it again after anything is printed over it
+var input struct {
+	mu   sync.Mutex
+	line []rune
+}
+
+// undoes enableCbreak, nil when stdin isn't a terminal and is read a line at a time
+var restoreTerminal func()
+
+// sent lines the up and down keys go through, oldest first
+var inputHistory []string
+
+const inputHistorySize = 100
+
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// complete extends the last word of line as far as its candidates agree,
+// it also returns the candidates when there is more than one
+func complete(line string) (string, []string) {
+	if !strings.HasPrefix(line, "/") {
+		return line, nil
+	}
+
+	// commas separate the names of /whisper
+	start := strings.LastIndexAny(line, " ,") + 1
+	head, word := line[:start], line[start:]
+
+	var candidates []string
+	if start == 0 {
+		candidates = commandNames()
+	} else {
+		args, err := cmdline.Split(head)
+		if err != nil || len(args) == 0 {
+			return line, nil
+		}
+		c, ok := commands[args[0]]
+		if !ok || c.complete == nil {
+			return line, nil
+		}
+		candidates = c.complete(args[1:])
+	}
+
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			matches = append(matches, c)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return line, nil
+	case 1:
+		return head + cmdline.Quote(matches[0]) + " ", nil
+	}
+
+	prefix := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+	return head + prefix, matches
+}
+
+// completePeers offers the names of the others for the first argument
+func completePeers(args []string) []string {
+	if len(args) > 0 {
+		return nil
+	}
+	return peerCandidates()
+}
+
+func peerCandidates() []string {
+	s := session.Load()
+	if s == nil {
+		return nil
+	}
+
+	var names []string
+	for _, c := range s.Clients() {
+		names = append(names, c.name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// completeWords offers words for the first argument
+func completeWords(words ...string) func(args []string) []string {
+	return func(args []string) []string {
+		if len(args) > 0 {
+			return nil
+		}
+		return words
+	}
+}
+
+// handleLine runs a command or sends the line to the chat
+func handleLine(text string) {
+	// a doubled slash sends a line starting with one
+	if strings.HasPrefix(text, "/") && !strings.HasPrefix(text, "//") {
+		textCommandHandle(text)
+		return
+	}
+	text = strings.TrimPrefix(text, "/")
+
+	s := session.Load()
+	if s == nil {
+		// Enter on an empty line is how a reconnect is asked for, anything
+		// else was meant for the room and the room never saw it
+		if len(text) > 0 {
+			ChatPrintClient("\x1b[33mnot connected, the line wasn't sent\x1b[m")
+		}
+		select {
+		case reconnect <- struct{}{}:
+		default:
+		}
+		return
+	}
+
+	Prompt()
+	if len(text) == 0 {
+		return
+	}
+	if s.SendText(text) {
+		recordText(s.Name(), text)
+	}
+}
+
+// readLines is the input without a terminal, whole lines and no editing
+func readLines() {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		handleLine(scanner.Text())
+	}
+}
+
+func setInput(line string) {
+	input.mu.Lock()
+	input.line = []rune(line)
+	input.mu.Unlock()
+
+	fmt.Print("\r\x1b[K")
+	Prompt()
+}
+
+func inputLine() string {
+	input.mu.Lock()
+	defer input.mu.Unlock()
+	return string(input.line)
+}
+
+// editLoop reads the terminal a key at a time, keeping the line being typed on screen
+func editLoop() {
+	r := bufio.NewReader(os.Stdin)
+
+	// position in inputHistory while going through it, len(inputHistory) is the new line
+	browsing := 0
+	var last rune
+	for {
+		key, _, err := r.ReadRune()
+		if err != nil {
+			return
+		}
+		prev := last
+		last = key
+
+		switch key {
+		case '\n', '\r':
+			// terminals sending both end one line
+			if key == '\n' && prev == '\r' {
+				continue
+			}
+
+			line := inputLine()
+			input.mu.Lock()
+			input.line = input.line[:0]
+			input.mu.Unlock()
+			fmt.Print("\n")
+
+			if line != "" && (len(inputHistory) == 0 || inputHistory[len(inputHistory)-1] != line) {
+				inputHistory = append(inputHistory, line)
+				if len(inputHistory) > inputHistorySize {
+					inputHistory = inputHistory[1:]
+				}
+			}
+			browsing = len(inputHistory)
+
+			handleLine(line)
+		case 0x7f, '\b':
+			input.mu.Lock()
+			erased := len(input.line) > 0
+			if erased {
+				input.line = input.line[:len(input.line)-1]
+			}
+			input.mu.Unlock()
+			if erased {
+				fmt.Print("\b \b")
+			}
+		case 0x17: // Ctrl+W drops the last word
+			line := strings.TrimRightFunc(inputLine(), unicode.IsSpace)
+			setInput(line[:strings.LastIndexFunc(line, unicode.IsSpace)+1])
+		case 0x15: // Ctrl+U drops the line
+			setInput("")
+		case 0x0c: // Ctrl+L
+			handleClear(nil)
+			Prompt()
+		case '\t':
+			line, candidates := complete(inputLine())
+			if len(candidates) > 0 && line == inputLine() {
+				fmt.Printf("\n\x1b[38;5;244m%s\x1b[m\n", strings.Join(candidates, "  "))
+			}
+			setInput(line)
+		case 0x1b:
+			switch readEscape(r) {
+			case 'A': // up
+				if browsing > 0 {
+					browsing--
+					setInput(inputHistory[browsing])
+				}
+			case 'B': // down
+				if browsing < len(inputHistory) {
+					browsing++
+					if browsing == len(inputHistory) {
+						setInput("")
+					} else {
+						setInput(inputHistory[browsing])
+					}
+				}
+			}
+		default:
+			if !unicode.IsPrint(key) {
+				continue
+			}
+			input.mu.Lock()
+			input.line = append(input.line, key)
+			input.mu.Unlock()
+			fmt.Print(string(key))
+		}
+	}
+}
+
+// readEscape reads the rest of an escape sequence and returns its final character
+func readEscape(r *bufio.Reader) rune {
+	key, _, err := r.ReadRune()
+	if err != nil || (key != '[' && key != 'O') {
+		return 0
+	}
+
+	for {
+		key, _, err = r.ReadRune()
+		if err != nil {
+			return 0
+		}
+		if key >= 0x40 && key <= 0x7e {
+			return key
+		}
+	}
+}
+
+func stdinReaderLoop() {
+	if restoreTerminal == nil {
+		readLines()
+		return
+	}
+	editLoop()
+}
+
+func completeCommands(args []string) []string {
+	if len(args) > 0 {
+		return nil
+	}
+	return commandNames()
+}
+
+func completeWhisper(args []string) []string {
+	return append(peerCandidates(), "off")
+}
+
+func completeFx(args []string) []string {
+	switch {
+	case len(args) == 0:
+		words := []string{"on", "off", "preset", "presets"}
+		if audioProcessor != nil {
+			for _, stage := range audioProcessor.Config().Stages {
+				words = append(words, stage.Name)
+			}
+		}
+		return words
+	case len(args) == 1 && args[0] == "preset":
+		return presetNames()
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/crolbar/lekvc/lekvc/preprocessing"
+)
+
+func TestCommandArgs(t *testing.T) {
+	InitCommands()
+
+	tests := []struct {
+		command, line string
+		want          []string
+	}{
+		{"/me", "doesn't care", []string{"doesn't care"}},
+		{"/msg", "bob it's fine", []string{"bob", "it's fine"}},
+		{"/msg", `bob "hi"`, []string{"bob", `"hi"`}},
+		{"/msg", `"bob smith"  hi  there`, []string{"bob smith", "hi  there"}},
+		{"/msg", "bob", []string{"bob"}},
+		// the server gets these as typed and splits them itself
+		{"/kick", `"eve smith" it's "spam"`, []string{`"eve smith" it's "spam"`}},
+		{"/broadcast", "back in 5'", []string{"back in 5'"}},
+		{"/history", "", nil},
+		{"/nick", `"a b"`, []string{"a b"}},
+	}
+
+	for _, tt := range tests {
+		got, err := commands[tt.command].args(tt.line)
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.command, tt.line, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s %s: %q, want %q", tt.command, tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	commands = map[string]cmd{
+		"/record":    {complete: completeWords("start", "stop")},
+		"/reconnect": {},
+		"/me":        {},
+	}
+	defer InitCommands()
+
+	tests := []struct {
+		line, want string
+		candidates int
+	}{
+		{"/me", "/me ", 0},
+		{"/re", "/reco", 2},
+		{"/rec", "/reco", 2},
+		{"/reco", "/reco", 2},
+		{"/recor", "/record ", 0},
+		{"/record s", "/record st", 2},
+		{"/record sta", "/record start ", 0},
+		{"/record start s", "/record start s", 0},
+		{"/nope x", "/nope x", 0},
+		{"hello", "hello", 0},
+	}
+	for _, tt := range tests {
+		got, candidates := complete(tt.line)
+		if got != tt.want || len(candidates) != tt.candidates {
+			t.Errorf("complete(%q) = %q, %q, want %q with %d candidates", tt.line, got, candidates, tt.want, tt.candidates)
+		}
+	}
+}
+
+func TestCompleteFxStages(t *testing.T) {
+	defer func(ap *preprocessing.AudioProcessor) { audioProcessor = ap }(audioProcessor)
+
+	var err error
+	audioProcessor, err = preprocessing.NewAudioProcessorFromConfig(48000, preprocessing.Config{
+		Stages: []preprocessing.StageConfig{
+			{Type: "peaking", Name: "presence"},
+			{Type: "peaking", Name: "warmth"},
+			{Type: "compressor"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := completeFx(nil)
+	for _, want := range []string{"presence", "warmth", "compressor"} {
+		if !slices.Contains(got, want) {
+			t.Errorf("%q isn't offered in %q", want, got)
+		}
+	}
+	if slices.Contains(got, "peaking") {
+		t.Errorf("the stage type is offered in %q", got)
+	}
+}
+
+// printed returns what f writes to stdout
+func printed(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	f()
+	os.Stdout = stdout
+	w.Close()
+
+	out, _ := io.ReadAll(r)
+	return string(out)
+}
+
+func TestHandleLineDisconnected(t *testing.T) {
+	session.Store(nil)
+	t.Cleanup(func() {
+		select {
+		case <-reconnect:
+		default:
+		}
+	})
+
+	for _, line := range []string{"", "hello"} {
+		out := printed(t, func() { handleLine(line) })
+
+		select {
+		case <-reconnect:
+		default:
+			t.Errorf("%q didn't ask for a reconnect", line)
+		}
+		if lost := strings.Contains(out, "wasn't sent"); lost != (line != "") {
+			t.Errorf("%q printed %q", line, out)
+		}
+	}
+}
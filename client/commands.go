@@ -1,27 +1,344 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
-func handleStatus() {
-	fmt.Printf("\x1b[34mConnected clients:\x1b[m\n[id]  [name]\n")
-	for _, c := range clients {
-		fmt.Printf("%d     \x1b[38;5;%dm%s\x1b[m\n", c.id, generateClientColorFromID(c.id), c.name)
+	"github.com/crolbar/lekvc/lekvc/ring"
+	"github.com/crolbar/lekvc/lekvcs/cmdline"
+)
+
+func handleStatus(args []string) {
+	if s := session.Load(); s != nil {
+		if rtt := s.RTT(); rtt > 0 {
+			fmt.Printf("\x1b[34mServer rtt:\x1b[m %s\n", rtt.Round(time.Millisecond))
+		}
+
+		fmt.Printf("\x1b[34mConnected clients:\x1b[m\n[id]  [name]\n")
+		for _, c := range s.Clients() {
+			fmt.Printf("%d     \x1b[38;5;%dm%s\x1b[m", c.id, generateClientColorFromID(c.id), c.name)
+			if rtt, ok := s.PeerRTT(c.id); ok {
+				fmt.Printf(" rtt %s", rtt.Round(time.Millisecond))
+			}
+			if c.drift != nil {
+				fmt.Printf(" \x1b[38;5;238m(clock %+.0f ppm)\x1b[m", c.drift.PPM())
+			}
+			if time.Since(time.Unix(0, c.whisperAt.Load())) < whisperGap {
+				fmt.Printf(" \x1b[35m[whisper]\x1b[m")
+			}
+			fmt.Println()
+		}
+
+		if targets := s.Whisper(); targets != nil {
+			fmt.Printf("\x1b[35mWhispering to:\x1b[m %s\n", peerNames(s, targets))
+		}
+	} else {
+		fmt.Println("\x1b[33mnot connected\x1b[m")
+	}
+
+	printRingStats("mic", captureRing)
+}
+
+func printRingStats(name string, r *ring.Buffer) {
+	if r == nil {
+		return
+	}
+
+	s := r.Stats()
+	fmt.Printf("\x1b[38;5;238m%s buffer %d/%d (max %d), dropped %d, underruns %d\x1b[m\n",
+		name, s.Fill, s.Capacity, s.MaxFill, s.Dropped, s.Underruns)
+}
+
+// findPeer looks a client up by name or id
+func findPeer(s *Session, target string) *Client {
+	for _, c := range s.Clients() {
+		if c.name == target {
+			return c
+		}
+	}
+	if id, err := strconv.ParseUint(target, 10, 8); err == nil {
+		return s.Clients()[uint8(id)]
+	}
+	return nil
+}
+
+func peerNames(s *Session, ids []uint8) string {
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		if c := s.Clients()[id]; c != nil {
+			names[i] = c.name
+		} else {
+			names[i] = strconv.Itoa(int(id))
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func handleMsg(args []string) {
+	s := session.Load()
+	if s == nil {
+		fmt.Println("\x1b[33mnot connected\x1b[m")
+		return
+	}
+	if len(args) < 2 {
+		ChatPrintClient("\x1b[31musage: /msg <name|id> <text>\x1b[m")
+		return
+	}
+
+	c := findPeer(s, args[0])
+	if c == nil {
+		ChatPrintClient(fmt.Sprintf("\x1b[31mno client %s\x1b[m", args[0]))
+		return
+	}
+
+	text := args[1]
+	if s.SendDirect([]uint8{c.id}, text) {
+		ChatPrintDirect("[dm] ->", c.id, c.name, text)
+		recordText(s.Name()+" (dm to "+c.name+")", text)
+	}
+}
+
+func handleWhisper(args []string) {
+	s := session.Load()
+	if s == nil {
+		fmt.Println("\x1b[33mnot connected\x1b[m")
+		return
+	}
+	if len(args) == 0 {
+		ChatPrintClient("\x1b[31musage: /whisper <name|id>[,<name|id>...] | /whisper off\x1b[m")
+		return
+	}
+
+	if args[0] == "off" {
+		s.SetWhisper(nil)
+		ChatPrintClient("\x1b[35mtalking to the room again\x1b[m")
+		return
+	}
+
+	var targets []uint8
+	for _, target := range strings.Split(strings.Join(args, ","), ",") {
+		if target == "" {
+			continue
+		}
+		c := findPeer(s, target)
+		if c == nil {
+			ChatPrintClient(fmt.Sprintf("\x1b[31mno client %s\x1b[m", target))
+			return
+		}
+		targets = append(targets, c.id)
+	}
+
+	s.SetWhisper(targets)
+	ChatPrintClient(fmt.Sprintf("\x1b[35mwhispering to %s, /whisper off to stop\x1b[m", peerNames(s, targets)))
+}
+
+// handleWho shows what we know of a peer, without a name the server lists everyone
+func handleWho(args []string) {
+	if len(args) == 0 {
+		serverCommand("/who")(args)
+		return
+	}
+
+	s := session.Load()
+	if s == nil {
+		fmt.Println("\x1b[33mnot connected\x1b[m")
+		return
+	}
+	c := findPeer(s, args[0])
+	if c == nil {
+		ChatPrintClient(fmt.Sprintf("\x1b[31mno client %s\x1b[m", args[0]))
+		return
+	}
+
+	fmt.Printf("\x1b[38;5;%dm%s\x1b[m \x1b[38;5;238mid %d\x1b[m\n", generateClientColorFromID(c.id), c.name, c.id)
+	if rtt, ok := s.PeerRTT(c.id); ok {
+		fmt.Printf("\x1b[34mrtt:\x1b[m %s\n", rtt.Round(time.Millisecond))
+	}
+	if c.jitterBuffer != nil {
+		buffered := time.Duration(c.jitterBuffer.Buffered()) * time.Second / time.Duration(sampleRate)
+		fmt.Printf("\x1b[34mbuffered:\x1b[m %s, playout delay %s\n",
+			buffered.Round(time.Millisecond), c.jitterBuffer.PlayoutDelay().Round(time.Millisecond))
+		if n := c.jitterBuffer.Dropped(); n > 0 {
+			fmt.Printf("\x1b[34mdropped:\x1b[m %d frames\n", n)
+		}
+	}
+	if c.drift != nil {
+		fmt.Printf("\x1b[34mclock:\x1b[m %+.0f ppm\n", c.drift.PPM())
+	}
+	if time.Since(time.Unix(0, c.whisperAt.Load())) < whisperGap {
+		fmt.Println("\x1b[35mwhispering to you\x1b[m")
+	}
+	if slices.Contains(s.Whisper(), c.id) {
+		fmt.Println("\x1b[35myou are whispering to them\x1b[m")
+	}
+}
+
+// handleNick leaves and joins again under another name, the server has no renaming
+func handleNick(args []string) {
+	if len(args) != 1 || args[0] == "" {
+		ChatPrintClient("\x1b[31musage: /nick <name>\x1b[m")
+		return
+	}
+	name := args[0]
+
+	config.Name = name
+	if err := saveConfig(config); err != nil {
+		ChatPrintClient(fmt.Sprintf("\x1b[31mcould not save config: %s\x1b[m", err.Error()))
+	}
+
+	rename.Store(&name)
+	if s := session.Load(); s != nil {
+		ChatPrintClient(fmt.Sprintf("rejoining as %s", name))
+		s.Leave()
+		return
+	}
+	select {
+	case reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// handleMe sends an action, other clients show it as part of a sentence with our name
+func handleMe(args []string) {
+	s := session.Load()
+	if s == nil {
+		fmt.Println("\x1b[33mnot connected\x1b[m")
+		return
+	}
+	if len(args) == 0 {
+		ChatPrintClient("\x1b[31musage: /me <action>\x1b[m")
+		return
+	}
+
+	action := args[0]
+	if s.SendText("/me " + action) {
+		ChatPrintAction(s.ID(), s.Name(), action)
+		recordText(s.Name(), "* "+action)
+	}
+}
+
+func handleQuit(args []string) {
+	shutdown()
+	os.Exit(0)
+}
+
+// handleReconnect drops the connection and resumes the session on a new one
+func handleReconnect(args []string) {
+	if s := session.Load(); s != nil {
+		ChatPrintClient("reconnecting")
+		s.Close()
+		return
+	}
+	select {
+	case reconnect <- struct{}{}:
+	default:
+	}
+}
+
+func handleClear(args []string) {
+	fmt.Print("\x1b[H\x1b[2J")
+}
+
+// serverCommand sends the command to the server, which answers in the chat,
+// args is at most the rest of the line as typed so the server sees the quoting
+func serverCommand(name string) func(args []string) {
+	return func(args []string) {
+		s := session.Load()
+		if s == nil {
+			fmt.Println("\x1b[33mnot connected\x1b[m")
+			return
+		}
+		s.SendCommand(strings.TrimSpace(name + " " + strings.Join(args, " ")))
+	}
+}
+
+func handleHelp(args []string) {
+	if len(args) > 0 {
+		name := "/" + strings.TrimPrefix(args[0], "/")
+		c, ok := commands[name]
+		if !ok {
+			ChatPrintClient(fmt.Sprintf("\x1b[31munknown command %s\x1b[m", name))
+			return
+		}
+		fmt.Printf("%s => %s\n", name, c.desc)
+		return
+	}
+
+	for _, name := range commandNames() {
+		fmt.Printf("%s => %s\n", name, commands[name].desc)
 	}
+	fmt.Println("\x1b[38;5;244mquote arguments with spaces, start a line with // to send it starting with /\x1b[m")
 }
 
-func handleHelp() {
-	for cstr, c := range commands {
-		fmt.Printf("%s => %s\n", cstr, c.desc)
+// textCommandHandle parses a line starting with / and runs its command
+func textCommandHandle(line string) {
+	name, rest, err := cmdline.SplitN(line, 1)
+	if err != nil {
+		ChatPrintClient(fmt.Sprintf("\x1b[31m%s\x1b[m", err))
+		return
 	}
+	if len(name) == 0 {
+		Prompt()
+		return
+	}
+
+	c, ok := commands[name[0]]
+	if !ok {
+		var similar []string
+		for _, n := range commandNames() {
+			if strings.HasPrefix(n, name[0]) {
+				similar = append(similar, n)
+			}
+		}
+		if len(similar) > 0 {
+			ChatPrintClient(fmt.Sprintf("\x1b[31munknown command %s, did you mean %s?\x1b[m", name[0], strings.Join(similar, ", ")))
+		} else {
+			ChatPrintClient(fmt.Sprintf("\x1b[31munknown command %s, /h lists them\x1b[m", name[0]))
+		}
+		return
+	}
+
+	args, err := c.args(rest)
+	if err != nil {
+		ChatPrintClient(fmt.Sprintf("\x1b[31m%s\x1b[m", err))
+		return
+	}
+
+	c.f(args)
+	Prompt()
 }
 
 type cmd struct {
-	f    func()
+	f    func(args []string)
 	desc string
+	// candidates for the argument after args when Tab is pressed, nil for none
+	complete func(args []string) []string
+
+	// the line after the first words arguments is passed as typed,
+	// as one last argument, for commands ending in free text
+	text  bool
+	words int
+}
+
+// args splits what follows the command name into its arguments
+func (c cmd) args(line string) ([]string, error) {
+	if !c.text {
+		return cmdline.Split(line)
+	}
+
+	args, rest, err := cmdline.SplitN(line, c.words)
+	if rest != "" {
+		args = append(args, rest)
+	}
+	return args, err
 }
 
 // var c cmd = cmd{
-// 	f: func() {},
+// 	f: func(args []string) {},
 // 	desc: "",
 // }
 
@@ -32,8 +349,138 @@ func InitCommands() {
 		"/s": cmd{f: handleStatus, desc: "connected clients"},
 
 		"/h": cmd{
-			f:    handleHelp,
-			desc: "show help menu",
+			f:        handleHelp,
+			desc:     "show help menu: /h [command]",
+			complete: completeCommands,
+		},
+
+		"/nick": cmd{
+			f:    handleNick,
+			desc: "rejoin under another name and keep it: /nick <name>",
+		},
+		"/me": cmd{
+			f:    handleMe,
+			desc: "say what you are doing: /me <action>",
+			text: true,
+		},
+		"/quit": cmd{
+			f:    handleQuit,
+			desc: "leave and close the client",
+		},
+		"/reconnect": cmd{
+			f:    handleReconnect,
+			desc: "drop the connection and connect again",
+		},
+		"/devices": cmd{
+			f:    handleDevices,
+			desc: "mics and speakers, the ones in use are marked",
+		},
+		"/clear": cmd{
+			f:    handleClear,
+			desc: "clear the screen",
+		},
+
+		"/record": cmd{
+			f:        handleRecord,
+			desc:     "record the call: /record start [tracks] | /record stop",
+			complete: completeWords("start", "stop"),
+		},
+
+		"/play": cmd{
+			f:    handlePlay,
+			desc: "play a wav file into the call: /play <file.wav> [fx] | /play volume <0-200>",
+		},
+		"/stop": cmd{
+			f:    handleStop,
+			desc: "stop the file started with /play",
+		},
+
+		"/fx": cmd{
+			f:        handleFx,
+			desc:     "audio processing: /fx [on|off] | /fx preset <name> | /fx presets | /fx <stage> on|off | /fx <stage> <param> <value>",
+			complete: completeFx,
+		},
+		"/gate": cmd{
+			f:    stageCommand("gate"),
+			desc: "noise gate: /gate <threshold dB> | /gate <param> <value> | /gate on|off",
+		},
+		"/comp": cmd{
+			f:    stageCommand("compressor"),
+			desc: "compressor: /comp <threshold dB> | /comp <param> <value> | /comp on|off",
+		},
+		"/deess": cmd{
+			f:    stageCommand("deesser"),
+			desc: "de-esser: /deess <threshold dB> | /deess <param> <value> | /deess on|off",
+		},
+
+		"/msg": cmd{
+			f:        handleMsg,
+			desc:     "private message: /msg <name|id> <text>",
+			complete: completePeers,
+			text:     true,
+			words:    1,
+		},
+		"/whisper": cmd{
+			f:        handleWhisper,
+			desc:     "send the mic only to some: /whisper <name|id>[,<name|id>...] | /whisper off",
+			complete: completeWhisper,
+		},
+
+		"/history": cmd{
+			f:    serverCommand("/history"),
+			desc: "older chat messages: /history [n]",
+			text: true,
+		},
+
+		"/who": cmd{
+			f:        handleWho,
+			desc:     "what we know of a peer: /who <name|id> | (moderators) /who lists clients with their role, address and token",
+			complete: completePeers,
+		},
+		"/kick": cmd{
+			f:        serverCommand("/kick"),
+			desc:     "(moderators) /kick <name|id> [reason]",
+			complete: completePeers,
+			text:     true,
+		},
+		"/ban": cmd{
+			f:        serverCommand("/ban"),
+			desc:     "(moderators) /ban <name|id|name:x|ip:x|token:x> [duration|perm] [reason]",
+			complete: completePeers,
+			text:     true,
+		},
+		"/broadcast": cmd{
+			f:    serverCommand("/broadcast"),
+			desc: "(admins) tell everyone something: /broadcast <text>",
+			text: true,
+		},
+		"/unban": cmd{
+			f:    serverCommand("/unban"),
+			desc: "(moderators) /unban <name|ip:x|token:x>",
+			text: true,
+		},
+		"/bans": cmd{
+			f:    serverCommand("/bans"),
+			desc: "(moderators) list bans",
+			text: true,
+		},
+		"/recording": cmd{
+			f:        serverCommand("/recording"),
+			desc:     "(moderators) record the room on the server: /recording [on|off]",
+			complete: completeWords("on", "off"),
+			text:     true,
+		},
+		"/mute": cmd{
+			f:        serverCommand("/mute"),
+			desc:     "(moderators) drop someone's audio on the server: /mute <name|id>",
+			complete: completePeers,
+			text:     true,
+		},
+		"/unmute": cmd{
+			f:        serverCommand("/unmute"),
+			desc:     "(moderators) /unmute <name|id>",
+			complete: completePeers,
+			text:     true,
 		},
 	}
 }
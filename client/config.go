@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/crolbar/lekvc/lekvc/preprocessing"
+)
+
+type Config struct {
+	// Preset names the processing preset, used while Processing is unset
+	Preset     string                `json:"preset,omitempty"`
+	Processing *preprocessing.Config `json:"processing,omitempty"`
+
+	// where /record writes, relative to the working directory
+	RecordDir string `json:"record_dir,omitempty"`
+
+	// rate the devices are opened at, 0 uses their native rate
+	DeviceRate int `json:"device_rate,omitempty"`
+	// rate of the processing pipeline and the mixer, 0 is 48000
+	ProcessingRate int `json:"processing_rate,omitempty"`
+	// rate asked from the server for the network stream, 0 is 48000
+	WireRate int `json:"wire_rate,omitempty"`
+
+	// replaces the login name as the username, /nick sets it
+	Name string `json:"name,omitempty"`
+
+	// proves to the server that the username is ours, only needed for names it has registered
+	Key string `json:"key,omitempty"`
+}
+
+const defaultPreset = "voice"
+
+func defaultConfig() Config {
+	return Config{
+		Preset: defaultPreset,
+	}
+}
+
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "lekvc"), nil
+}
+
+func configPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.json"), nil
+}
+
+// loadConfig reads the client config, writing the defaults on first run
+// so they can be edited
+func loadConfig() (Config, error) {
+	cfg, err := readConfig()
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, saveConfig(cfg)
+	}
+	return cfg, err
+}
+
+// readConfig reads the client config without creating it,
+// the error wraps fs.ErrNotExist when there is none yet
+func readConfig() (Config, error) {
+	path, err := configPath()
+	if err != nil {
+		return defaultConfig(), err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return defaultConfig(), err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return defaultConfig(), err
+	}
+
+	// an empty list disables processing, a missing one means the preset,
+	// the object is still kept for a bypass set on its own
+	if cfg.Processing != nil && cfg.Processing.Stages == nil && !cfg.Processing.Bypass {
+		cfg.Processing = nil
+	}
+	if cfg.Preset == "" {
+		cfg.Preset = defaultPreset
+	}
+
+	return cfg, nil
+}
+
+func saveConfig(cfg Config) error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+func presetsDir() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "presets"), nil
+}
+
+// loadPreset returns the user preset <config dir>/presets/<name>.json
+// or the built-in one, user presets take precedence
+func loadPreset(name string) (preprocessing.Config, error) {
+	dir, err := presetsDir()
+	if err != nil {
+		return preprocessing.Config{}, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, name+".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		preset, ok := preprocessing.Preset(name)
+		if !ok {
+			return preprocessing.Config{}, fmt.Errorf("no preset named %q", name)
+		}
+		return preset, nil
+	}
+	if err != nil {
+		return preprocessing.Config{}, err
+	}
+
+	var preset preprocessing.Config
+	if err := json.Unmarshal(data, &preset); err != nil {
+		return preprocessing.Config{}, fmt.Errorf("preset %q: %w", name, err)
+	}
+	if preset.Stages == nil {
+		preset.Stages = []preprocessing.StageConfig{}
+	}
+
+	return preset, nil
+}
+
+// presetNames lists built-in and user presets
+func presetNames() []string {
+	names := preprocessing.PresetNames()
+
+	dir, err := presetsDir()
+	if err != nil {
+		return names
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// processingConfig resolves the pipeline the config asks for
+func processingConfig(cfg Config) (preprocessing.Config, error) {
+	if cfg.Processing != nil && cfg.Processing.Stages != nil {
+		return *cfg.Processing, nil
+	}
+
+	preset, err := loadPreset(cfg.Preset)
+	if cfg.Processing != nil {
+		preset.Bypass = preset.Bypass || cfg.Processing.Bypass
+	}
+	return preset, err
+}
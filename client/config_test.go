@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadConfigProcessing(t *testing.T) {
+	tests := []struct {
+		json   string
+		kept   bool
+		stages bool
+		bypass bool
+	}{
+		// no list means the preset
+		{`{"processing": {}}`, false, true, false},
+		// only a bypass keeps it, still over the preset's stages
+		{`{"processing": {"bypass": true}}`, true, true, true},
+		// an empty list disables processing
+		{`{"processing": {"stages": []}}`, true, false, false},
+		{`{}`, false, true, false},
+	}
+
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	t.Setenv("HOME", dir)
+
+	path, err := configPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		if err := os.WriteFile(path, []byte(tt.json), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := readConfig()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.json, err)
+		}
+		if (cfg.Processing != nil) != tt.kept {
+			t.Errorf("%s: processing is %+v", tt.json, cfg.Processing)
+		}
+
+		processing, err := processingConfig(cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.json, err)
+		}
+		if (len(processing.Stages) > 0) != tt.stages || processing.Bypass != tt.bypass {
+			t.Errorf("%s: got %d stages with bypass %v", tt.json, len(processing.Stages), processing.Bypass)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/crolbar/lekvc/lekvc/resample"
+)
+
+const (
+	// smoothing of the buffer level per mixed frame, ~10s time constant
+	driftSmoothing = 1.0 / 400
+	// correction per second of latency error
+	driftGainP = 0.01
+	// integral time of the controller in seconds
+	driftIntegralTime = 60
+	// sound card clocks are off by a few hundred ppm at most
+	maxDriftPPM = 1000
+)
+
+// DriftCompensator keeps the jitter buffer of a remote stream at its
+// playout delay by slightly stretching the incoming audio, the sender's
+// sound card clock never runs at exactly our rate.
+// Observe runs on the mixer and Process on the network goroutine,
+// they only share the ratio so neither waits on the other.
+type DriftCompensator struct {
+	sampleRate float64
+
+	// smoothed buffer level in samples, negative until the first observation,
+	// only Observe touches these
+	level    float64
+	integral float64
+
+	// float64 bits of the stretch ratio
+	ratio atomic.Uint64
+
+	// only Process touches it
+	stretcher *resample.Stretcher
+}
+
+func NewDriftCompensator(sampleRate int) *DriftCompensator {
+	d := &DriftCompensator{
+		sampleRate: float64(sampleRate),
+		level:      -1,
+		stretcher:  resample.NewStretcher(),
+	}
+	d.ratio.Store(math.Float64bits(1))
+	return d
+}
+
+// Observe updates the drift estimate from the buffer level,
+// called by the mixer once per frame taken from the buffer, concealed ones included
+func (d *DriftCompensator) Observe(buffered int, target int) {
+	if d.level < 0 {
+		d.level = float64(buffered)
+	}
+	d.level += (float64(buffered) - d.level) * driftSmoothing
+
+	// seconds of latency above the target, the sender is running fast
+	err := (d.level - float64(target)) / d.sampleRate
+
+	frameTime := float64(targetFramesize) / d.sampleRate
+	limit := maxDriftPPM / 1e6 / driftGainP * driftIntegralTime
+	d.integral = math.Max(-limit, math.Min(limit, d.integral+err*frameTime))
+
+	correction := driftGainP * (err + d.integral/driftIntegralTime)
+	correction = math.Max(-maxDriftPPM/1e6, math.Min(maxDriftPPM/1e6, correction))
+
+	// shrink the stream when it is building up, stretch it when it drains
+	d.ratio.Store(math.Float64bits(1 - correction))
+}
+
+func (d *DriftCompensator) Ratio() float64 {
+	return math.Float64frombits(d.ratio.Load())
+}
+
+// Process stretches samples at the processing rate by the current estimate
+func (d *DriftCompensator) Process(samples []float32) []float32 {
+	d.stretcher.SetRatio(d.Ratio())
+	return d.stretcher.Process(samples)
+}
+
+// PPM is how much faster the sender's clock is estimated to run
+func (d *DriftCompensator) PPM() float64 {
+	return (1/d.Ratio() - 1) * 1e6
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// simulateDrift runs the controller against a sender whose clock is off by
+// ppm, the buffer grows by what arrives after stretching and shrinks by a
+// frame each time the mixer takes one
+func simulateDrift(ppm float64, seconds int) *DriftCompensator {
+	const rate = 48000
+	d := NewDriftCompensator(rate)
+	target := rate / 10
+	buffered := float64(target)
+
+	frames := seconds * rate / targetFramesize
+	for range frames {
+		d.Observe(int(buffered), target)
+		buffered += float64(targetFramesize) * (1 + ppm/1e6) * d.Ratio()
+		buffered = math.Max(0, buffered-float64(targetFramesize))
+	}
+	return d
+}
+
+func TestDriftConverges(t *testing.T) {
+	for _, ppm := range []float64{-500, -120, 0, 80, 300, 900} {
+		// twenty minutes, the integral takes a few of its time constants to settle
+		d := simulateDrift(ppm, 1200)
+		if got := d.PPM(); math.Abs(got-ppm) > 5 {
+			t.Errorf("clock %+.0f ppm: estimated %+.1f ppm", ppm, got)
+		}
+	}
+}
+
+func TestDriftBounded(t *testing.T) {
+	tests := []struct {
+		name     string
+		buffered int
+	}{
+		{"underrun", 0},
+		{"building up", 48000 * 10},
+	}
+
+	for _, tt := range tests {
+		d := NewDriftCompensator(48000)
+		for range 100000 {
+			d.Observe(tt.buffered, 4800)
+			if d.Ratio() < 1-maxDriftPPM/1e6-1e-12 || d.Ratio() > 1+maxDriftPPM/1e6+1e-12 {
+				t.Fatalf("%s: ratio %v is past %d ppm", tt.name, d.Ratio(), maxDriftPPM)
+			}
+		}
+	}
+}
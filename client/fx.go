@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// persistProcessing stores the current pipeline in the client config
+func persistProcessing() {
+	processing := audioProcessor.Config()
+	config.Processing = &processing
+	if err := saveConfig(config); err != nil {
+		ChatPrintClient(fmt.Sprintf("\x1b[31mcould not save config: %s\x1b[m", err.Error()))
+	}
+}
+
+func printProcessing() {
+	cfg := audioProcessor.Config()
+
+	state := "\x1b[32mon\x1b[m"
+	if cfg.Bypass {
+		state = "\x1b[31moff\x1b[m"
+	}
+	fmt.Printf("\x1b[34mAudio processing:\x1b[m %s\n", state)
+
+	for _, sc := range cfg.Stages {
+		names := make([]string, 0, len(sc.Params))
+		for name := range sc.Params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		params := make([]string, 0, len(names))
+		for _, name := range names {
+			params = append(params, fmt.Sprintf("%s=%g", name, sc.Params[name]))
+		}
+
+		enabled := ""
+		if sc.Disabled {
+			enabled = " \x1b[31m(off)\x1b[m"
+		}
+		fmt.Printf("  %-12s %s%s\n", sc.Name, strings.Join(params, " "), enabled)
+	}
+}
+
+func parseOnOff(arg string) (bool, bool) {
+	switch arg {
+	case "on":
+		return true, true
+	case "off":
+		return false, true
+	}
+	return false, false
+}
+
+// setStage handles `on|off`, `<threshold>` and `<param> <value>` for a stage
+func setStage(stage string, args []string) error {
+	if len(args) == 1 {
+		if on, ok := parseOnOff(args[0]); ok {
+			return audioProcessor.SetStageEnabled(stage, on)
+		}
+		// a lone number is the threshold
+		args = []string{"threshold", args[0]}
+	}
+
+	if len(args) != 2 {
+		return fmt.Errorf("expected on|off, <threshold> or <param> <value>")
+	}
+
+	value, err := strconv.ParseFloat(args[1], 32)
+	if err != nil {
+		return fmt.Errorf("invalid value %q", args[1])
+	}
+
+	return audioProcessor.SetParam(stage, args[0], float32(value))
+}
+
+func stageCommand(stage string) func(args []string) {
+	return func(args []string) {
+		if len(args) == 0 {
+			printProcessing()
+			return
+		}
+
+		if err := setStage(stage, args); err != nil {
+			ChatPrintClient(fmt.Sprintf("\x1b[31m%s: %s\x1b[m", stage, err.Error()))
+			return
+		}
+
+		persistProcessing()
+		ChatPrintClient(fmt.Sprintf("%s: %s", stage, strings.Join(args, " ")))
+	}
+}
+
+func handleFx(args []string) {
+	if len(args) == 0 {
+		printProcessing()
+		return
+	}
+
+	switch args[0] {
+	case "preset":
+		handlePreset(args[1:])
+		return
+	case "presets":
+		fmt.Printf("\x1b[34mPresets:\x1b[m %s\n", strings.Join(presetNames(), ", "))
+		return
+	}
+
+	if on, ok := parseOnOff(args[0]); ok && len(args) == 1 {
+		audioProcessor.SetBypass(!on)
+		persistProcessing()
+		ChatPrintClient("audio processing " + args[0])
+		return
+	}
+
+	stageCommand(args[0])(args[1:])
+}
+
+func handlePreset(args []string) {
+	if len(args) != 1 {
+		ChatPrintClient(fmt.Sprintf("\x1b[31musage: /fx preset <%s>\x1b[m", strings.Join(presetNames(), "|")))
+		return
+	}
+
+	preset, err := loadPreset(args[0])
+	if err == nil {
+		err = audioProcessor.SetConfig(preset)
+	}
+	if err != nil {
+		ChatPrintClient(fmt.Sprintf("\x1b[31m%s\x1b[m", err.Error()))
+		return
+	}
+
+	// the preset replaces any tweaks made so far
+	config.Preset = args[0]
+	config.Processing = nil
+	if err := saveConfig(config); err != nil {
+		ChatPrintClient(fmt.Sprintf("\x1b[31mcould not save config: %s\x1b[m", err.Error()))
+	}
+
+	ChatPrintClient("using preset " + args[0])
+}
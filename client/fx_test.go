@@ -0,0 +1,153 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/crolbar/lekvc/lekvc/preprocessing"
+)
+
+func testProcessor(t *testing.T, rate int) {
+	t.Helper()
+	prev := audioProcessor
+	t.Cleanup(func() { audioProcessor = prev })
+
+	var err error
+	audioProcessor, err = preprocessing.NewAudioProcessorFromConfig(rate, preprocessing.Config{
+		Stages: []preprocessing.StageConfig{
+			{Type: "highpass"},
+			{Type: "peaking", Name: "presence"},
+			{Type: "deesser"},
+			{Type: "compressor"},
+			{Type: "gate"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func stageParams(stage string) map[string]float32 {
+	for _, sc := range audioProcessor.Config().Stages {
+		if sc.Name == stage {
+			return sc.Params
+		}
+	}
+	return nil
+}
+
+func TestSetStage(t *testing.T) {
+	const rate = 16000
+
+	tests := []struct {
+		stage string
+		args  []string
+		param string
+		want  float32
+		err   bool
+	}{
+		{"gate", []string{"-50"}, "threshold", -50, false},
+		{"gate", []string{"hysteresis", "4"}, "hysteresis", 4, false},
+		{"compressor", []string{"ratio", "6"}, "ratio", 6, false},
+		{"compressor", []string{"attack", "2.5"}, "attack", 2.5, false},
+		{"presence", []string{"gain", "-3"}, "gain", -3, false},
+		{"presence", []string{"freq", "2000"}, "freq", 2000, false},
+
+		// filter frequencies past 0.45 of the rate are lowered to it
+		{"highpass", []string{"freq", "7900"}, "freq", preprocessing.MaxFreq(rate), false},
+		{"presence", []string{"freq", "20000"}, "freq", preprocessing.MaxFreq(rate), false},
+		{"deesser", []string{"frequency", "9000"}, "frequency", preprocessing.MaxFreq(rate), false},
+		{"deesser", []string{"frequency", "7200"}, "frequency", 7200, false},
+
+		// out of range values that can't be clamped are refused
+		{"highpass", []string{"freq", "0"}, "freq", 80, true},
+		{"compressor", []string{"ratio", "0.5"}, "ratio", 3, true},
+		{"gate", []string{"hysteresis", "-1"}, "hysteresis", 0, true},
+
+		{"nope", []string{"freq", "100"}, "", 0, true},
+		{"highpass", []string{"gain", "3"}, "gain", 0, true},
+		{"compressor", []string{"knee", "3"}, "knee", 0, true},
+		{"gate", []string{"loud"}, "threshold", -40, true},
+		{"compressor", []string{"ratio", "x"}, "ratio", 3, true},
+		{"compressor", []string{"ratio", "4", "5"}, "ratio", 3, true},
+	}
+	for _, tt := range tests {
+		testProcessor(t, rate)
+		before := stageParams(tt.stage)
+
+		err := setStage(tt.stage, tt.args)
+		if (err != nil) != tt.err {
+			t.Errorf("%s %q: got error %v", tt.stage, tt.args, err)
+			continue
+		}
+
+		got := stageParams(tt.stage)
+		if tt.err {
+			for name, value := range before {
+				if got[name] != value {
+					t.Errorf("%s %q failed but changed %s from %v to %v", tt.stage, tt.args, name, value, got[name])
+				}
+			}
+			continue
+		}
+		if got[tt.param] != tt.want {
+			t.Errorf("%s %q: %s is %v, want %v", tt.stage, tt.args, tt.param, got[tt.param], tt.want)
+		}
+	}
+}
+
+func TestSetStageEnabled(t *testing.T) {
+	testProcessor(t, 48000)
+
+	disabled := func(stage string) bool {
+		for _, sc := range audioProcessor.Config().Stages {
+			if sc.Name == stage {
+				return sc.Disabled
+			}
+		}
+		t.Fatalf("no stage %s", stage)
+		return false
+	}
+
+	if err := setStage("gate", []string{"off"}); err != nil || !disabled("gate") {
+		t.Fatalf("gate off: %v, disabled %v", err, disabled("gate"))
+	}
+	if err := setStage("gate", []string{"on"}); err != nil || disabled("gate") {
+		t.Fatalf("gate on: %v, disabled %v", err, disabled("gate"))
+	}
+	if err := setStage("nope", []string{"on"}); err == nil {
+		t.Fatal("enabled a stage that doesn't exist")
+	}
+}
+
+func TestHandleFxPersists(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	t.Setenv("HOME", dir)
+
+	testProcessor(t, 48000)
+	defer func(cfg Config) { config = cfg }(config)
+	config = defaultConfig()
+
+	handleFx([]string{"compressor", "ratio", "5"})
+	handleFx([]string{"off"})
+
+	cfg, err := readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Processing == nil || !cfg.Processing.Bypass {
+		t.Fatalf("bypass wasn't saved: %+v", cfg.Processing)
+	}
+	for _, sc := range cfg.Processing.Stages {
+		if sc.Name == "compressor" && sc.Params["ratio"] != 5 {
+			t.Errorf("saved compressor ratio is %v", sc.Params["ratio"])
+		}
+	}
+
+	// an unknown stage leaves the saved config alone
+	handleFx([]string{"nope", "freq", "100"})
+	if again, _ := readConfig(); len(again.Processing.Stages) != len(cfg.Processing.Stages) {
+		t.Errorf("saved stages changed to %+v", again.Processing.Stages)
+	}
+}
@@ -1,135 +1,139 @@
 package main
 
 import (
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type AudioPacket struct {
-	samples   []float32
-	timestamp time.Time
-	sequence  uint32
-}
-
-type JitterBuffer struct {
-	packets       []AudioPacket
-	mu            sync.Mutex
-	playoutDelay  time.Duration
-	baseTimestamp time.Time
-	nextSequence  uint32
-	lastPlayout   time.Time
-	adaptiveMin   time.Duration
-	adaptiveMax   time.Duration
-	latePackets   int
-	totalPackets  int
-}
+// frames a jitter buffer can hold, a power of two so the index wraps with a mask
+const jitterSlots = 64
 
-func NewJitterBuffer() *JitterBuffer {
-	return &JitterBuffer{
-		packets:      make([]AudioPacket, 0, 50),
-		playoutDelay: 60 * time.Millisecond,
-		adaptiveMin:  20 * time.Millisecond,
-		adaptiveMax:  200 * time.Millisecond,
-		nextSequence: 0,
-	}
+type jitterSlot struct {
+	samples []float32
+	// when the frame arrived in ns
+	arrived int64
 }
 
-func (jb *JitterBuffer) Add(samples []float32) {
-	jb.mu.Lock()
-	defer jb.mu.Unlock()
-
-	now := time.Now()
-
-	if jb.baseTimestamp.IsZero() {
-		jb.baseTimestamp = now
-		jb.lastPlayout = now
-	}
-
-	packet := AudioPacket{
-		samples:   samples,
-		timestamp: now,
-		sequence:  jb.nextSequence,
-	}
-
-	jb.nextSequence++
-	jb.totalPackets++
-
-	inserted := false
-	for i := 0; i < len(jb.packets); i++ {
-		if packet.sequence < jb.packets[i].sequence {
-			jb.packets = append(jb.packets[:i], append([]AudioPacket{packet}, jb.packets[i:]...)...)
-			inserted = true
-			break
-		}
-	}
+// JitterBuffer holds a remote stream's frames until they are playoutDelay old.
+// It is a fixed ring of frames safe for the network goroutine adding and the
+// mixer taking at the same time, neither ever waits on the other.
+// Buffered and PlayoutDelay may be called from anywhere.
+type JitterBuffer struct {
+	slots     [jitterSlots]jitterSlot
+	frameSize int
+	frameTime time.Duration
 
-	if !inserted {
-		jb.packets = append(jb.packets, packet)
-	}
+	// total frames ever taken and added, what is queued is tail - head
+	head atomic.Uint64
+	tail atomic.Uint64
 
-	if len(jb.packets) > 10 {
+	// in ns, adapted by Add to how bursty the stream arrives
+	playoutDelay atomic.Int64
+	adaptiveMin  time.Duration
+	adaptiveMax  time.Duration
 
-		jb.playoutDelay = min(jb.playoutDelay+5*time.Millisecond, jb.adaptiveMax)
-	} else if len(jb.packets) < 3 && jb.playoutDelay > jb.adaptiveMin {
+	// frames lost to a full ring or trimmed for being too far behind
+	dropped atomic.Uint64
+}
 
-		jb.playoutDelay = max(jb.playoutDelay-2*time.Millisecond, jb.adaptiveMin)
+// NewJitterBuffer creates a buffer of frames of frameSize samples at sampleRate
+func NewJitterBuffer(frameSize, sampleRate int) *JitterBuffer {
+	jb := &JitterBuffer{
+		frameSize:   frameSize,
+		frameTime:   time.Duration(frameSize) * time.Second / time.Duration(sampleRate),
+		adaptiveMin: 20 * time.Millisecond,
+		adaptiveMax: 200 * time.Millisecond,
 	}
-
-	if len(jb.packets) > 30 {
-		jb.packets = jb.packets[1:]
+	jb.playoutDelay.Store(int64(60 * time.Millisecond))
+	for i := range jb.slots {
+		jb.slots[i].samples = make([]float32, frameSize)
 	}
+	return jb
 }
 
-func (jb *JitterBuffer) Get(targetSize int) []float32 {
-	jb.mu.Lock()
-	defer jb.mu.Unlock()
-
-	now := time.Now()
+// maxQueued is how many frames are kept at the given delay,
+// twice what the delay needs so the drift compensation has room
+func (jb *JitterBuffer) maxQueued(delay time.Duration) uint64 {
+	return uint64(2*delay/jb.frameTime) + 2
+}
 
-	if now.Sub(jb.baseTimestamp) < jb.playoutDelay {
-		return nil
+// Add queues a frame, only the network goroutine may call it
+func (jb *JitterBuffer) Add(samples []float32) {
+	tail := jb.tail.Load()
+	queued := tail - jb.head.Load()
+	if queued >= jitterSlots {
+		jb.dropped.Add(1)
+		return
 	}
 
-	if len(jb.packets) == 0 {
-		return nil
+	slot := &jb.slots[tail%jitterSlots]
+	n := copy(slot.samples, samples)
+	clear(slot.samples[n:])
+	slot.arrived = time.Now().UnixNano()
+	jb.tail.Store(tail + 1)
+	queued++
+
+	// a burst past what the delay keeps means the network is jittery
+	delay := time.Duration(jb.playoutDelay.Load())
+	if queued > jb.maxQueued(delay) {
+		delay = min(delay+5*time.Millisecond, jb.adaptiveMax)
+	} else if queued < 3 {
+		delay = max(delay-2*time.Millisecond, jb.adaptiveMin)
 	}
+	jb.playoutDelay.Store(int64(delay))
+}
 
-	packet := jb.packets[0]
-
-	if now.Sub(packet.timestamp) < jb.playoutDelay {
-
-		return nil
+// Get copies the next frame that is playoutDelay old into out and reports
+// whether there was one. Frames beyond what the delay keeps are skipped
+// so a burst can't build up latency. Only the mixer may call it.
+func (jb *JitterBuffer) Get(out []float32) bool {
+	head := jb.head.Load()
+	tail := jb.tail.Load()
+	delay := time.Duration(jb.playoutDelay.Load())
+
+	if limit := jb.maxQueued(delay); tail-head > limit {
+		jb.dropped.Add(tail - head - limit)
+		head = tail - limit
+		jb.head.Store(head)
 	}
-
-	jb.packets = jb.packets[1:]
-	jb.lastPlayout = now
-
-	if len(packet.samples) < targetSize {
-		padded := make([]float32, targetSize)
-		copy(padded, packet.samples)
-		return padded
+	if head == tail {
+		return false
 	}
 
-	if len(packet.samples) > targetSize {
-		return packet.samples[:targetSize]
+	slot := &jb.slots[head%jitterSlots]
+	if time.Since(time.Unix(0, slot.arrived)) < delay {
+		return false
 	}
 
-	return packet.samples
+	n := copy(out, slot.samples)
+	clear(out[n:])
+	jb.head.Store(head + 1)
+	return true
 }
 
-func (jb *JitterBuffer) Conceal(targetSize int, lastSamples []float32) []float32 {
-	concealed := make([]float32, targetSize)
-
-	if len(lastSamples) == 0 {
-		return concealed
-	}
+// Conceal fills out with a fade of the last frame, standing in for a lost one
+func (jb *JitterBuffer) Conceal(out, lastSamples []float32) {
+	clear(out)
 
-	fadeLen := minInt(len(lastSamples), targetSize)
+	fadeLen := minInt(len(lastSamples), len(out))
 	for i := range fadeLen {
 		fade := float32(fadeLen-i) / float32(fadeLen) * 0.7
-		concealed[i] = lastSamples[minInt(i, len(lastSamples)-1)] * fade
+		out[i] = lastSamples[i] * fade
 	}
+}
+
+// Buffered returns the number of samples waiting to be played
+func (jb *JitterBuffer) Buffered() int {
+	// load head first so a concurrent Get can't make it negative
+	head := jb.head.Load()
+	return int(jb.tail.Load()-head) * jb.frameSize
+}
 
-	return concealed
+func (jb *JitterBuffer) PlayoutDelay() time.Duration {
+	return time.Duration(jb.playoutDelay.Load())
 }
 
+// Dropped returns how many frames were lost to overflow or trimmed
+func (jb *JitterBuffer) Dropped() uint64 {
+	return jb.dropped.Load()
+}
@@ -3,5 +3,33 @@
 
 package main
 
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
 func enableANSI() {
 }
+
+// enableCbreak stops the terminal on stdin from buffering lines and echoing,
+// so the line editor sees every key. Signals and output are left alone.
+func enableCbreak() (restore func(), err error) {
+	fd := int(os.Stdin.Fd())
+	old, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+
+	t := *old
+	t.Lflag &^= unix.ICANON | unix.ECHO
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &t); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		unix.IoctlSetTermios(fd, unix.TCSETS, old)
+	}, nil
+}
@@ -1,24 +1,28 @@
 package main
 
 import (
-	"bufio"
-	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
-	"math"
-	"net"
+	"log/slog"
+	"math/rand/v2"
 	"os"
+	"os/signal"
 	"runtime"
-	"strings"
-	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gen2brain/malgo"
 
 	"github.com/crolbar/lekvc/lekvc/preprocessing"
+	"github.com/crolbar/lekvc/lekvc/resample"
+	"github.com/crolbar/lekvc/lekvc/ring"
+	"github.com/crolbar/lekvc/lekvcs/logging"
 	p "github.com/crolbar/lekvc/lekvcs/protocol"
+	"github.com/crolbar/lekvc/lekvcs/record"
 )
 
-const bufferFrames = 0.4 * 48000 * 2
-
 const Address = "crol.bar:9000"
 
 type Client struct {
@@ -26,14 +30,27 @@ type Client struct {
 	name         string
 	jitterBuffer *JitterBuffer
 	lastSamples  []float32 // for packet loss concealment
+
+	// converts the wire rate to the processing rate
+	resampler *resample.Resampler
+	// resampled audio not yet making up a whole frame
+	pending []float32
+
+	drift *DriftCompensator
+
+	// when the last whispered frame came in ns, 0 if it never whispered to us
+	whisperAt atomic.Int64
+
+	// rest of the frame being played and whether it is concealment
+	frame     []float32
+	concealed bool
+	// back the frames taken from the jitter buffer and concealed ones
+	// so the mixer doesn't allocate them
+	frameBuf   []float32
+	concealBuf []float32
 }
 
 var (
-	id          uint8
-	name        string
-	conn        net.Conn
-	isConnected bool
-
 	username string
 
 	captureDevIdx  = 0
@@ -42,259 +59,224 @@ var (
 	captureDevices  []malgo.DeviceInfo
 	playbackDevices []malgo.DeviceInfo
 
-	format     = malgo.FormatF32
-	channels   = uint32(1)
+	format   = malgo.FormatF32
+	channels = uint32(1)
+
+	// rate of the processing pipeline, the mixer and recordings
 	sampleRate = uint32(48000)
+	// rates the devices actually run at
+	captureRate  uint32
+	playbackRate uint32
+
+	captureResampler  *resample.Resampler
+	playbackResampler *resample.Resampler
 
 	malgoCtx    *malgo.AllocatedContext
 	playbackDev *malgo.Device
 	captureDev  *malgo.Device
 
-	ch            chan p.Msg
-	closeNotifyCH chan bool = make(chan bool, 1)
-
-	ring   = NewRingBuffer(bufferFrames * int(channels))
-	ringMu sync.Mutex
-
-	clients map[uint8]*Client = make(map[uint8]*Client)
+	// Enter pressed while disconnected, retries without waiting
+	reconnect = make(chan struct{}, 1)
+	// set by /nick, the next connection is a new session under this name
+	rename atomic.Pointer[string]
 
+	// frame size at the processing rate, 25ms
 	targetFramesize = 1200
 
-	// Simple accumulator for resampling capture input to consistent frame sizes
-	captureAccumulator   []float32 = make([]float32, 0, targetFramesize*2)
-	captureAccumulatorMu sync.Mutex
+	// processed mic audio from the capture callback to senderLoop,
+	// the oldest audio goes first if the sender falls behind
+	captureRing  *ring.Buffer
+	captureReady = make(chan struct{}, 1)
+	// reused by the capture callback, the mic audio as it came and resampled
+	captureIn  []float32
+	captureOut []float32
+
+	config Config
 
 	// Audio preprocessing
-	audioProcessor *preprocessing.AudioProcessor = preprocessing.NewAudioProcessor(int(sampleRate))
+	audioProcessor *preprocessing.AudioProcessor
 )
 
 func captureDevCb(pOutputSample, pInputSamples []byte, framecount uint32) {
-	samples := bytesToFloat32(pInputSamples)
+	captureIn = record.DecodeSamples(captureIn, pInputSamples)
+	captureOut = captureResampler.Append(captureOut[:0], captureIn)
+	samples := captureOut
+
+	mixPlayer(samples, true)
 
 	// Apply professional audio preprocessing
 	if audioProcessor != nil {
 		samples = audioProcessor.Process(samples)
 	}
 
-	if ch == nil || conn == nil {
-		return
-	}
+	mixPlayer(samples, false)
 
-	captureAccumulatorMu.Lock()
-	defer captureAccumulatorMu.Unlock()
-
-	captureAccumulator = append(captureAccumulator, samples...)
-
-	// send frame only if we have enough samples
-	for len(captureAccumulator) >= targetFramesize {
-		frame := make([]float32, targetFramesize)
-		copy(frame, captureAccumulator[:targetFramesize])
-
-		payload := float32ToBytes(frame)
-
-		msg := p.Msg{
-			Type:           p.Audio,
-			ID:             id,
-			PayloadSize:    uint16(len(payload)),
-			Payload:        payload,
-			ClientName:     name,
-			ClientNameSize: uint16(len(name)),
-		}
-
-		select {
-		case ch <- msg:
-		default:
-		}
-
-		// remove used samples
-		captureAccumulator = captureAccumulator[targetFramesize:]
+	if rec := recorder.Load(); rec != nil {
+		rec.WriteMic(samples)
 	}
 
-	// Prevent accumulator from growing indefinitely (keep max 2x targetFramesize)
-	if len(captureAccumulator) > targetFramesize*2 {
-		captureAccumulator = captureAccumulator[len(captureAccumulator)-targetFramesize:]
+	captureRing.Write(samples)
+	select {
+	case captureReady <- struct{}{}:
+	default:
 	}
 }
 
-func playbackDevCb(pOutputSample, pInputSamples []byte, framecount uint32) {
-	samples := make([]float32, framecount*uint32(channels))
-
-	ringMu.Lock()
-	n := ring.Read(samples)
-	ringMu.Unlock()
-
-	for i := n; i < len(samples); i++ {
-		samples[i] = 0
-	}
+// senderLoop takes the captured audio off the real-time thread,
+// resamples it to the wire rate and sends it in whole frames
+func senderLoop() {
+	samples := make([]float32, captureRing.Cap())
 
-	for i, v := range samples {
-		binary.LittleEndian.PutUint32(
-			pOutputSample[i*4:],
-			math.Float32bits(v),
-		)
+	for range captureReady {
+		n := captureRing.Read(samples[:captureRing.Len()])
+		if s := session.Load(); s != nil {
+			s.SendAudio(samples[:n])
+		}
 	}
 }
 
-func audioHandle(audioMsg *p.Msg) {
-	samples := bytesToFloat32(audioMsg.Payload)
-	client := clients[audioMsg.ID]
+const (
+	reconnectMin = 500 * time.Millisecond
+	reconnectMax = 30 * time.Second
+)
 
-	if client != nil && client.jitterBuffer != nil {
-		client.jitterBuffer.Add(samples)
+// reconnectDelay is the wait before the given retry, doubling up to
+// reconnectMax with random jitter so clients dropped together don't retry together
+func reconnectDelay(attempt int) time.Duration {
+	d := reconnectMax
+	if attempt < 16 {
+		d = min(reconnectMin<<attempt, reconnectMax)
 	}
+	return d/2 + rand.N(d/2)
 }
 
-func textCommandHandle(cmd string) {
-	for cstr, c := range commands {
-		if cmd == cstr {
-			c.f()
-		}
+// connectLoop keeps the client connected, resuming the last session after a drop
+func connectLoop() {
+	requested := uint32(p.DefaultSampleRate)
+	if config.WireRate > 0 {
+		requested = uint32(config.WireRate)
 	}
-	Prompt()
-}
 
-func stdinReaderLoop() {
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		if !isConnected {
-			break
-		}
-		text := scanner.Text()
-		if strings.HasPrefix(text, "/") {
-			textCommandHandle(text)
-			continue
+	var token []byte
+	for attempt := 0; ; attempt++ {
+		if name := rename.Swap(nil); name != nil {
+			username = *name
+			token = nil
 		}
 
-		if isConnected {
-			Prompt()
+		s, err := Dial(Address, username, requested, token, config.Key)
+		if err != nil {
+			slog.Debug("dial failed", "addr", Address, "attempt", attempt, "resuming", token != nil, "err", err)
 		}
-		if len(text) == 0 {
+		var kicked KickedError
+		if errors.As(err, &kicked) {
+			ChatPrintClient(fmt.Sprintf("\x1b[31m%s, press Enter to try again\x1b[m", err.Error()))
+			<-reconnect
 			continue
 		}
-		msg := p.NewMsg(p.Text, id, []byte(text), name)
-		ch <- msg
-	}
-}
-
-func readerLoop() {
-	defer func() {
-		conn.Close()
-		close(ch)
-		isConnected = false
-		ch = nil
-		clear(clients)
-		captureAccumulatorMu.Lock()
-		captureAccumulator = captureAccumulator[:0]
-		captureAccumulatorMu.Unlock()
-		// Reset audio processor state
-		if audioProcessor != nil {
-			audioProcessor.Reset()
-		}
-	}()
-
-	for {
-		msg, err := p.ReadMsg(conn)
-		// assuming conn is closed
 		if err != nil {
-			ChatPrintClient(fmt.Sprintf("\x1b[31merr: %s\x1b[m", err.Error()))
-			break
-		}
+			wait := reconnectDelay(attempt)
+			ChatPrintClient(fmt.Sprintf("\x1b[31merr: %s, retrying in %s (Enter retries now)\x1b[m", err.Error(), wait.Round(100*time.Millisecond)))
 
-		// CREATE CLIENT
-		{
-			// if the msg is not from us or we don't have the client registered
-			if _, ok := clients[msg.ID]; msg.ID != id && !ok {
-				clients[msg.ID] = &Client{
-					id:           msg.ID,
-					name:         msg.ClientName,
-					jitterBuffer: NewJitterBuffer(),
-					lastSamples:  make([]float32, 0),
-				}
+			select {
+			case <-time.After(wait):
+			case <-reconnect:
 			}
+			continue
 		}
 
-		switch msg.Type {
-		case p.Audio:
-			audioHandle(msg)
-		case p.Text:
-			var sender string
-			if msg.ID != id {
-				sender = msg.ClientName
-			} else {
-				// server is sending msg back with our id, server telling us something
-				sender = "SERVER"
-			}
-			ChatPrintMsg(sender, msg)
-		case p.ClientJoin:
-			ChatPrintServer(fmt.Sprintf("\x1b[34m%s\x1b[m", string(msg.Payload)))
-		case p.ClientLeave:
-			ChatPrintServer(fmt.Sprintf("\x1b[38;5;124m%s\x1b[m", string(msg.Payload)))
-
-			// REMOVE CLIENT
-			{
-				delete(clients, msg.ID)
-			}
+		attempt = -1
+		token = s.Token()
+		run(s)
+
+		// kicked sessions can't be resumed, don't hammer the server either
+		if errors.As(s.Err(), &kicked) {
+			token = nil
+			ChatPrintClient("\x1b[33mpress Enter to reconnect\x1b[m")
+			<-reconnect
 		}
 	}
 }
 
-func writerLoop() {
-	for msg := range ch {
-		data, _ := p.EncodeMsg(msg)
-		conn.Write(data)
+// run stays connected until the session ends
+func run(s *Session) {
+	if s.Resumed() {
+		ChatPrintClient(fmt.Sprintf("\x1b[32mReconnected to crol.bar:9000 as %s with id %d\x1b[m", s.Name(), s.ID()))
+	} else {
+		ChatPrintClient(fmt.Sprintf("\x1b[32mConnected to crol.bar:9000 as %s with id %d at %d Hz\x1b[m", s.Name(), s.ID(), s.WireRate()))
 	}
-	closeNotifyCH <- true
-}
 
-func InitClient(name string) (uint8, string) {
-	data, err := p.EncodeMsg(
-		p.NewMsgNP(p.InitClient, 0, name),
-	)
-	if err != nil {
-		panic(err)
-	}
+	log := slog.With("id", s.ID(), "name", s.Name())
+	log.Debug("session started", "wire_rate", s.WireRate(), "resumed", s.Resumed())
 
-	_, err = conn.Write(data)
-	if err != nil {
-		panic(err)
-	}
+	session.Store(s)
+	<-s.Done()
+	session.CompareAndSwap(s, nil)
+	s.Wait()
 
-	msg, err := p.ReadMsg(conn)
-	if err != nil {
-		panic(err)
+	log.Debug("session ended", "err", s.Err())
+
+	if err := s.Err(); err != nil {
+		ChatPrintClient(fmt.Sprintf("\x1b[31merr: %s\x1b[m", err.Error()))
 	}
 
-	if msg.Type != p.InitClient {
-		panic("wrong msg type recived on init client")
+	// Reset audio processor state
+	if audioProcessor != nil {
+		audioProcessor.Reset()
 	}
 
-	return msg.ID, msg.ClientName
+	ChatPrintServer("\x1b[33mConnection closed\x1b[m\n")
 }
 
-func connect() error {
-	var err error
-
-	ch = make(chan p.Msg, 50)
-
-	conn, err = net.Dial("tcp", Address)
-	if err != nil {
-		close(ch)
-		return err
+// shutdown leaves the server and finishes a running recording
+func shutdown() {
+	if restoreTerminal != nil {
+		restoreTerminal()
 	}
 
-	id, name = InitClient(username)
-
-	ChatPrintClient(fmt.Sprintf("\x1b[32mConnected to crol.bar:9000 as %s with id %d\x1b[m", name, id))
+	if s := session.Swap(nil); s != nil {
+		s.Leave()
+		s.Wait()
+	}
 
-	go readerLoop()
-	go writerLoop()
+	if rec := recorder.Swap(nil); rec != nil {
+		if err := rec.Stop(); err != nil {
+			slog.Error("finishing the recording failed", "err", err)
+		}
+	}
 
-	return nil
+	captureDev.Stop()
+	playbackDev.Stop()
 }
 
 func main() {
 	var err error
 
+	if len(os.Args) > 1 && os.Args[1] == "process" {
+		if err := processCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "process:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	presetFlag := flag.String("preset", "", "audio processing preset (raw, voice, broadcast, music or a user preset)")
+	logFormat := flag.String("log-format", logging.Auto, "log as auto, text, json or color, auto colors terminals only")
+	logLevel := flag.String("log-level", "info", "least level logged: debug, info, warn or error")
+	flag.Parse()
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger, err := logging.New(os.Stderr, *logFormat, level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
 	if runtime.GOOS == "windows" {
 		enableANSI()
 		username = os.Getenv("USERNAME")
@@ -304,6 +286,38 @@ func main() {
 
 	InitCommands()
 
+	config, err = loadConfig()
+	if err != nil {
+		slog.Error("loading config failed", "err", err)
+	}
+
+	if config.Name != "" {
+		username = config.Name
+	}
+
+	if *presetFlag != "" {
+		config.Preset = *presetFlag
+		config.Processing = nil
+	}
+
+	if config.ProcessingRate > 0 {
+		sampleRate = uint32(config.ProcessingRate)
+	}
+	targetFramesize = int(sampleRate) / 40
+
+	processing, err := processingConfig(config)
+	if err == nil {
+		audioProcessor, err = preprocessing.NewAudioProcessorFromConfig(int(sampleRate), processing)
+	}
+	if err != nil {
+		slog.Error("processing config is invalid, using defaults", "err", err)
+		audioProcessor, err = preprocessing.NewAudioProcessor(int(sampleRate))
+	}
+	if err != nil {
+		slog.Error("default processing failed, sending the mic unprocessed", "err", err)
+		audioProcessor, _ = preprocessing.NewAudioProcessorFromConfig(int(sampleRate), preprocessing.Config{})
+	}
+
 	malgoCtx, _ = malgo.InitContext(nil, malgo.ContextConfig{}, nil)
 	defer malgoCtx.Free()
 
@@ -320,29 +334,44 @@ func main() {
 	defer captureDev.Uninit()
 	defer playbackDev.Uninit()
 
-	captureDev.Start()
-	playbackDev.Start()
-
-	go mixer()
+	captureRate = captureDev.SampleRate()
+	playbackRate = playbackDev.SampleRate()
 
-	for {
-		go stdinReaderLoop()
-		err = connect()
-		if err != nil {
-			ChatPrintClient(fmt.Sprintf("\x1b[31merr: %s\x1b[m", err.Error()))
-			closeNotifyCH <- true
-		}
+	captureResampler, err = resample.New(int(captureRate), int(sampleRate))
+	if err != nil {
+		panic(err)
+	}
+	playbackResampler, err = resample.New(int(sampleRate), int(playbackRate))
+	if err != nil {
+		panic(err)
+	}
 
-		isConnected = true
+	// half a second, the sender never gets close to it
+	captureRing = ring.New(int(sampleRate)/2, ring.DropOldest)
+	playbackPending = make([]float32, 0, int(playbackRate)/10)
 
-		// wait utill conn is closed
-		<-closeNotifyCH
+	slog.Info("audio rates", "mic", captureRate, "speaker", playbackRate, "processing", sampleRate)
 
-		isConnected = false
+	go senderLoop()
 
-		ChatPrintServer("\x1b[33mConnection closed\x1b[m\n")
+	captureDev.Start()
+	playbackDev.Start()
 
-		fmt.Println("\r\x1b[34m== Press \x1b[32mEnter\x1b[34m twice to try to reconnect ==\x1b[m")
-		bufio.NewReader(os.Stdin).ReadBytes('\n')
+	restoreTerminal, err = enableCbreak()
+	if err != nil {
+		slog.Debug("no line editing, stdin is read a line at a time", "err", err)
 	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		shutdown()
+		os.Exit(0)
+	}()
+
+	go stdinReaderLoop()
+
+	connectLoop()
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/crolbar/lekvc/lekvc/preprocessing"
+	"github.com/crolbar/lekvc/lekvc/resample"
+	"github.com/crolbar/lekvc/lekvc/ring"
+)
+
+func TestCaptureCallbackDoesNotAllocate(t *testing.T) {
+	defer func(r *resample.Resampler, ap *preprocessing.AudioProcessor, cr *ring.Buffer) {
+		captureResampler, audioProcessor, captureRing = r, ap, cr
+	}(captureResampler, audioProcessor, captureRing)
+
+	captureResampler, _ = resample.New(44100, int(sampleRate))
+	audioProcessor, _ = preprocessing.NewAudioProcessor(int(sampleRate))
+	captureRing = ring.New(int(sampleRate)/2, ring.DropOldest)
+
+	in := make([]byte, 441*4)
+	for i := range 441 {
+		binary.LittleEndian.PutUint32(in[i*4:], math.Float32bits(float32(math.Sin(float64(i)/10))))
+	}
+
+	captureDevCb(nil, in, 441)
+	if n := testing.AllocsPerRun(100, func() { captureDevCb(nil, in, 441) }); n != 0 {
+		t.Errorf("the capture callback allocates %v times per call", n)
+	}
+}
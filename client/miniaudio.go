@@ -18,7 +18,7 @@ func InitDevices() (capture *malgo.Device, playback *malgo.Device, err error) {
 		deviceConfig.Capture.DeviceID = captureDevInfo.ID.Pointer()
 		deviceConfig.Capture.Format = format
 		deviceConfig.Capture.Channels = channels
-		deviceConfig.SampleRate = sampleRate
+		deviceConfig.SampleRate = uint32(config.DeviceRate)
 		deviceConfig.PUserData = nil
 
 		captureCallbacks := malgo.DeviceCallbacks{Data: captureDevCb}
@@ -35,7 +35,7 @@ func InitDevices() (capture *malgo.Device, playback *malgo.Device, err error) {
 		deviceConfig.Playback.DeviceID = playbackDevInfo.ID.Pointer()
 		deviceConfig.Playback.Format = format
 		deviceConfig.Playback.Channels = channels
-		deviceConfig.SampleRate = sampleRate
+		deviceConfig.SampleRate = uint32(config.DeviceRate)
 		deviceConfig.PUserData = nil
 
 		captureCallbacks := malgo.DeviceCallbacks{Data: playbackDevCb}
@@ -110,3 +110,25 @@ func SelectDevices(ctx *malgo.AllocatedContext) error {
 
 	return nil
 }
+
+func handleDevices(args []string) {
+	printDevices("Mics", captureDevices, captureDevIdx, captureRate)
+	printDevices("Speakers", playbackDevices, playbackDevIdx, playbackRate)
+
+	fmt.Printf("\x1b[38;5;238mprocessing at %d Hz", sampleRate)
+	if s := session.Load(); s != nil {
+		fmt.Printf(", sending at %d Hz", s.WireRate())
+	}
+	fmt.Printf("\x1b[m\n")
+}
+
+func printDevices(title string, devices []malgo.DeviceInfo, current int, rate uint32) {
+	fmt.Printf("\x1b[34m%s:\x1b[m\n", title)
+	for i, d := range devices {
+		if i == current {
+			fmt.Printf("* %d %s \x1b[38;5;238m(%d Hz)\x1b[m\n", i, d.Name(), rate)
+		} else {
+			fmt.Printf("  %d %s\n", i, d.Name())
+		}
+	}
+}
@@ -1,77 +1,153 @@
 package main
 
-import "time"
+import (
+	"encoding/binary"
+	"math"
+)
 
-func mixer() {
-	// in ms
-	var frameTime float32 = (float32(targetFramesize) / float32(sampleRate)) * 1000
-	ticker := time.NewTicker(time.Millisecond * time.Duration(frameTime))
-	defer ticker.Stop()
+var (
+	// resampled mix the last callback didn't need,
+	// only the playback callback touches it
+	playbackPending []float32
 
-	for range ticker.C {
-		if len(clients) == 0 {
-			continue
-		}
+	// reused by mix, which only runs on the playback callback
+	mixSum     []float32
+	mixSamples []float32
+)
 
-		summed := make([]float32, targetFramesize)
-		active := 0
+// playbackDevCb mixes exactly the frames the device asks for. Nothing it
+// reads takes a lock, the jitter buffers hand over frames lock-free and the
+// recorder only queues, so it never waits on the network or the disk.
+func playbackDevCb(pOutputSample, pInputSamples []byte, framecount uint32) {
+	n := int(framecount * channels)
 
-		for _, c := range clients {
-			if c.jitterBuffer == nil {
-				continue
-			}
+	for len(playbackPending) < n {
+		// processing samples needed for the rest, the resampler may hold a few back
+		need := (n-len(playbackPending))*int(sampleRate)/int(playbackRate) + 1
+		playbackPending = playbackResampler.Append(playbackPending, mix(need))
+	}
 
-			// Try to get samples from jitter buffer
-			samples := c.jitterBuffer.Get(targetFramesize)
-
-			// If no samples available, use packet loss concealment
-			if samples == nil {
-				samples = c.jitterBuffer.Conceal(targetFramesize, c.lastSamples)
-				// Don't count concealed packets as active to reduce their impact
-				if len(samples) > 0 {
-					// Mix in concealed audio at reduced level
-					for i := range samples {
-						if i < len(summed) {
-							summed[i] += samples[i] * 0.3 // reduce volume of concealed audio
-						}
-					}
-				}
-				continue
-			}
+	for i, v := range playbackPending[:n] {
+		binary.LittleEndian.PutUint32(
+			pOutputSample[i*4:],
+			math.Float32bits(v),
+		)
+	}
+	playbackPending = playbackPending[:copy(playbackPending, playbackPending[n:])]
+}
 
-			// Store last valid samples for future concealment
-			if len(samples) > 0 {
-				c.lastSamples = make([]float32, len(samples))
-				copy(c.lastSamples, samples)
+// read fills out with the next samples of the client, pulling frames from
+// the jitter buffer as needed, returns how many were real audio
+func (c *Client) read(out []float32) int {
+	real := 0
+
+	for i := 0; i < len(out); {
+		if len(c.frame) == 0 {
+			if cap(c.frameBuf) < targetFramesize {
+				c.frameBuf = make([]float32, targetFramesize)
+				c.concealBuf = make([]float32, targetFramesize)
 			}
+			samples := c.frameBuf[:targetFramesize]
+			got := c.jitterBuffer.Get(samples)
+
+			// underruns count too, a slow sender drains the buffer and only shows up there
+			delay := c.jitterBuffer.PlayoutDelay()
+			c.drift.Observe(c.jitterBuffer.Buffered(), int(delay.Seconds()*float64(sampleRate)))
 
-			// Mix in the samples
-			for i, s := range samples {
-				if i < len(summed) {
-					summed[i] += s
+			if !got {
+				// packet loss concealment at reduced level
+				samples = c.concealBuf[:targetFramesize]
+				c.jitterBuffer.Conceal(samples, c.lastSamples)
+				for j := range samples {
+					samples[j] *= 0.3
 				}
+				c.concealed = true
+			} else {
+				// Store last valid samples for future concealment
+				c.lastSamples = append(c.lastSamples[:0], samples...)
+				c.concealed = false
 			}
-			active++
+
+			c.frame = samples
 		}
 
-		if active == 0 {
+		n := copy(out[i:], c.frame)
+		c.frame = c.frame[n:]
+		if !c.concealed {
+			real += n
+		}
+		i += n
+	}
+
+	return real
+}
+
+// mix returns n samples at the processing rate of every client mixed together,
+// they are only valid until the next call
+func mix(n int) []float32 {
+	if cap(mixSum) < n {
+		mixSum = make([]float32, n)
+		mixSamples = make([]float32, n)
+	}
+	summed := mixSum[:n]
+	samples := mixSamples[:n]
+	clear(summed)
+	active := 0
+
+	pl := player.Load()
+	rec := recorder.Load()
+
+	var clients map[uint8]*Client
+	if s := session.Load(); s != nil {
+		clients = s.Clients()
+	}
+
+	for _, c := range clients {
+		if c.jitterBuffer == nil {
 			continue
 		}
 
-		// Normalize and apply soft clipping
+		clear(samples)
+		if c.read(samples) > 0 {
+			active++
+		}
+
+		if rec != nil {
+			rec.WriteTrack(c.id, c.name, samples)
+		}
+
+		// Mix in the samples
+		for i, s := range samples {
+			summed[i] += s
+		}
+	}
+
+	if active > 0 {
 		for i := range summed {
 			summed[i] /= float32(active)
+		}
+	} else {
+		// concealment alone is not worth playing
+		clear(summed)
+	}
 
-			// Soft clipping to prevent harsh distortion
-			if summed[i] > 1 {
-				summed[i] = 1
-			} else if summed[i] < -1 {
-				summed[i] = -1
-			}
+	// local monitoring of the file being played
+	if pl != nil {
+		pl.MixMonitor(summed)
+	}
+
+	// Soft clipping to prevent harsh distortion
+	for i := range summed {
+		if summed[i] > 1 {
+			summed[i] = 1
+		} else if summed[i] < -1 {
+			summed[i] = -1
 		}
+	}
 
-		ringMu.Lock()
-		ring.Write(summed)
-		ringMu.Unlock()
+	if rec != nil {
+		rec.WriteMix(summed)
 	}
+
+	return summed
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/crolbar/lekvc/lekvc/resample"
+)
+
+func TestMixDoesNotAllocate(t *testing.T) {
+	s := &Session{wireRate: sampleRate}
+	c := s.newClient(1, "a")
+	c.lastSamples = make([]float32, targetFramesize)
+	for i := range c.lastSamples {
+		c.lastSamples[i] = 0.5
+	}
+	clients := map[uint8]*Client{c.id: c}
+	s.clients.Store(&clients)
+
+	session.Store(s)
+	defer session.Store(nil)
+
+	// the first call sizes the buffers
+	mix(targetFramesize)
+
+	// the jitter buffer is empty, every frame is concealed
+	if n := testing.AllocsPerRun(100, func() { mix(targetFramesize) }); n != 0 {
+		t.Errorf("mix allocates %v times per call", n)
+	}
+}
+
+func TestPlaybackCallbackMixesOnDemand(t *testing.T) {
+	defer func(rate uint32, r *resample.Resampler) {
+		playbackRate, playbackResampler, playbackPending = rate, r, nil
+	}(playbackRate, playbackResampler)
+
+	s := &Session{wireRate: sampleRate}
+	c := s.newClient(1, "a")
+	c.jitterBuffer.adaptiveMin, c.jitterBuffer.adaptiveMax = 0, 0
+	c.jitterBuffer.playoutDelay.Store(0)
+	clients := map[uint8]*Client{c.id: c}
+	s.clients.Store(&clients)
+
+	session.Store(s)
+	defer session.Store(nil)
+
+	frame := make([]float32, targetFramesize)
+	for i := range frame {
+		frame[i] = float32(i) / float32(targetFramesize)
+	}
+	c.jitterBuffer.Add(frame)
+
+	playbackRate = sampleRate
+	playbackResampler, _ = resample.New(int(sampleRate), int(playbackRate))
+	playbackPending = nil
+
+	// what the device asks for comes straight from the jitter buffer, in order
+	var got []float32
+	for _, n := range []int{5, 100, 1} {
+		out := make([]byte, n*4)
+		playbackDevCb(out, nil, uint32(n))
+		for i := range n {
+			got = append(got, math.Float32frombits(binary.LittleEndian.Uint32(out[i*4:])))
+		}
+	}
+	for i, v := range got {
+		if v != frame[i] {
+			t.Fatalf("sample %d is %v, want %v", i, v, frame[i])
+		}
+	}
+
+	// a device at another rate gets exactly what it asked for each time
+	playbackRate = 44100
+	playbackResampler, _ = resample.New(int(sampleRate), int(playbackRate))
+	playbackPending = nil
+	for _, n := range []int{441, 512, 1, 1024} {
+		out := make([]byte, n*4)
+		playbackDevCb(out, nil, uint32(n))
+		if len(playbackPending) > int(sampleRate)/100 {
+			t.Errorf("%d samples left over after a callback of %d", len(playbackPending), n)
+		}
+	}
+}
+
+func TestPlaybackCallbackDoesNotAllocate(t *testing.T) {
+	defer func(rate uint32, r *resample.Resampler) {
+		playbackRate, playbackResampler, playbackPending = rate, r, nil
+	}(playbackRate, playbackResampler)
+
+	s := &Session{wireRate: sampleRate}
+	c := s.newClient(1, "a")
+	clients := map[uint8]*Client{c.id: c}
+	s.clients.Store(&clients)
+	session.Store(s)
+	defer session.Store(nil)
+
+	playbackRate = 44100
+	playbackResampler, _ = resample.New(int(sampleRate), int(playbackRate))
+	playbackPending = make([]float32, 0, int(playbackRate)/10)
+
+	out := make([]byte, 441*4)
+	playbackDevCb(out, nil, 441)
+	if n := testing.AllocsPerRun(100, func() { playbackDevCb(out, nil, 441) }); n != 0 {
+		t.Errorf("the playback callback allocates %v times per call", n)
+	}
+}
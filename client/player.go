@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/crolbar/lekvc/lekvc/resample"
+	"github.com/crolbar/lekvc/lekvcs/wav"
+)
+
+// Player mixes a decoded file into the outgoing capture stream,
+// the playback side reads it separately so the sender hears it too
+type Player struct {
+	mu sync.Mutex
+
+	name    string
+	samples []float32
+
+	// read positions of the capture and playback side
+	send    int
+	monitor int
+
+	// pass the file through the voice processing with the mic
+	process bool
+}
+
+var (
+	player atomic.Pointer[Player]
+
+	// volume of played files in percent, kept between files
+	playVolume atomic.Uint32
+)
+
+func init() {
+	playVolume.Store(50)
+}
+
+// LoadPlayer decodes a wav file into mono at the session rate
+func LoadPlayer(path string, process bool) (*Player, error) {
+	samples, format, err := wav.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mono, err := resample.Resample(downmix(samples, format.Channels), format.SampleRate, int(sampleRate))
+	if err != nil {
+		return nil, err
+	}
+	if len(mono) == 0 {
+		return nil, fmt.Errorf("%s has no audio", path)
+	}
+
+	return &Player{
+		name:    filepath.Base(path),
+		samples: mono,
+		process: process,
+	}, nil
+}
+
+func (pl *Player) Name() string {
+	return pl.name
+}
+
+// Remaining is how much of the file is left to send
+func (pl *Player) Remaining() time.Duration {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	frames := len(pl.samples) - pl.send
+	return time.Duration(frames) * time.Second / time.Duration(sampleRate)
+}
+
+// mix adds the next len(out) samples at *pos to out,
+// returns false once the file is exhausted
+func (pl *Player) mix(out []float32, pos *int) bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	gain := float32(playVolume.Load()) / 100
+	n := copyMixed(out, pl.samples[minInt(*pos, len(pl.samples)):], gain)
+	*pos += n
+
+	return *pos < len(pl.samples)
+}
+
+// MixSend mixes the file into captured samples
+func (pl *Player) MixSend(out []float32) bool {
+	return pl.mix(out, &pl.send)
+}
+
+// MixMonitor mixes the file into the local playback
+func (pl *Player) MixMonitor(out []float32) bool {
+	return pl.mix(out, &pl.monitor)
+}
+
+func copyMixed(out, in []float32, gain float32) int {
+	n := minInt(len(out), len(in))
+	for i := range n {
+		out[i] += in[i] * gain
+	}
+	return n
+}
+
+// mixPlayer is called from the capture callback before and after the
+// voice processing, the file is mixed in at one of them depending on how it was started
+func mixPlayer(samples []float32, beforeProcessing bool) {
+	pl := player.Load()
+	if pl == nil || pl.process != beforeProcessing {
+		return
+	}
+
+	if !pl.MixSend(samples) && player.CompareAndSwap(pl, nil) {
+		go ChatPrintClient("finished playing " + pl.Name())
+	}
+}
+
+// downmix averages interleaved channels into mono
+func downmix(samples []float32, channels int) []float32 {
+	if channels == 1 {
+		return samples
+	}
+
+	out := make([]float32, len(samples)/channels)
+	for i := range out {
+		var sum float32
+		for ch := range channels {
+			sum += samples[i*channels+ch]
+		}
+		out[i] = sum / float32(channels)
+	}
+	return out
+}
+
+func handlePlay(args []string) {
+	if len(args) == 0 {
+		if pl := player.Load(); pl != nil {
+			ChatPrintClient(fmt.Sprintf("playing %s, %s left, volume %d%%",
+				pl.Name(), pl.Remaining().Round(time.Second), playVolume.Load()))
+		} else {
+			ChatPrintClient(fmt.Sprintf("not playing, volume %d%%", playVolume.Load()))
+		}
+		return
+	}
+
+	if args[0] == "volume" {
+		if len(args) != 2 {
+			ChatPrintClient("\x1b[31musage: /play volume <0-200>\x1b[m")
+			return
+		}
+		percent, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil || percent > 200 {
+			ChatPrintClient(fmt.Sprintf("\x1b[31minvalid volume %q\x1b[m", args[1]))
+			return
+		}
+		playVolume.Store(uint32(percent))
+		ChatPrintClient(fmt.Sprintf("play volume %d%%", percent))
+		return
+	}
+
+	process := len(args) > 1 && args[1] == "fx"
+
+	pl, err := LoadPlayer(args[0], process)
+	if err != nil {
+		ChatPrintClient(fmt.Sprintf("\x1b[31mplay: %s\x1b[m", err.Error()))
+		return
+	}
+
+	player.Store(pl)
+	ChatPrintClient(fmt.Sprintf("playing %s (%s)", pl.Name(), pl.Remaining().Round(time.Second)))
+}
+
+func handleStop(args []string) {
+	pl := player.Swap(nil)
+	if pl == nil {
+		ChatPrintClient("not playing")
+		return
+	}
+	ChatPrintClient("stopped " + pl.Name())
+}
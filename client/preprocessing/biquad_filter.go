@@ -1,6 +1,18 @@
 package preprocessing
 
-import "math"
+import (
+	"fmt"
+	"math"
+)
+
+type filterKind uint8
+
+const (
+	lowPass filterKind = iota
+	highPass
+	peaking
+	bandPass
+)
 
 type BiquadFilter struct {
 	a0, a1, a2 float64
@@ -8,32 +20,52 @@ type BiquadFilter struct {
 
 	x1, x2 float64
 	y1, y2 float64
+
+	// kept so the coefficients can be recomputed when a param changes
+	kind       filterKind
+	sampleRate int
+	freq       float64
+	q          float64
+	gainDB     float64
 }
 
 func NewLowPassFilter(sampleRate int, cutoffFreq, q float64) *BiquadFilter {
-	filter := &BiquadFilter{}
+	filter := &BiquadFilter{kind: lowPass, sampleRate: sampleRate, freq: cutoffFreq, q: q}
 	filter.setLowPass(sampleRate, cutoffFreq, q)
 	return filter
 }
 
 func NewHighPassFilter(sampleRate int, cutoffFreq, q float64) *BiquadFilter {
-	filter := &BiquadFilter{}
+	filter := &BiquadFilter{kind: highPass, sampleRate: sampleRate, freq: cutoffFreq, q: q}
 	filter.setHighPass(sampleRate, cutoffFreq, q)
 	return filter
 }
 
 func NewPeakingFilter(sampleRate int, centerFreq, gainDB, q float64) *BiquadFilter {
-	filter := &BiquadFilter{}
+	filter := &BiquadFilter{kind: peaking, sampleRate: sampleRate, freq: centerFreq, q: q, gainDB: gainDB}
 	filter.setPeakingEQ(sampleRate, centerFreq, gainDB, q)
 	return filter
 }
 
 func NewBandPassFilter(sampleRate int, centerFreq, q float64) *BiquadFilter {
-	filter := &BiquadFilter{}
+	filter := &BiquadFilter{kind: bandPass, sampleRate: sampleRate, freq: centerFreq, q: q}
 	filter.setBandPass(sampleRate, centerFreq, q)
 	return filter
 }
 
+func (f *BiquadFilter) updateCoefficients() {
+	switch f.kind {
+	case lowPass:
+		f.setLowPass(f.sampleRate, f.freq, f.q)
+	case highPass:
+		f.setHighPass(f.sampleRate, f.freq, f.q)
+	case peaking:
+		f.setPeakingEQ(f.sampleRate, f.freq, f.gainDB, f.q)
+	case bandPass:
+		f.setBandPass(f.sampleRate, f.freq, f.q)
+	}
+}
+
 func (f *BiquadFilter) setLowPass(sampleRate int, cutoffFreq, q float64) {
 	w0 := 2.0 * math.Pi * cutoffFreq / float64(sampleRate)
 	alpha := math.Sin(w0) / (2.0 * q)
@@ -115,7 +147,8 @@ func (f *BiquadFilter) setBandPass(sampleRate int, centerFreq, q float64) {
 	f.a0 = 1.0
 }
 
-func (f *BiquadFilter) Process(samples []float32) {
+// Process filters samples in place and returns them
+func (f *BiquadFilter) Process(samples []float32) []float32 {
 	for i := range samples {
 
 		x := float64(samples[i])
@@ -129,6 +162,8 @@ func (f *BiquadFilter) Process(samples []float32) {
 
 		samples[i] = float32(y)
 	}
+
+	return samples
 }
 
 func (f *BiquadFilter) ProcessSample(sample float32) float32 {
@@ -149,3 +184,36 @@ func (f *BiquadFilter) Reset() {
 	f.y1 = 0.0
 	f.y2 = 0.0
 }
+
+func (f *BiquadFilter) Params() map[string]float32 {
+	params := map[string]float32{
+		"freq": float32(f.freq),
+		"q":    float32(f.q),
+	}
+	if f.kind == peaking {
+		params["gain"] = float32(f.gainDB)
+	}
+	return params
+}
+
+func (f *BiquadFilter) SetParam(name string, value float32) error {
+	switch {
+	case name == "freq":
+		if value <= 0 || float64(value) >= float64(f.sampleRate)/2 {
+			return fmt.Errorf("freq must be between 0 and %d Hz", f.sampleRate/2)
+		}
+		f.freq = float64(value)
+	case name == "q":
+		if value <= 0 {
+			return fmt.Errorf("q must be positive")
+		}
+		f.q = float64(value)
+	case name == "gain" && f.kind == peaking:
+		f.gainDB = float64(value)
+	default:
+		return fmt.Errorf("unknown filter param %q", name)
+	}
+
+	f.updateCoefficients()
+	return nil
+}
@@ -1,16 +1,25 @@
 package preprocessing
 
-import "math"
+import (
+	"fmt"
+	"math"
+	"slices"
+)
 
 type Compressor struct {
 	sampleRate   int
 	thresholdDB  float32
 	ratio        float32
+	attackMs     float32
+	releaseMs    float32
 	attackCoeff  float32
 	releaseCoeff float32
 
 	envelope   float32
 	makeupGain float32
+
+	processed     int
+	gainReduction []int
 }
 
 func NewCompressor(sampleRate int, thresholdDB, ratio, attackMs, releaseMs float32) *Compressor {
@@ -22,11 +31,8 @@ func NewCompressor(sampleRate int, thresholdDB, ratio, attackMs, releaseMs float
 		makeupGain:  1.0,
 	}
 
-	attackSec := float64(attackMs) / 1000.0
-	releaseSec := float64(releaseMs) / 1000.0
-
-	c.attackCoeff = float32(1.0 - math.Exp(-1.0/(attackSec*float64(sampleRate))))
-	c.releaseCoeff = float32(1.0 - math.Exp(-1.0/(releaseSec*float64(sampleRate))))
+	c.SetAttack(attackMs)
+	c.SetRelease(releaseMs)
 
 	c.makeupGain = float32(math.Pow(10.0, float64(-thresholdDB*(1.0-1.0/ratio))/40.0))
 
@@ -34,7 +40,6 @@ func NewCompressor(sampleRate int, thresholdDB, ratio, attackMs, releaseMs float
 }
 
 func (c *Compressor) Process(samples []float32) []float32 {
-	output := make([]float32, len(samples))
 	threshold := dbToLinear(c.thresholdDB)
 
 	for i, sample := range samples {
@@ -57,16 +62,20 @@ func (c *Compressor) Process(samples []float32) []float32 {
 			gain = dbToLinear(gainReductionDB)
 		}
 
-		output[i] = sample * gain * c.makeupGain
+		countGainReduction(c.gainReduction, gain)
+
+		samples[i] = sample * gain * c.makeupGain
 
-		if output[i] > 1.0 {
-			output[i] = 1.0
-		} else if output[i] < -1.0 {
-			output[i] = -1.0
+		if samples[i] > 1.0 {
+			samples[i] = 1.0
+		} else if samples[i] < -1.0 {
+			samples[i] = -1.0
 		}
 	}
 
-	return output
+	c.processed += len(samples)
+
+	return samples
 }
 
 func (c *Compressor) Reset() {
@@ -84,3 +93,58 @@ func (c *Compressor) SetRatio(ratio float32) {
 
 	c.makeupGain = float32(math.Pow(10.0, float64(-c.thresholdDB*(1.0-1.0/ratio))/40.0))
 }
+
+func (c *Compressor) SetAttack(attackMs float32) {
+	c.attackMs = attackMs
+	c.attackCoeff = timeCoeff(attackMs, c.sampleRate)
+}
+
+func (c *Compressor) SetRelease(releaseMs float32) {
+	c.releaseMs = releaseMs
+	c.releaseCoeff = timeCoeff(releaseMs, c.sampleRate)
+}
+
+func (c *Compressor) collectStats() {
+	c.gainReduction = newGainReductionHistogram()
+}
+
+func (c *Compressor) Stats() Stats {
+	return Stats{
+		Samples:       c.processed,
+		GainReduction: slices.Clone(c.gainReduction),
+	}
+}
+
+func (c *Compressor) Params() map[string]float32 {
+	return map[string]float32{
+		"threshold": c.thresholdDB,
+		"ratio":     c.ratio,
+		"attack":    c.attackMs,
+		"release":   c.releaseMs,
+	}
+}
+
+func (c *Compressor) SetParam(name string, value float32) error {
+	switch name {
+	case "threshold":
+		c.SetThreshold(value)
+	case "ratio":
+		if value < 1 {
+			return fmt.Errorf("ratio must be at least 1")
+		}
+		c.SetRatio(value)
+	case "attack":
+		if value <= 0 {
+			return fmt.Errorf("attack must be positive")
+		}
+		c.SetAttack(value)
+	case "release":
+		if value <= 0 {
+			return fmt.Errorf("release must be positive")
+		}
+		c.SetRelease(value)
+	default:
+		return fmt.Errorf("unknown compressor param %q", name)
+	}
+	return nil
+}
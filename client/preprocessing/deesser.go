@@ -1,6 +1,9 @@
 package preprocessing
 
-import "math"
+import (
+	"fmt"
+	"slices"
+)
 
 type DeEsser struct {
 	sampleRate  int
@@ -9,12 +12,16 @@ type DeEsser struct {
 	ratio       float32
 
 	sidechainFilter *BiquadFilter
+	sidechain       []float32
 
 	compressor *Compressor
 
 	envelope     float32
 	attackCoeff  float32
 	releaseCoeff float32
+
+	processed     int
+	gainReduction []int
 }
 
 func NewDeEsser(sampleRate int, frequency, thresholdDB, ratio float32) *DeEsser {
@@ -27,23 +34,20 @@ func NewDeEsser(sampleRate int, frequency, thresholdDB, ratio float32) *DeEsser
 	}
 
 	de.sidechainFilter = NewBandPassFilter(sampleRate, float64(frequency), 2.0)
+	de.sidechain = make([]float32, sampleRate/10)
 
-	attackMs := float32(1.0)
-	releaseMs := float32(50.0)
-
-	attackSec := float64(attackMs) / 1000.0
-	releaseSec := float64(releaseMs) / 1000.0
-
-	de.attackCoeff = float32(1.0 - math.Exp(-1.0/(attackSec*float64(sampleRate))))
-	de.releaseCoeff = float32(1.0 - math.Exp(-1.0/(releaseSec*float64(sampleRate))))
+	de.attackCoeff = timeCoeff(1.0, sampleRate)
+	de.releaseCoeff = timeCoeff(50.0, sampleRate)
 
 	return de
 }
 
 func (de *DeEsser) Process(samples []float32) []float32 {
-	output := make([]float32, len(samples))
-
-	sidechain := make([]float32, len(samples))
+	// grows once to the block size of the audio callback
+	if cap(de.sidechain) < len(samples) {
+		de.sidechain = make([]float32, len(samples))
+	}
+	sidechain := de.sidechain[:len(samples)]
 	copy(sidechain, samples)
 	de.sidechainFilter.Process(sidechain)
 
@@ -73,10 +77,14 @@ func (de *DeEsser) Process(samples []float32) []float32 {
 			}
 		}
 
-		output[i] = sample * gain
+		countGainReduction(de.gainReduction, gain)
+
+		samples[i] = sample * gain
 	}
 
-	return output
+	de.processed += len(samples)
+
+	return samples
 }
 
 func (de *DeEsser) Reset() {
@@ -93,3 +101,46 @@ func (de *DeEsser) SetFrequency(frequency float32) {
 
 	de.sidechainFilter = NewBandPassFilter(de.sampleRate, float64(frequency), 2.0)
 }
+
+func (de *DeEsser) SetRatio(ratio float32) {
+	de.ratio = ratio
+}
+
+func (de *DeEsser) collectStats() {
+	de.gainReduction = newGainReductionHistogram()
+}
+
+func (de *DeEsser) Stats() Stats {
+	return Stats{
+		Samples:       de.processed,
+		GainReduction: slices.Clone(de.gainReduction),
+	}
+}
+
+func (de *DeEsser) Params() map[string]float32 {
+	return map[string]float32{
+		"frequency": de.frequency,
+		"threshold": de.thresholdDB,
+		"ratio":     de.ratio,
+	}
+}
+
+func (de *DeEsser) SetParam(name string, value float32) error {
+	switch name {
+	case "frequency":
+		if value <= 0 || int(value) >= de.sampleRate/2 {
+			return fmt.Errorf("frequency must be between 0 and %d Hz", de.sampleRate/2)
+		}
+		de.SetFrequency(value)
+	case "threshold":
+		de.SetThreshold(value)
+	case "ratio":
+		if value < 1 {
+			return fmt.Errorf("ratio must be at least 1")
+		}
+		de.SetRatio(value)
+	default:
+		return fmt.Errorf("unknown de-esser param %q", name)
+	}
+	return nil
+}
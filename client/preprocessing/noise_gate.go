@@ -1,6 +1,9 @@
 package preprocessing
 
-import "math"
+import (
+	"fmt"
+	"math"
+)
 
 type NoiseGate struct {
 	sampleRate   int
@@ -15,6 +18,9 @@ type NoiseGate struct {
 	gateOpen    bool
 	holdCounter int
 	currentGain float32
+
+	processed int
+	openCount int
 }
 
 func NewNoiseGate(sampleRate int, thresholdDB, hysteresisDB float32) *NoiseGate {
@@ -40,7 +46,6 @@ func NewNoiseGate(sampleRate int, thresholdDB, hysteresisDB float32) *NoiseGate
 }
 
 func (ng *NoiseGate) Process(samples []float32) []float32 {
-	output := make([]float32, len(samples))
 
 	openThreshold := dbToLinear(ng.thresholdDB)
 	closeThreshold := dbToLinear(ng.thresholdDB - ng.hysteresisDB)
@@ -86,10 +91,16 @@ func (ng *NoiseGate) Process(samples []float32) []float32 {
 			ng.currentGain += ng.releaseCoeff * (targetGain - ng.currentGain)
 		}
 
-		output[i] = sample * ng.currentGain
+		samples[i] = sample * ng.currentGain
+
+		if ng.gateOpen {
+			ng.openCount++
+		}
 	}
 
-	return output
+	ng.processed += len(samples)
+
+	return samples
 }
 
 func (ng *NoiseGate) Reset() {
@@ -106,3 +117,35 @@ func (ng *NoiseGate) SetThreshold(thresholdDB float32) {
 func (ng *NoiseGate) SetHysteresis(hysteresisDB float32) {
 	ng.hysteresisDB = hysteresisDB
 }
+
+// collectStats has nothing to start, counting open samples is cheap
+func (ng *NoiseGate) collectStats() {}
+
+func (ng *NoiseGate) Stats() Stats {
+	return Stats{
+		Samples:  ng.processed,
+		GateOpen: ng.openCount,
+	}
+}
+
+func (ng *NoiseGate) Params() map[string]float32 {
+	return map[string]float32{
+		"threshold":  ng.thresholdDB,
+		"hysteresis": ng.hysteresisDB,
+	}
+}
+
+func (ng *NoiseGate) SetParam(name string, value float32) error {
+	switch name {
+	case "threshold":
+		ng.SetThreshold(value)
+	case "hysteresis":
+		if value < 0 {
+			return fmt.Errorf("hysteresis can't be negative")
+		}
+		ng.SetHysteresis(value)
+	default:
+		return fmt.Errorf("unknown gate param %q", name)
+	}
+	return nil
+}
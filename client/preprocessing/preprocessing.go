@@ -1,98 +1,308 @@
 package preprocessing
 
-import "math"
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
 
-type AudioProcessor struct {
-	sampleRate int
+type pipelineStage struct {
+	name     string
+	typ      string
+	disabled bool
+	stage    Stage
+}
 
-	gate *NoiseGate
+// pipeline is one configuration of the processor, it never changes once
+// published. Changes build a new one and swap it in, so Process never waits.
+type pipeline struct {
+	stages []*pipelineStage
+	bypass bool
 
-	highPass *BiquadFilter
-	lowPass  *BiquadFilter
+	// whether Process crossfades when it picks this pipeline up,
+	// from the one it replaced or, while from is nil, from silence
+	fade bool
+	from *pipeline
+}
+
+// crossfade length used when switching pipelines or after a Reset
+const fadeMs = 20
+
+// AudioProcessor is safe to reconfigure while Process runs on the audio thread,
+// Process takes no lock and doesn't allocate
+type AudioProcessor struct {
+	sampleRate int
 
-	compressor *Compressor
-	deEsser    *DeEsser
+	pipeline atomic.Pointer[pipeline]
+	// serializes the changes, Process never takes it
+	mu sync.Mutex
 
-	eqFilters []*BiquadFilter
+	// owned by Process: the pipeline it runs, the one it fades out from,
+	// nil fades in from silence, and where that one's output goes
+	current  *pipeline
+	fadeFrom *pipeline
+	fadeLen  int
+	fadePos  int
+	fadeBuf  []float32
 }
 
 // NewAudioProcessor creates a new audio processor optimized for voice
-func NewAudioProcessor(sampleRate int) *AudioProcessor {
+func NewAudioProcessor(sampleRate int) (*AudioProcessor, error) {
+	return NewAudioProcessorFromConfig(sampleRate, DefaultConfig())
+}
+
+// NewAudioProcessorFromConfig creates an audio processor running the stages described by cfg
+func NewAudioProcessorFromConfig(sampleRate int, cfg Config) (*AudioProcessor, error) {
+	stages, err := newStages(sampleRate, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	fadeLen := sampleRate * fadeMs / 1000
 	ap := &AudioProcessor{
 		sampleRate: sampleRate,
+		fadeLen:    fadeLen,
+		fadePos:    fadeLen,
+		// a tenth of a second is more than any audio callback hands over
+		fadeBuf: make([]float32, sampleRate/10),
 	}
+	ap.pipeline.Store(&pipeline{stages: stages, bypass: cfg.Bypass})
+	return ap, nil
+}
 
-	// Advanced noise gate with smooth attack/release
-	ap.gate = NewNoiseGate(sampleRate, -40.0, 10.0)
+func newStages(sampleRate int, cfg Config) ([]*pipelineStage, error) {
+	stages := make([]*pipelineStage, 0, len(cfg.Stages))
 
-	// High-pass filter at 80Hz to remove rumble and pops
-	ap.highPass = NewHighPassFilter(sampleRate, 80.0, 0.707)
+	used := make(map[string]bool)
+	for _, sc := range cfg.Stages {
+		stage, err := NewStage(sampleRate, sc)
+		if err != nil {
+			return nil, err
+		}
 
-	// Low-pass filter at 8kHz (voice range upper limit)
-	ap.lowPass = NewLowPassFilter(sampleRate, 8000.0, 0.707)
+		name := sc.Name
+		if name == "" {
+			name = sc.Type
+		}
+		// make names unique so every stage can be addressed,
+		// keeping the given name recognizable
+		base := name
+		for i := 2; used[name]; i++ {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		used[name] = true
 
-	// Compressor for evening out dynamics (-20dB threshold, 3:1 ratio)
-	ap.compressor = NewCompressor(sampleRate, -20.0, 3.0, 10.0, 50.0)
+		stages = append(stages, &pipelineStage{
+			name:     name,
+			typ:      sc.Type,
+			disabled: sc.Disabled,
+			stage:    stage,
+		})
+	}
 
-	// De-esser to tame harsh sibilants around 6-8kHz
-	ap.deEsser = NewDeEsser(sampleRate, 6500.0, -12.0, 2.0)
+	return stages, nil
+}
 
-	// Voice-optimized EQ
-	ap.eqFilters = []*BiquadFilter{
-		// Boost presence around 3kHz for clarity
-		NewPeakingFilter(sampleRate, 3000.0, 2.0, 1.2),
-		// Slight cut around 250Hz to reduce muddiness
-		NewPeakingFilter(sampleRate, 250.0, -1.5, 1.5),
-		// Boost high-mids for intelligibility
-		NewPeakingFilter(sampleRate, 5000.0, 1.5, 1.0),
+// runStages processes samples in place with every enabled stage
+func runStages(stages []*pipelineStage, samples []float32) {
+	for _, ps := range stages {
+		if !ps.disabled {
+			ps.stage.Process(samples)
+		}
 	}
-
-	return ap
 }
 
-// Process applies all preprocessing to the audio samples
+// Process applies all enabled stages, in order, to the audio samples in place
 func (ap *AudioProcessor) Process(samples []float32) []float32 {
 	if len(samples) == 0 {
 		return samples
 	}
 
-	// Make a copy to avoid modifying the original
-	processed := make([]float32, len(samples))
-	copy(processed, samples)
+	p := ap.pipeline.Load()
+	if p != ap.current {
+		ap.current = p
+		if p.fade {
+			ap.fadeFrom = p.from
+			ap.fadePos = 0
+		}
+	}
+
+	if ap.fadePos >= ap.fadeLen {
+		if !p.bypass {
+			runStages(p.stages, samples)
+		}
+		return samples
+	}
+
+	if cap(ap.fadeBuf) < len(samples) {
+		ap.fadeBuf = make([]float32, len(samples))
+	}
+	from := ap.fadeBuf[:len(samples)]
 
-	// 1. High-pass filter (remove low-frequency rumble)
-	ap.highPass.Process(processed)
+	switch {
+	case ap.fadeFrom == nil:
+		clear(from)
+		if !p.bypass {
+			runStages(p.stages, samples)
+		}
+	case sameStages(ap.fadeFrom, p):
+		// only bypass was toggled, the stages must not run twice
+		copy(from, samples)
+		if p.bypass {
+			runStages(p.stages, from)
+		} else {
+			runStages(p.stages, samples)
+		}
+	default:
+		copy(from, samples)
+		if !ap.fadeFrom.bypass {
+			runStages(ap.fadeFrom.stages, from)
+		}
+		if !p.bypass {
+			runStages(p.stages, samples)
+		}
+	}
 
-	// 3. Low-pass filter (remove high-frequency noise above voice range)
-	ap.lowPass.Process(processed)
+	for i := range samples {
+		if ap.fadePos >= ap.fadeLen {
+			break
+		}
+		t := float32(ap.fadePos) / float32(ap.fadeLen)
+		samples[i] = from[i]*(1-t) + samples[i]*t
+		ap.fadePos++
+	}
 
-	// 4. Voice EQ
-	for _, filter := range ap.eqFilters {
-		filter.Process(processed)
+	if ap.fadePos >= ap.fadeLen {
+		ap.fadeFrom = nil
 	}
 
-	// 5. De-esser (reduce harsh sibilants)
-	processed = ap.deEsser.Process(processed)
+	return samples
+}
+
+func sameStages(a, b *pipeline) bool {
+	return len(a.stages) == len(b.stages) && (len(a.stages) == 0 || &a.stages[0] == &b.stages[0])
+}
+
+// swap publishes a pipeline crossfaded from the running one, mu must be held
+func (ap *AudioProcessor) swap(stages []*pipelineStage, bypass bool) {
+	old := ap.pipeline.Load()
+	ap.pipeline.Store(&pipeline{
+		stages: stages,
+		bypass: bypass,
+		fade:   true,
+		// without its own fade, so old pipelines don't chain up
+		from: &pipeline{stages: old.stages, bypass: old.bypass},
+	})
+}
+
+// SetConfig switches to a new pipeline, crossfading from the old one
+func (ap *AudioProcessor) SetConfig(cfg Config) error {
+	stages, err := newStages(ap.sampleRate, cfg)
+	if err != nil {
+		return err
+	}
 
-	// 6. Compressor (even out dynamics)
-	processed = ap.compressor.Process(processed)
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
 
-	// 7. Noise gate (final cleanup with smooth envelope)
-	processed = ap.gate.Process(processed)
+	// reapplying the same config keeps the running stages and doesn't fade
+	p := ap.pipeline.Load()
+	if reflect.DeepEqual(stagesConfig(stages, cfg.Bypass), stagesConfig(p.stages, p.bypass)) {
+		return nil
+	}
 
-	return processed
+	ap.swap(stages, cfg.Bypass)
+	return nil
 }
 
-// Reset resets all stateful processors (useful when connection drops)
+// Reset starts over with fresh stages (useful when connection drops)
+// and fades the output back in to avoid a click
 func (ap *AudioProcessor) Reset() {
-	ap.gate.Reset()
-	ap.highPass.Reset()
-	ap.lowPass.Reset()
-	ap.compressor.Reset()
-	ap.deEsser.Reset()
-	for _, filter := range ap.eqFilters {
-		filter.Reset()
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	p := ap.pipeline.Load()
+	// the running config built these stages already
+	stages, _ := newStages(ap.sampleRate, stagesConfig(p.stages, p.bypass))
+	ap.pipeline.Store(&pipeline{stages: stages, bypass: p.bypass, fade: true})
+}
+
+// change builds the pipeline with the named stage's config changed by f
+// and crossfades to it, mu must be held
+func (ap *AudioProcessor) change(stage string, f func(sc *StageConfig)) error {
+	p := ap.pipeline.Load()
+	cfg := stagesConfig(p.stages, p.bypass)
+
+	i := slices.IndexFunc(cfg.Stages, func(sc StageConfig) bool { return sc.Name == stage })
+	if i < 0 {
+		return fmt.Errorf("no stage named %q", stage)
+	}
+	f(&cfg.Stages[i])
+
+	stages, err := newStages(ap.sampleRate, cfg)
+	if err != nil {
+		return err
+	}
+	ap.swap(stages, p.bypass)
+	return nil
+}
+
+// SetParam changes a param of the named stage, filter frequencies above
+// MaxFreq are lowered to it like in a config
+func (ap *AudioProcessor) SetParam(stage, param string, value float32) error {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	return ap.change(stage, func(sc *StageConfig) {
+		sc.Params[param] = value
+	})
+}
+
+// SetStageEnabled enables or disables the named stage
+func (ap *AudioProcessor) SetStageEnabled(stage string, enabled bool) error {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	return ap.change(stage, func(sc *StageConfig) {
+		sc.Disabled = !enabled
+	})
+}
+
+// SetBypass turns all processing off (true) or back on (false)
+func (ap *AudioProcessor) SetBypass(bypass bool) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	p := ap.pipeline.Load()
+	if p.bypass == bypass {
+		return
+	}
+	ap.swap(p.stages, bypass)
+}
+
+// Config describes the current pipeline including changed params
+func (ap *AudioProcessor) Config() Config {
+	p := ap.pipeline.Load()
+	return stagesConfig(p.stages, p.bypass)
+}
+
+func stagesConfig(stages []*pipelineStage, bypass bool) Config {
+	cfg := Config{
+		Bypass: bypass,
+		Stages: make([]StageConfig, 0, len(stages)),
 	}
+	for _, ps := range stages {
+		cfg.Stages = append(cfg.Stages, StageConfig{
+			Type:     ps.typ,
+			Name:     ps.name,
+			Disabled: ps.disabled,
+			Params:   ps.stage.Params(),
+		})
+	}
+	return cfg
 }
 
 // Helper functions
@@ -114,3 +324,9 @@ func abs32(x float32) float32 {
 	}
 	return x
 }
+
+// timeCoeff converts an attack/release time to a one-pole smoothing coefficient
+func timeCoeff(ms float32, sampleRate int) float32 {
+	sec := float64(ms) / 1000.0
+	return float32(1.0 - math.Exp(-1.0/(sec*float64(sampleRate))))
+}
@@ -0,0 +1,325 @@
+package preprocessing
+
+import (
+	"encoding/json"
+	"math"
+	"slices"
+	"testing"
+)
+
+func stageNames(ap *AudioProcessor) []string {
+	var names []string
+	for _, sc := range ap.Config().Stages {
+		names = append(names, sc.Name)
+	}
+	return names
+}
+
+func TestConfigParsing(t *testing.T) {
+	data := `{"bypass": true, "stages": [
+		{"type": "highpass", "params": {"freq": 120}},
+		{"type": "peaking", "name": "presence", "disabled": true, "params": {"freq": 3000, "gain": 2}}
+	]}`
+
+	var cfg Config
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	ap, err := NewAudioProcessorFromConfig(48000, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := ap.Config()
+	if !got.Bypass || len(got.Stages) != 2 {
+		t.Fatalf("config = %+v, want bypass and 2 stages", got)
+	}
+	if got.Stages[0].Name != "highpass" || got.Stages[0].Params["freq"] != 120 {
+		t.Errorf("first stage = %+v, want highpass at 120 Hz", got.Stages[0])
+	}
+	if s := got.Stages[1]; s.Name != "presence" || !s.Disabled || s.Params["gain"] != 2 {
+		t.Errorf("second stage = %+v, want disabled presence with 2 dB gain", s)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []Config{
+		{Stages: []StageConfig{{Type: "reverb"}}},
+		{Stages: []StageConfig{{Type: "highpass", Params: map[string]float32{"volume": 1}}}},
+		{Stages: []StageConfig{{Type: "compressor", Params: map[string]float32{"ratio": 0}}}},
+	}
+	for _, cfg := range tests {
+		if _, err := NewAudioProcessorFromConfig(48000, cfg); err == nil {
+			t.Errorf("config %+v was accepted", cfg.Stages)
+		}
+	}
+}
+
+func TestDuplicateStageNames(t *testing.T) {
+	cfg := Config{Stages: []StageConfig{
+		{Type: "peaking", Name: "presence"},
+		{Type: "peaking", Name: "presence"},
+		{Type: "peaking"},
+		{Type: "peaking"},
+	}}
+	ap, err := NewAudioProcessorFromConfig(48000, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"presence", "presence-2", "peaking", "peaking-2"}
+	if got := stageNames(ap); !slices.Equal(got, want) {
+		t.Fatalf("names = %q, want %q", got, want)
+	}
+
+	if err := ap.SetParam("presence-2", "gain", 4); err != nil {
+		t.Fatal(err)
+	}
+	stages := ap.Config().Stages
+	if stages[0].Params["gain"] != 0 || stages[1].Params["gain"] != 4 {
+		t.Errorf("gains = %v, %v, want 0, 4", stages[0].Params["gain"], stages[1].Params["gain"])
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	ap, err := NewAudioProcessorFromConfig(48000, DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ap.SetParam("compressor", "ratio", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := ap.SetStageEnabled("gate", false); err != nil {
+		t.Fatal(err)
+	}
+
+	ap2, err := NewAudioProcessorFromConfig(48000, ap.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := json.Marshal(ap.Config())
+	b, _ := json.Marshal(ap2.Config())
+	if string(a) != string(b) {
+		t.Errorf("config changed going through a processor:\n%s\n%s", a, b)
+	}
+}
+
+func TestDisabledStage(t *testing.T) {
+	cfg := Config{Stages: []StageConfig{
+		{Type: "highpass", Disabled: true},
+	}}
+	ap, err := NewAudioProcessorFromConfig(48000, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := []float32{0.5, -0.25, 0.125, 0}
+	// let the fade in from silence finish
+	for range 10 {
+		ap.Process(make([]float32, 1000))
+	}
+	out := ap.Process(slices.Clone(in))
+	if !slices.Equal(out, in) {
+		t.Errorf("disabled stage changed samples: %v", out)
+	}
+
+	if err := ap.SetStageEnabled("highpass", true); err != nil {
+		t.Fatal(err)
+	}
+	for range 10 {
+		ap.Process(make([]float32, 1000))
+	}
+	if out := ap.Process(slices.Clone(in)); slices.Equal(out, in) {
+		t.Error("enabled highpass left samples untouched")
+	}
+}
+
+func TestPresetsAtLowRates(t *testing.T) {
+	for _, rate := range []int{8000, 11025, 16000, 22050, 44100, 48000} {
+		for _, name := range PresetNames() {
+			cfg, _ := Preset(name)
+			ap, err := NewAudioProcessorFromConfig(rate, cfg)
+			if err != nil {
+				t.Errorf("preset %s at %d Hz: %v", name, rate, err)
+				continue
+			}
+
+			samples := make([]float32, rate)
+			for i := range samples {
+				samples[i] = float32(0.5 * math.Sin(2*math.Pi*440*float64(i)/float64(rate)))
+			}
+			for _, s := range ap.Process(samples) {
+				if math.IsNaN(float64(s)) || math.IsInf(float64(s), 0) || math.Abs(float64(s)) > 4 {
+					t.Errorf("preset %s at %d Hz is unstable: %v", name, rate, s)
+					break
+				}
+			}
+
+			for _, sc := range ap.Config().Stages {
+				for _, param := range []string{"freq", "frequency"} {
+					if f, ok := sc.Params[param]; ok && f > MaxFreq(rate) {
+						t.Errorf("preset %s at %d Hz: %s %s is %v, above %v", name, rate, sc.Name, param, f, MaxFreq(rate))
+					}
+				}
+			}
+		}
+
+		if _, err := NewAudioProcessor(rate); err != nil {
+			t.Errorf("default processor at %d Hz: %v", rate, err)
+		}
+	}
+}
+
+// sine feeds a 200 Hz tone through ap in 10 ms chunks, continuing at sample start
+func sine(ap *AudioProcessor, rate, start, n int) []float32 {
+	var out []float32
+	chunk := rate / 100
+	for i := start; i < start+n; i += chunk {
+		samples := make([]float32, chunk)
+		for j := range samples {
+			samples[j] = float32(0.05 * math.Sin(2*math.Pi*200*float64(i+j)/float64(rate)))
+		}
+		out = append(out, ap.Process(samples)...)
+	}
+	return out
+}
+
+func maxJump(samples []float32) float64 {
+	var jump float64
+	for i := 1; i < len(samples); i++ {
+		jump = max(jump, math.Abs(float64(samples[i]-samples[i-1])))
+	}
+	return jump
+}
+
+func TestSwitchCrossfade(t *testing.T) {
+	const rate = 48000
+	quiet := Config{Stages: []StageConfig{
+		{Type: "peaking", Params: map[string]float32{"freq": 200, "gain": -12, "q": 1}},
+	}}
+	loud := Config{Stages: []StageConfig{
+		{Type: "peaking", Params: map[string]float32{"freq": 200, "gain": 12, "q": 1}},
+	}}
+
+	ap, err := NewAudioProcessorFromConfig(rate, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// switch on a peak of the tone, where a hard cut jumps most
+	const at = rate/2 + rate/200/4
+	before := sine(ap, rate, rate/200/4, rate/2)
+	if err := ap.SetConfig(loud); err != nil {
+		t.Fatal(err)
+	}
+	after := sine(ap, rate, at, rate/2)
+
+	// the largest step of the loud tone once it settled
+	steady := maxJump(after[len(after)-rate/10:])
+	fadeLen := rate * fadeMs / 1000
+	window := append(before[len(before)-1:], after[:2*fadeLen]...)
+	if got := maxJump(window); got > 1.5*steady {
+		t.Errorf("largest step while fading is %.5f, the settled tone's is %.5f", got, steady)
+	}
+
+	// the same switch without a fade, to be sure the window would catch one
+	cut, _ := NewAudioProcessorFromConfig(rate, loud)
+	hard := append(before[len(before)-1:], sine(cut, rate, at, fadeLen)...)
+	if got := maxJump(hard); got <= 1.5*steady {
+		t.Errorf("a hard cut steps only %.5f, the test can't tell it from a fade", got)
+	}
+}
+
+func TestSetSameConfigDoesNotFade(t *testing.T) {
+	const rate = 48000
+	cfg, _ := Preset("voice")
+
+	ap, _ := NewAudioProcessorFromConfig(rate, cfg)
+	twin, _ := NewAudioProcessorFromConfig(rate, cfg)
+	sine(ap, rate, 0, rate/10)
+	sine(twin, rate, 0, rate/10)
+
+	if err := ap.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := ap.SetConfig(ap.Config()); err != nil {
+		t.Fatal(err)
+	}
+	ap.SetBypass(cfg.Bypass)
+
+	got := sine(ap, rate, rate/10, rate/10)
+	want := sine(twin, rate, rate/10, rate/10)
+	if !slices.Equal(got, want) {
+		t.Error("setting the running config changed the output")
+	}
+}
+
+// voiceBlock is a 10 ms block of a loud 200 Hz tone
+func voiceBlock(rate int) []float32 {
+	samples := make([]float32, rate/100)
+	for i := range samples {
+		samples[i] = float32(0.5 * math.Sin(2*math.Pi*200*float64(i)/float64(rate)))
+	}
+	return samples
+}
+
+func TestProcessDoesNotAllocate(t *testing.T) {
+	const rate = 48000
+	ap, _ := NewAudioProcessor(rate)
+	samples := voiceBlock(rate)
+
+	if n := testing.AllocsPerRun(100, func() { ap.Process(samples) }); n != 0 {
+		t.Errorf("Process allocates %v times per call", n)
+	}
+
+	// a fade long enough to last through every run, both pipelines run
+	broadcast, _ := Preset("broadcast")
+	ap.fadeLen = rate * 10
+	if err := ap.SetConfig(broadcast); err != nil {
+		t.Fatal(err)
+	}
+	ap.Process(samples)
+	if n := testing.AllocsPerRun(100, func() { ap.Process(samples) }); n != 0 {
+		t.Errorf("Process allocates %v times per call while fading", n)
+	}
+	if ap.fadeFrom == nil {
+		t.Error("the fade ended early")
+	}
+}
+
+func TestReconfigureWhileProcessing(t *testing.T) {
+	const rate = 48000
+	ap, _ := NewAudioProcessor(rate)
+	voice, _ := Preset("voice")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 200 {
+			switch i % 4 {
+			case 0:
+				ap.SetBypass(i%8 == 0)
+			case 1:
+				ap.SetParam("compressor", "ratio", float32(2+i%5))
+			case 2:
+				ap.SetStageEnabled("gate", i%3 == 0)
+			case 3:
+				ap.SetConfig(voice)
+			}
+			ap.Config()
+		}
+	}()
+
+	samples := voiceBlock(rate)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		for _, s := range ap.Process(samples) {
+			if math.IsNaN(float64(s)) || math.Abs(float64(s)) > 4 {
+				t.Fatalf("unstable output %v", s)
+			}
+		}
+	}
+}
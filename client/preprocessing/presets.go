@@ -0,0 +1,56 @@
+package preprocessing
+
+import "sort"
+
+var presets = map[string]func() Config{
+	// no processing at all
+	"raw": func() Config {
+		return Config{Stages: []StageConfig{}}
+	},
+
+	"voice": DefaultConfig,
+
+	// tighter, louder voice with more presence
+	"broadcast": func() Config {
+		return Config{
+			Stages: []StageConfig{
+				{Type: "highpass", Params: map[string]float32{"freq": 100, "q": 0.707}},
+				{Type: "lowpass", Params: map[string]float32{"freq": 12000, "q": 0.707}},
+				{Type: "peaking", Name: "presence", Params: map[string]float32{"freq": 3500, "gain": 3.0, "q": 1.0}},
+				{Type: "peaking", Name: "mud", Params: map[string]float32{"freq": 300, "gain": -3.0, "q": 1.4}},
+				{Type: "deesser", Params: map[string]float32{"frequency": 6000, "threshold": -15, "ratio": 3}},
+				{Type: "compressor", Params: map[string]float32{"threshold": -24, "ratio": 4, "attack": 5, "release": 80}},
+				{Type: "gate", Params: map[string]float32{"threshold": -45, "hysteresis": 6}},
+			},
+		}
+	},
+
+	// wideband, no gate and only gentle compression
+	"music": func() Config {
+		return Config{
+			Stages: []StageConfig{
+				{Type: "highpass", Params: map[string]float32{"freq": 30, "q": 0.707}},
+				{Type: "compressor", Params: map[string]float32{"threshold": -18, "ratio": 2, "attack": 20, "release": 200}},
+			},
+		}
+	},
+}
+
+// Preset returns the built-in preset with the given name
+func Preset(name string) (Config, bool) {
+	preset, ok := presets[name]
+	if !ok {
+		return Config{}, false
+	}
+	return preset(), true
+}
+
+// PresetNames lists the built-in presets
+func PresetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
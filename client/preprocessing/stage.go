@@ -0,0 +1,115 @@
+package preprocessing
+
+import "fmt"
+
+// Stage is a single step of the processing pipeline
+type Stage interface {
+	// Process processes samples in place and returns them, it must not allocate
+	// as it runs on the audio callback
+	Process(samples []float32) []float32
+	Reset()
+
+	Params() map[string]float32
+	SetParam(name string, value float32) error
+}
+
+// StageConfig describes one stage of the pipeline.
+// Params not set keep the defaults of the stage type.
+type StageConfig struct {
+	Type     string             `json:"type"`
+	Name     string             `json:"name,omitempty"`
+	Disabled bool               `json:"disabled,omitempty"`
+	Params   map[string]float32 `json:"params,omitempty"`
+}
+
+// Config describes the whole pipeline, stages are applied in order
+type Config struct {
+	Bypass bool          `json:"bypass,omitempty"`
+	Stages []StageConfig `json:"stages"`
+}
+
+// StageTypes lists the stage types known to NewStage
+var StageTypes = []string{
+	"highpass",
+	"lowpass",
+	"peaking",
+	"bandpass",
+	"deesser",
+	"compressor",
+	"gate",
+}
+
+// filter frequencies of a config are kept this fraction of the rate,
+// just below Nyquist, so configs made for 48 kHz still load at 8 or 16 kHz
+const maxFreqRatio = 0.45
+
+// MaxFreq is the highest filter frequency a config gets at sampleRate
+func MaxFreq(sampleRate int) float32 {
+	return float32(sampleRate) * maxFreqRatio
+}
+
+// clampParam lowers a filter frequency above MaxFreq to it
+func clampParam(sampleRate int, name string, value float32) float32 {
+	if name == "freq" || name == "frequency" {
+		return min(value, MaxFreq(sampleRate))
+	}
+	return value
+}
+
+// NewStage creates a stage of the given config type with its params applied.
+// Filter frequencies above MaxFreq are lowered to it.
+func NewStage(sampleRate int, sc StageConfig) (Stage, error) {
+	var stage Stage
+
+	maxFreq := MaxFreq(sampleRate)
+	switch sc.Type {
+	case "highpass":
+		stage = NewHighPassFilter(sampleRate, float64(min(80.0, maxFreq)), 0.707)
+	case "lowpass":
+		stage = NewLowPassFilter(sampleRate, float64(min(8000.0, maxFreq)), 0.707)
+	case "peaking":
+		stage = NewPeakingFilter(sampleRate, float64(min(1000.0, maxFreq)), 0.0, 1.0)
+	case "bandpass":
+		stage = NewBandPassFilter(sampleRate, float64(min(1000.0, maxFreq)), 1.0)
+	case "deesser":
+		stage = NewDeEsser(sampleRate, min(6500.0, maxFreq), -12.0, 2.0)
+	case "compressor":
+		stage = NewCompressor(sampleRate, -20.0, 3.0, 10.0, 50.0)
+	case "gate":
+		stage = NewNoiseGate(sampleRate, -40.0, 10.0)
+	default:
+		return nil, fmt.Errorf("unknown stage type %q", sc.Type)
+	}
+
+	for name, value := range sc.Params {
+		if err := stage.SetParam(name, clampParam(sampleRate, name, value)); err != nil {
+			return nil, fmt.Errorf("stage %q: %w", sc.Type, err)
+		}
+	}
+
+	return stage, nil
+}
+
+// DefaultConfig is the voice-optimized chain
+func DefaultConfig() Config {
+	return Config{
+		Stages: []StageConfig{
+			// High-pass filter at 80Hz to remove rumble and pops
+			{Type: "highpass", Params: map[string]float32{"freq": 80, "q": 0.707}},
+			// Low-pass filter at 8kHz (voice range upper limit)
+			{Type: "lowpass", Params: map[string]float32{"freq": 8000, "q": 0.707}},
+			// Boost presence around 3kHz for clarity
+			{Type: "peaking", Name: "presence", Params: map[string]float32{"freq": 3000, "gain": 2.0, "q": 1.2}},
+			// Slight cut around 250Hz to reduce muddiness
+			{Type: "peaking", Name: "mud", Params: map[string]float32{"freq": 250, "gain": -1.5, "q": 1.5}},
+			// Boost high-mids for intelligibility
+			{Type: "peaking", Name: "highmid", Params: map[string]float32{"freq": 5000, "gain": 1.5, "q": 1.0}},
+			// De-esser to tame harsh sibilants around 6-8kHz
+			{Type: "deesser", Params: map[string]float32{"frequency": 6500, "threshold": -12, "ratio": 2}},
+			// Compressor for evening out dynamics (-20dB threshold, 3:1 ratio)
+			{Type: "compressor", Params: map[string]float32{"threshold": -20, "ratio": 3, "attack": 10, "release": 50}},
+			// Advanced noise gate with smooth attack/release
+			{Type: "gate", Params: map[string]float32{"threshold": -40, "hysteresis": 10}},
+		},
+	}
+}
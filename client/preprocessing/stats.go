@@ -0,0 +1,78 @@
+package preprocessing
+
+// number of 1 dB buckets in the gain reduction histogram,
+// the last one collects everything above
+const GainReductionBuckets = 24
+
+// Stats are counters collected by a stage since it was created
+type Stats struct {
+	Samples int
+
+	// samples processed while the gate was open, gates only
+	GateOpen int
+
+	// samples by gain reduction in 1 dB steps, dynamics stages only,
+	// nil unless CollectStats was called
+	GainReduction []int
+}
+
+type statsCollector interface {
+	Stats() Stats
+	// collectStats starts the counters that cost time on every sample
+	collectStats()
+}
+
+// StageStats are the stats of a named stage
+type StageStats struct {
+	Name string
+	Type string
+	Stats
+}
+
+func newGainReductionHistogram() []int {
+	return make([]int, GainReductionBuckets)
+}
+
+// countGainReduction adds a sample with the given gain (<= 1) to the histogram,
+// nothing while it is nil
+func countGainReduction(histogram []int, gain float32) {
+	if histogram == nil {
+		return
+	}
+
+	bucket := int(-linearToDb(gain))
+	bucket = max(0, min(bucket, len(histogram)-1))
+	histogram[bucket]++
+}
+
+// CollectStats turns on the stats that slow processing down, like the gain
+// reduction histograms. It must be called before Process runs, and the stages
+// of any later change don't collect them.
+func (ap *AudioProcessor) CollectStats() {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	for _, ps := range ap.pipeline.Load().stages {
+		if collector, ok := ps.stage.(statsCollector); ok {
+			collector.collectStats()
+		}
+	}
+}
+
+// Stats returns the stats of all stages collecting them, in pipeline order.
+// The counters belong to Process, so call it between calls to Process.
+func (ap *AudioProcessor) Stats() []StageStats {
+	var stats []StageStats
+	for _, ps := range ap.pipeline.Load().stages {
+		collector, ok := ps.stage.(statsCollector)
+		if !ok {
+			continue
+		}
+		stats = append(stats, StageStats{
+			Name:  ps.name,
+			Type:  ps.typ,
+			Stats: collector.Stats(),
+		})
+	}
+	return stats
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/crolbar/lekvc/lekvc/preprocessing"
+	"github.com/crolbar/lekvc/lekvcs/wav"
+)
+
+// processCommand runs a wav file through the processing pipeline:
+//
+//	lekvc process [-preset name] [-stats] in.wav out.wav
+func processCommand(args []string) error {
+	fs := flag.NewFlagSet("process", flag.ExitOnError)
+	preset := fs.String("preset", "", "processing preset, defaults to the configured pipeline")
+	showStats := fs.Bool("stats", false, "print per stage stats")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: lekvc process [-preset name] [-stats] in.wav out.wav")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// only reads, a missing config means the defaults
+	cfg, err := readConfig()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if *preset != "" {
+		cfg.Preset = *preset
+		cfg.Processing = nil
+	}
+
+	processing, err := processingConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	samples, format, err := wav.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// every channel gets its own pipeline
+	processors := make([]*preprocessing.AudioProcessor, format.Channels)
+	for i := range processors {
+		processors[i], err = preprocessing.NewAudioProcessorFromConfig(format.SampleRate, processing)
+		if err != nil {
+			return err
+		}
+		if *showStats {
+			processors[i].CollectStats()
+		}
+	}
+
+	frames := len(samples) / format.Channels
+	channel := make([]float32, frames)
+	for ch, ap := range processors {
+		for i := range frames {
+			channel[i] = samples[i*format.Channels+ch]
+		}
+
+		processed := ap.Process(channel)
+
+		for i := range frames {
+			samples[i*format.Channels+ch] = processed[i]
+		}
+	}
+
+	if err := wav.WriteFile(fs.Arg(1), samples, format); err != nil {
+		return err
+	}
+
+	if *showStats {
+		for ch, ap := range processors {
+			if len(processors) > 1 {
+				fmt.Printf("\x1b[34m== channel %d ==\x1b[m\n", ch)
+			}
+			printStageStats(ap.Stats(), format.SampleRate)
+		}
+	}
+
+	return nil
+}
+
+func printStageStats(stats []preprocessing.StageStats, sampleRate int) {
+	for _, s := range stats {
+		if s.Samples == 0 {
+			continue
+		}
+		seconds := float64(s.Samples) / float64(sampleRate)
+
+		fmt.Printf("\x1b[33m%s\x1b[m (%s)\n", s.Name, s.Type)
+
+		if s.Type == "gate" {
+			open := float64(s.GateOpen) / float64(sampleRate)
+			fmt.Printf("  open %.2fs of %.2fs (%.1f%%)\n", open, seconds, open/seconds*100)
+		}
+
+		if s.GainReduction != nil {
+			fmt.Println("  gain reduction:")
+			for db, n := range s.GainReduction {
+				if n == 0 {
+					continue
+				}
+				label := fmt.Sprintf("%d-%d dB", db, db+1)
+				if db == len(s.GainReduction)-1 {
+					label = fmt.Sprintf(">%d dB", db)
+				}
+				percent := float64(n) / float64(s.Samples) * 100
+				fmt.Printf("  %9s %5.1f%% %s\n", label, percent, strings.Repeat("#", int(percent/2)))
+			}
+		}
+	}
+}
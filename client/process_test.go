@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/crolbar/lekvc/lekvcs/wav"
+)
+
+// testSignal is a second of a voice-like signal: a gliding tone with
+// harmonics, a sibilant burst of noise and a quiet tail for the gate
+func testSignal(rate int) []float32 {
+	samples := make([]float32, rate)
+	seed := uint32(1)
+	for i := range samples {
+		t := float64(i) / float64(rate)
+		f := 150 + 100*t
+		v := 0.3*math.Sin(2*math.Pi*f*t) + 0.1*math.Sin(2*math.Pi*3*f*t) + 0.05*math.Sin(2*math.Pi*7*f*t)
+
+		seed = seed*1664525 + 1013904223
+		noise := float64(int32(seed)) / (1 << 31)
+		if t > 0.5 && t < 0.6 {
+			v += 0.2 * noise
+		}
+		if t > 0.8 {
+			v = 0.001 * noise
+		}
+		samples[i] = float32(v)
+	}
+	return samples
+}
+
+func rms(samples []float32) float64 {
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+func TestProcessCommand(t *testing.T) {
+	// the output of the voice preset, update only for intended changes to the DSP
+	tests := []struct {
+		rate               int
+		speech, hiss, tail float64
+	}{
+		{8000, 0.239262, 0.256266, 0.00124212},
+		{16000, 0.239553, 0.257735, 0.00133272},
+		{48000, 0.239737, 0.246151, 0.000856682},
+	}
+
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	t.Setenv("HOME", dir)
+
+	for _, tt := range tests {
+		in := filepath.Join(dir, "in.wav")
+		out := filepath.Join(dir, "out.wav")
+		input := testSignal(tt.rate)
+		if err := wav.WriteFile(in, input, wav.Format{SampleRate: tt.rate, Channels: 1, Encoding: wav.Float32}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := processCommand([]string{"-preset", "voice", in, out}); err != nil {
+			t.Fatalf("%d Hz: %v", tt.rate, err)
+		}
+
+		output, format, err := wav.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format.SampleRate != tt.rate || len(output) != len(input) {
+			t.Fatalf("%d Hz: got %d samples at %d Hz", tt.rate, len(output), format.SampleRate)
+		}
+
+		r := tt.rate / 10
+		speech, hiss, tail := rms(output[2*r:5*r]), rms(output[5*r:6*r]), rms(output[9*r:])
+		t.Logf("%d Hz: speech %.6g hiss %.6g tail %.6g", tt.rate, speech, hiss, tail)
+		for _, c := range []struct {
+			name      string
+			got, want float64
+		}{{"speech", speech, tt.speech}, {"hiss", hiss, tt.hiss}, {"tail", tail, tt.tail}} {
+			if math.Abs(c.got-c.want) > c.want*0.005 {
+				t.Errorf("%d Hz: %s rms %.6g, want %.6g", tt.rate, c.name, c.got, c.want)
+			}
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "config")); !os.IsNotExist(err) {
+		t.Errorf("process created the config dir: %v", err)
+	}
+}
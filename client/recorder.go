@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/crolbar/lekvc/lekvcs/record"
+	"github.com/crolbar/lekvc/lekvcs/wav"
+)
+
+// audio waiting for the writer, in chunks of a tenth of a second,
+// a stalled disk drops audio from the recording after this many
+const recordChunks = 64
+
+type chunkKind uint8
+
+const (
+	chunkMix chunkKind = iota
+	chunkMic
+	chunkSpeaker
+)
+
+// recordChunk is audio handed from the audio callbacks to the writer goroutine
+type recordChunk struct {
+	kind chunkKind
+	id   uint8
+	name string
+	// when the last sample arrived
+	at      time.Time
+	samples []float32
+}
+
+const defaultRecordDir = "recordings"
+
+// Recorder writes the mixed output, and optionally every speaker and the local
+// mic on their own tracks, plus a transcript of the chat.
+// The Write methods only queue the audio, a goroutine does all the file work
+// so the audio callbacks never wait on the disk.
+type Recorder struct {
+	mu sync.Mutex
+
+	base   string
+	start  time.Time
+	format wav.Format
+
+	perTrack atomic.Bool
+
+	// filled chunks to the writer and empty ones back, never more than recordChunks
+	chunks  chan recordChunk
+	free    chan []float32
+	dropped atomic.Uint64
+	stop    chan struct{}
+	stopped chan struct{}
+
+	mixed      *wav.Track
+	mic        *wav.Track
+	tracks     map[uint8]*wav.Track
+	transcript *record.Transcript
+}
+
+var recorder atomic.Pointer[Recorder]
+
+func StartRecorder(dir string, sampleRate int, perTrack bool) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	r := &Recorder{
+		base:    filepath.Join(dir, "lekvc-"+start.Format("20060102-150405")),
+		start:   start,
+		format:  wav.Format{SampleRate: sampleRate, Channels: 1, Encoding: wav.PCM16},
+		tracks:  make(map[uint8]*wav.Track),
+		chunks:  make(chan recordChunk, recordChunks),
+		free:    make(chan []float32, recordChunks),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	r.perTrack.Store(perTrack)
+	for range recordChunks {
+		r.free <- make([]float32, 0, sampleRate/10)
+	}
+
+	var err error
+	r.mixed, err = wav.CreateTrack(r.base+"-mix.wav", r.format, start, record.Slack)
+	if err != nil {
+		return nil, err
+	}
+
+	if perTrack {
+		r.mic, err = wav.CreateTrack(r.base+"-mic.wav", r.format, start, record.Slack)
+		if err != nil {
+			r.mixed.Close()
+			return nil, err
+		}
+	}
+
+	r.transcript, err = record.CreateTranscript(r.base+".txt", start)
+	if err != nil {
+		r.mixed.Close()
+		if r.mic != nil {
+			r.mic.Close()
+		}
+		return nil, err
+	}
+
+	go r.writeLoop()
+
+	return r, nil
+}
+
+// Base is the path of the recording without the suffixes
+func (r *Recorder) Base() string {
+	return r.base
+}
+
+func (r *Recorder) Elapsed() time.Duration {
+	return time.Since(r.start)
+}
+
+// WriteMix records the mixed playback output
+func (r *Recorder) WriteMix(samples []float32) {
+	r.queue(chunkMix, 0, "", samples)
+}
+
+// WriteMic records the local processed mic
+func (r *Recorder) WriteMic(samples []float32) {
+	if r.perTrack.Load() {
+		r.queue(chunkMic, 0, "", samples)
+	}
+}
+
+// WriteTrack records a remote speaker after the jitter buffer
+func (r *Recorder) WriteTrack(id uint8, name string, samples []float32) {
+	if r.perTrack.Load() {
+		r.queue(chunkSpeaker, id, name, samples)
+	}
+}
+
+// queue copies samples into free chunks for the writer without ever blocking,
+// dropping them when the writer is too far behind
+func (r *Recorder) queue(kind chunkKind, id uint8, name string, samples []float32) {
+	now := time.Now()
+
+	for len(samples) > 0 {
+		var buf []float32
+		select {
+		case buf = <-r.free:
+		default:
+			r.dropped.Add(1)
+			return
+		}
+
+		n := copy(buf[:cap(buf)], samples)
+		samples = samples[n:]
+
+		// the end of this chunk arrived before the rest
+		at := now.Add(-time.Duration(len(samples)) * time.Second / time.Duration(r.format.SampleRate))
+
+		// never blocks, every chunk in flight took a free buffer
+		r.chunks <- recordChunk{kind: kind, id: id, name: name, at: at, samples: buf[:n]}
+	}
+}
+
+func (r *Recorder) writeLoop() {
+	defer close(r.stopped)
+
+	for {
+		select {
+		case c := <-r.chunks:
+			r.write(c)
+		case <-r.stop:
+			// what was queued before Stop still goes in
+			for {
+				select {
+				case c := <-r.chunks:
+					r.write(c)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *Recorder) write(c recordChunk) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer func() { r.free <- c.samples[:0] }()
+
+	switch c.kind {
+	case chunkMix:
+		r.mixed.WriteAt(c.at, c.samples)
+	case chunkMic:
+		if r.mic != nil {
+			r.mic.WriteAt(c.at, c.samples)
+		}
+	case chunkSpeaker:
+		if !r.perTrack.Load() {
+			return
+		}
+
+		track, ok := r.tracks[c.id]
+		if !ok {
+			var err error
+			path := fmt.Sprintf("%s-%d-%s.wav", r.base, c.id, record.FileName(c.name))
+			track, err = wav.CreateTrack(path, r.format, r.start, record.Slack)
+			if err != nil {
+				ChatPrintClient(fmt.Sprintf("\x1b[31mrecord: %s\x1b[m", err.Error()))
+				r.perTrack.Store(false)
+				return
+			}
+			r.tracks[c.id] = track
+		}
+
+		track.WriteAt(c.at, c.samples)
+	}
+}
+
+// Text adds a chat line to the transcript
+func (r *Recorder) Text(sender, text string) {
+	r.transcript.Line(sender, text)
+}
+
+func (r *Recorder) Stop() error {
+	close(r.stop)
+	<-r.stopped
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var errs []error
+	if n := r.dropped.Load(); n > 0 {
+		slog.Warn("the disk fell behind the recording, audio is missing", "chunks", n, "recording", r.base)
+	}
+
+	// pad every track to the same length
+	end := int64(time.Since(r.start).Seconds() * float64(r.format.SampleRate))
+	tracks := []*wav.Track{r.mixed}
+	if r.mic != nil {
+		tracks = append(tracks, r.mic)
+	}
+	for _, track := range r.tracks {
+		tracks = append(tracks, track)
+	}
+	for _, track := range tracks {
+		errs = append(errs, track.Pad(end), track.Close())
+	}
+
+	errs = append(errs, r.transcript.Close())
+
+	r.mixed, r.mic = nil, nil
+	clear(r.tracks)
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func recordText(sender, text string) {
+	if rec := recorder.Load(); rec != nil {
+		rec.Text(sender, text)
+	}
+}
+
+func handleRecord(args []string) {
+	if len(args) == 0 {
+		if rec := recorder.Load(); rec != nil {
+			ChatPrintClient(fmt.Sprintf("recording to %s for %s", rec.Base(), rec.Elapsed().Round(time.Second)))
+		} else {
+			ChatPrintClient("not recording")
+		}
+		return
+	}
+
+	switch args[0] {
+	case "start":
+		if recorder.Load() != nil {
+			ChatPrintClient("\x1b[31malready recording\x1b[m")
+			return
+		}
+
+		perTrack := len(args) > 1 && args[1] == "tracks"
+
+		dir := config.RecordDir
+		if dir == "" {
+			dir = defaultRecordDir
+		}
+
+		rec, err := StartRecorder(dir, int(sampleRate), perTrack)
+		if err != nil {
+			ChatPrintClient(fmt.Sprintf("\x1b[31mrecord: %s\x1b[m", err.Error()))
+			return
+		}
+		recorder.Store(rec)
+		ChatPrintClient("\x1b[31m● recording\x1b[m to " + rec.Base())
+
+	case "stop":
+		rec := recorder.Swap(nil)
+		if rec == nil {
+			ChatPrintClient("not recording")
+			return
+		}
+		if err := rec.Stop(); err != nil {
+			ChatPrintClient(fmt.Sprintf("\x1b[31mrecord: %s\x1b[m", err.Error()))
+			return
+		}
+		ChatPrintClient(fmt.Sprintf("recording saved to %s (%s)", rec.Base(), rec.Elapsed().Round(time.Second)))
+
+	default:
+		ChatPrintClient("\x1b[31musage: /record start [tracks] | /record stop\x1b[m")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crolbar/lekvc/lekvcs/wav"
+)
+
+func TestRecorderWritesQueuedAudio(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := StartRecorder(dir, 8000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := make([]float32, 200)
+	for i := range frame {
+		frame[i] = 0.5
+	}
+	// more than a chunk at once is split
+	rec.WriteMix(make([]float32, 2000))
+	for range 20 {
+		rec.WriteMix(frame)
+		rec.WriteMic(frame)
+		rec.WriteTrack(3, "bob/../x", frame)
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := rec.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if n := rec.dropped.Load(); n != 0 {
+		t.Errorf("dropped %d chunks", n)
+	}
+
+	for _, name := range []string{"-mix.wav", "-mic.wav", "-3-bob_.._x.wav"} {
+		samples, _, err := wav.ReadFile(rec.Base() + name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(samples) < 20*len(frame) {
+			t.Errorf("%s has %d samples, want at least %d", name, len(samples), 20*len(frame))
+		}
+	}
+
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.wav")); len(matches) != 3 {
+		t.Errorf("wrote %v", matches)
+	}
+}
+
+func TestRecorderDropsWhenFull(t *testing.T) {
+	rec, err := StartRecorder(t.TempDir(), 8000, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// hold the writer up the way a stalled disk would
+	rec.mu.Lock()
+	for range 2 * recordChunks {
+		rec.WriteMix(make([]float32, 800))
+	}
+	rec.mu.Unlock()
+
+	if rec.dropped.Load() == 0 {
+		t.Error("nothing was dropped with the writer stuck")
+	}
+	if err := rec.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,205 @@
+// Package resample converts mono audio between sample rates
+// with a polyphase windowed-sinc filter
+package resample
+
+import (
+	"fmt"
+	"math"
+)
+
+// filter length in samples of the lower rate, longer is sharper but slower
+const tapsPerPhase = 32
+
+// kaiser window shape, ~80 dB stopband
+const kaiserBeta = 8.0
+
+// fraction of the lower nyquist that passes untouched
+const passband = 0.92
+
+// limits the coefficient table to a few MB for unusual rate pairs
+const maxPhases = 4096
+
+// Resampler is a streaming rate converter, it keeps enough history
+// between calls to Process that consecutive blocks join seamlessly
+type Resampler struct {
+	from, to int
+
+	// upsample by l, downsample by m
+	l, m int
+
+	// coeffs[phase][tap], taps input samples per phase
+	coeffs [][]float32
+	taps   int
+
+	// last taps-1 inputs followed by the new block
+	buf []float32
+	// position of the next output in upsampled samples from buf[0]
+	pos int
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// New creates a resampler from one rate to another
+func New(from, to int) (*Resampler, error) {
+	if from <= 0 || to <= 0 {
+		return nil, fmt.Errorf("invalid sample rates %d -> %d", from, to)
+	}
+
+	g := gcd(from, to)
+	r := &Resampler{
+		from: from,
+		to:   to,
+		l:    to / g,
+		m:    from / g,
+	}
+	// the filter spans tapsPerPhase samples of the output when decimating,
+	// so the transition band is as narrow as when upsampling
+	r.taps = tapsPerPhase
+	if r.m > r.l {
+		r.taps = (tapsPerPhase*r.m + r.l - 1) / r.l
+	}
+	if r.l > maxPhases {
+		return nil, fmt.Errorf("unsupported sample rate ratio %d -> %d", from, to)
+	}
+
+	if from != to {
+		r.coeffs = design(r.l, r.m, r.taps)
+	}
+	r.Reset()
+
+	return r, nil
+}
+
+// design builds the prototype lowpass at the upsampled rate
+// and splits it into l phases of taps each
+func design(l, m, taps int) [][]float32 {
+	n := l * taps
+	center := float64(n-1) / 2
+
+	// cutoff in cycles per upsampled sample
+	cutoff := 0.5 / float64(max(l, m)) * passband
+
+	coeffs := make([][]float32, l)
+	for p := range coeffs {
+		coeffs[p] = make([]float32, taps)
+	}
+
+	norm := besselI0(kaiserBeta)
+	for i := range n {
+		x := float64(i) - center
+
+		sinc := 2 * cutoff
+		if x != 0 {
+			sinc = math.Sin(2*math.Pi*cutoff*x) / (math.Pi * x)
+		}
+
+		ratio := 2*float64(i)/float64(n-1) - 1
+		window := besselI0(kaiserBeta*math.Sqrt(1-ratio*ratio)) / norm
+
+		// zero stuffing divides the level by l
+		coeffs[i%l][i/l] = float32(sinc * window * float64(l))
+	}
+
+	return coeffs
+}
+
+// besselI0 is the zeroth order modified bessel function of the first kind
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; k < 50; k++ {
+		term *= (x / (2 * float64(k))) * (x / (2 * float64(k)))
+		sum += term
+		if term < sum*1e-12 {
+			break
+		}
+	}
+	return sum
+}
+
+func (r *Resampler) From() int {
+	return r.from
+}
+
+func (r *Resampler) To() int {
+	return r.to
+}
+
+// Delay is the latency of the filter in output samples
+func (r *Resampler) Delay() int {
+	if r.from == r.to {
+		return 0
+	}
+	return r.taps / 2 * r.l / r.m
+}
+
+// Reset clears the history, e.g. after a gap in the stream
+func (r *Resampler) Reset() {
+	r.buf = make([]float32, r.taps-1, r.taps*4)
+	r.pos = (r.taps - 1) * r.l
+}
+
+// Process converts the next block of input, the output length
+// varies by a sample between calls as the phase advances
+func (r *Resampler) Process(in []float32) []float32 {
+	return r.Append(make([]float32, 0, len(in)*r.l/r.m+1), in)
+}
+
+// Append converts the next block of input and appends it to out,
+// it doesn't allocate once out and the history have grown to the block size
+func (r *Resampler) Append(out, in []float32) []float32 {
+	if r.from == r.to {
+		return append(out, in...)
+	}
+
+	r.buf = append(r.buf, in...)
+
+	for {
+		i := r.pos / r.l
+		if i >= len(r.buf) {
+			break
+		}
+
+		taps := r.coeffs[r.pos%r.l]
+		var sum float32
+		for j, c := range taps {
+			sum += r.buf[i-j] * c
+		}
+		out = append(out, sum)
+
+		r.pos += r.m
+	}
+
+	// keep the history the next block needs
+	drop := len(r.buf) - (r.taps - 1)
+	copy(r.buf, r.buf[drop:])
+	r.buf = r.buf[:r.taps-1]
+	r.pos -= drop * r.l
+
+	return out
+}
+
+// Resample converts a whole signal, compensating the filter delay
+func Resample(samples []float32, from, to int) ([]float32, error) {
+	r, err := New(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if from == to {
+		return r.Process(samples), nil
+	}
+
+	// flush the filter with silence
+	padded := make([]float32, len(samples)+r.taps)
+	copy(padded, samples)
+
+	out := r.Process(padded)
+
+	delay := r.Delay()
+	n := int(int64(len(samples)) * int64(to) / int64(from))
+	return out[delay : delay+n], nil
+}
@@ -0,0 +1,203 @@
+package resample
+
+import (
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+var ratePairs = [][2]int{{44100, 48000}, {48000, 44100}, {16000, 48000}, {48000, 16000}}
+
+func tone(rate int, freq float64, n int) []float32 {
+	samples := make([]float32, n)
+	for i := range samples {
+		samples[i] = float32(0.5 * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)))
+	}
+	return samples
+}
+
+// blocks processes in in the uneven blocks audio callbacks hand over
+func blocks(r *Resampler, in []float32, seed uint64) []float32 {
+	rng := rand.New(rand.NewPCG(seed, 0))
+
+	var out []float32
+	for len(in) > 0 {
+		n := min(len(in), rng.IntN(r.From()/50))
+		out = append(out, r.Process(in[:n])...)
+		in = in[n:]
+	}
+	return out
+}
+
+// fit splits one second of a signal into the tone at freq
+// and what is left, as levels relative to a 0.5 sine
+func fit(samples []float32, rate int, freq float64) (gain, residual float64) {
+	samples = samples[:rate]
+
+	// a whole number of periods, so sine and cosine don't leak into each other
+	var a, b float64
+	for i, v := range samples {
+		w := 2 * math.Pi * freq * float64(i) / float64(rate)
+		a += float64(v) * math.Sin(w)
+		b += float64(v) * math.Cos(w)
+	}
+	a, b = 2*a/float64(rate), 2*b/float64(rate)
+
+	var rest float64
+	for i, v := range samples {
+		w := 2 * math.Pi * freq * float64(i) / float64(rate)
+		d := float64(v) - a*math.Sin(w) - b*math.Cos(w)
+		rest += d * d
+	}
+
+	level := 0.5 / math.Sqrt2
+	return math.Hypot(a, b) / 0.5, math.Sqrt(rest/float64(rate)) / level
+}
+
+func db(x float64) float64 {
+	return 20 * math.Log10(x)
+}
+
+func TestResampleLength(t *testing.T) {
+	for _, pair := range ratePairs {
+		from, to := pair[0], pair[1]
+		r, err := New(from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		in := 3*from + 17
+		out := len(blocks(r, make([]float32, in), 1))
+		want := float64(in) * float64(to) / float64(from)
+		if math.Abs(float64(out)-want) > 1 {
+			t.Errorf("%d -> %d: %d samples out of %d, want %.1f", from, to, out, in, want)
+		}
+
+		whole, err := Resample(make([]float32, in), from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(whole) != in*to/from {
+			t.Errorf("%d -> %d: Resample gave %d samples, want %d", from, to, len(whole), in*to/from)
+		}
+	}
+}
+
+func TestResampleDelay(t *testing.T) {
+	for _, pair := range ratePairs {
+		from, to := pair[0], pair[1]
+
+		// a click 100 ms in
+		in := make([]float32, from/2)
+		at := from / 10
+		in[at] = 1
+
+		peak := func(samples []float32) int {
+			best := 0
+			for i, v := range samples {
+				if math.Abs(float64(v)) > math.Abs(float64(samples[best])) {
+					best = i
+				}
+			}
+			return best
+		}
+
+		r, _ := New(from, to)
+		want := float64(at)*float64(to)/float64(from) + float64(r.Delay())
+		if got := peak(blocks(r, in, 2)); math.Abs(float64(got)-want) > 1 {
+			t.Errorf("%d -> %d: the click comes out at %d, want %.1f with a delay of %d", from, to, got, want, r.Delay())
+		}
+
+		// Resample takes the delay out
+		whole, _ := Resample(in, from, to)
+		want = float64(at) * float64(to) / float64(from)
+		if got := peak(whole); math.Abs(float64(got)-want) > 1 {
+			t.Errorf("%d -> %d: Resample puts the click at %d, want %.1f", from, to, got, want)
+		}
+	}
+}
+
+func TestResamplePassband(t *testing.T) {
+	for _, pair := range ratePairs {
+		from, to := pair[0], pair[1]
+		nyquist := float64(min(from, to)) / 2
+
+		for _, frac := range []float64{0.01, 0.1, 0.25, 0.5, 0.65, 0.75} {
+			freq := math.Round(frac * nyquist)
+
+			r, _ := New(from, to)
+			out := r.Process(tone(from, freq, 2*from))
+			gain, residual := fit(out[to/2:], to, freq)
+			if math.Abs(db(gain)) > 0.05 || db(residual) > -70 {
+				t.Errorf("%d -> %d at %.0f Hz: gain %.3f dB, %.1f dB of something else", from, to, freq, db(gain), db(residual))
+			}
+		}
+	}
+}
+
+func TestResampleStopband(t *testing.T) {
+	tests := []struct {
+		from, to int
+		freq     float64
+	}{
+		// tones above the new nyquist that would alias back down
+		{48000, 16000, 8800},
+		{48000, 16000, 12000},
+		{48000, 16000, 23000},
+		{48000, 44100, 23800},
+		// the images of a tone near the old nyquist, at 8.8 kHz and 24.3 kHz
+		{16000, 48000, 7200},
+		{44100, 48000, 19800},
+	}
+	for _, tt := range tests {
+		r, _ := New(tt.from, tt.to)
+		out := r.Process(tone(tt.from, tt.freq, 2*tt.from))[tt.to/2:]
+
+		// anything in the output but the tone itself leaked through
+		var residual float64
+		if tt.freq < float64(tt.to)/2 {
+			_, residual = fit(out, tt.to, tt.freq)
+		} else {
+			_, residual = fit(out, tt.to, 0)
+		}
+		if db(residual) > -60 {
+			t.Errorf("%d -> %d at %.0f Hz: %.1f dB gets through", tt.from, tt.to, tt.freq, db(residual))
+		}
+	}
+}
+
+func TestResampleChunks(t *testing.T) {
+	for _, pair := range ratePairs {
+		from, to := pair[0], pair[1]
+		in := tone(from, 1000, from)
+
+		r, _ := New(from, to)
+		want := r.Process(in)
+
+		for seed := range uint64(5) {
+			r.Reset()
+			got := blocks(r, in, seed)
+			if len(got) != len(want) {
+				t.Fatalf("%d -> %d: %d samples in blocks, %d at once", from, to, len(got), len(want))
+			}
+			for i := range got {
+				if math.Abs(float64(got[i]-want[i])) > 1e-6 {
+					t.Errorf("%d -> %d: sample %d is %v in blocks, %v at once", from, to, i, got[i], want[i])
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestAppendDoesNotAllocate(t *testing.T) {
+	for _, pair := range ratePairs {
+		r, _ := New(pair[0], pair[1])
+		in := tone(pair[0], 1000, pair[0]/100)
+		out := r.Append(nil, in)
+
+		if n := testing.AllocsPerRun(100, func() { out = r.Append(out[:0], in) }); n != 0 {
+			t.Errorf("%d -> %d: Append allocates %v times per call", pair[0], pair[1], n)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package resample
+
+import "math"
+
+// Stretcher resamples by a ratio that can change between calls,
+// used to follow the slow clock drift between two sound cards
+type Stretcher struct {
+	ratio float64
+
+	// history followed by the new block
+	buf []float32
+	// position of the next output in input samples from buf[0]
+	pos float64
+}
+
+const (
+	stretchTaps   = 16
+	stretchPhases = 256
+)
+
+// coefficients for fractional offsets in 1/stretchPhases steps,
+// one extra phase so interpolation never runs off the end
+var stretchTable = designStretch()
+
+func designStretch() [][]float32 {
+	cutoff := 0.5 * passband
+	norm := besselI0(kaiserBeta)
+	half := float64(stretchTaps) / 2
+
+	table := make([][]float32, stretchPhases+1)
+	for p := range table {
+		table[p] = make([]float32, stretchTaps)
+
+		var sum float64
+		coeffs := make([]float64, stretchTaps)
+		for j := range coeffs {
+			x := float64(j) - (half - 1) - float64(p)/stretchPhases
+
+			sinc := 2 * cutoff
+			if x != 0 {
+				sinc = math.Sin(2*math.Pi*cutoff*x) / (math.Pi * x)
+			}
+
+			ratio := x / half
+			window := 0.0
+			if ratio > -1 && ratio < 1 {
+				window = besselI0(kaiserBeta*math.Sqrt(1-ratio*ratio)) / norm
+			}
+
+			coeffs[j] = sinc * window
+			sum += coeffs[j]
+		}
+
+		// unity gain at dc for every phase
+		for j, c := range coeffs {
+			table[p][j] = float32(c / sum)
+		}
+	}
+
+	return table
+}
+
+func NewStretcher() *Stretcher {
+	s := &Stretcher{ratio: 1}
+	s.Reset()
+	return s
+}
+
+// SetRatio sets output samples per input sample, close to 1
+func (s *Stretcher) SetRatio(ratio float64) {
+	s.ratio = ratio
+}
+
+func (s *Stretcher) Ratio() float64 {
+	return s.ratio
+}
+
+func (s *Stretcher) Reset() {
+	s.buf = make([]float32, stretchTaps-1, stretchTaps*4)
+	s.pos = stretchTaps/2 - 1
+}
+
+// Process stretches the next block, returning about len(in)*ratio samples
+func (s *Stretcher) Process(in []float32) []float32 {
+	s.buf = append(s.buf, in...)
+
+	step := 1 / s.ratio
+	out := make([]float32, 0, int(float64(len(in))*s.ratio)+2)
+	for {
+		i := int(s.pos)
+		if i+stretchTaps/2 >= len(s.buf) {
+			break
+		}
+
+		phase := (s.pos - float64(i)) * stretchPhases
+		p := int(phase)
+		frac := float32(phase - float64(p))
+		lo, hi := stretchTable[p], stretchTable[p+1]
+
+		window := s.buf[i-(stretchTaps/2-1):]
+		var sum float32
+		for j := range stretchTaps {
+			sum += window[j] * (lo[j] + (hi[j]-lo[j])*frac)
+		}
+		out = append(out, sum)
+
+		s.pos += step
+	}
+
+	// keep the history the next block needs
+	if drop := int(s.pos) - (stretchTaps/2 - 1); drop > 0 {
+		drop = min(drop, len(s.buf))
+		copy(s.buf, s.buf[drop:])
+		s.buf = s.buf[:len(s.buf)-drop]
+		s.pos -= float64(drop)
+	}
+
+	return out
+}
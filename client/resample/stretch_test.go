@@ -0,0 +1,56 @@
+package resample
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStretchLength(t *testing.T) {
+	for _, ratio := range []float64{0.999, 0.9999, 1, 1.0001, 1.001} {
+		s := NewStretcher()
+		s.SetRatio(ratio)
+
+		in, out := 0, 0
+		// block sizes the jitter buffer hands over
+		for i := range 2000 {
+			block := make([]float32, 240+i%7*160)
+			in += len(block)
+			out += len(s.Process(block))
+		}
+
+		// the filter holds back half its taps
+		want := float64(in) * ratio
+		if math.Abs(float64(out)-want) > stretchTaps {
+			t.Errorf("ratio %v: %d samples out of %d, want about %.0f", ratio, out, in, want)
+		}
+	}
+}
+
+func TestStretchBounded(t *testing.T) {
+	const rate = 48000
+
+	s := NewStretcher()
+	var phase float64
+	peak := float32(0)
+	for i := range 500 {
+		// swing the ratio as far as drift compensation does, every block
+		s.SetRatio(1 + 0.001*math.Sin(float64(i)))
+
+		block := make([]float32, 480)
+		for j := range block {
+			block[j] = float32(0.9 * math.Sin(phase))
+			phase += 2 * math.Pi * 1000 / rate
+		}
+
+		for _, v := range s.Process(block) {
+			if math.IsNaN(float64(v)) {
+				t.Fatalf("block %d: NaN", i)
+			}
+			peak = max(peak, float32(math.Abs(float64(v))))
+		}
+	}
+
+	if peak > 0.92 || peak < 0.88 {
+		t.Errorf("peak %v of a 0.9 sine", peak)
+	}
+}
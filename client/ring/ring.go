@@ -0,0 +1,155 @@
+// Package ring is a lock-free single-producer/single-consumer sample queue
+// for handing audio to and from the device callbacks
+package ring
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// Policy decides what Write does when the buffer is full
+type Policy int
+
+const (
+	// DropNewest stores what fits and drops the rest of the write
+	DropNewest Policy = iota
+	// DropOldest overwrites the oldest samples so the newest always fit
+	DropOldest
+)
+
+// Buffer is safe for one goroutine writing and one reading at the same time,
+// Stats and Len may be called from anywhere
+type Buffer struct {
+	// float32 bits, atomic so an overwrite racing a read is well defined
+	buf    []atomic.Uint32
+	mask   uint64
+	policy Policy
+
+	// total samples ever read and written, the fill is write - read
+	read  atomic.Uint64
+	write atomic.Uint64
+
+	dropped   atomic.Uint64
+	underruns atomic.Uint64
+	maxFill   atomic.Uint64
+}
+
+type Stats struct {
+	Fill     int
+	Capacity int
+	// highest fill seen
+	MaxFill int
+	// samples lost to overflow
+	Dropped uint64
+	// reads that got fewer samples than asked for
+	Underruns uint64
+}
+
+// New creates a buffer holding at least size samples,
+// the capacity is rounded up to a power of two
+func New(size int, policy Policy) *Buffer {
+	capacity := 1
+	for capacity < size {
+		capacity <<= 1
+	}
+
+	return &Buffer{
+		buf:    make([]atomic.Uint32, capacity),
+		mask:   uint64(capacity - 1),
+		policy: policy,
+	}
+}
+
+func (b *Buffer) Cap() int {
+	return len(b.buf)
+}
+
+// Len returns the number of samples waiting to be read
+func (b *Buffer) Len() int {
+	// load read first so a concurrent read can't make the fill negative
+	r := b.read.Load()
+	return int(b.write.Load() - r)
+}
+
+// Write appends samples, returns how many were stored.
+// Only the producer may call it.
+func (b *Buffer) Write(samples []float32) int {
+	size := uint64(len(b.buf))
+	w := b.write.Load()
+
+	if extra := uint64(len(samples)) - min(uint64(len(samples)), size); extra > 0 {
+		b.dropped.Add(extra)
+		if b.policy == DropNewest {
+			samples = samples[:size]
+		} else {
+			samples = samples[extra:]
+		}
+	}
+	n := uint64(len(samples))
+
+	if free := size - (w - b.read.Load()); n > free {
+		switch b.policy {
+		case DropNewest:
+			b.dropped.Add(n - free)
+			samples = samples[:free]
+			n = free
+
+		case DropOldest:
+			// move the reader past the samples about to be overwritten,
+			// racing the consumer moving it forward itself
+			need := w + n - size
+			for {
+				r := b.read.Load()
+				if r >= need {
+					break
+				}
+				if b.read.CompareAndSwap(r, need) {
+					b.dropped.Add(need - r)
+					break
+				}
+			}
+		}
+	}
+
+	for i, s := range samples {
+		b.buf[(w+uint64(i))&b.mask].Store(math.Float32bits(s))
+	}
+	b.write.Store(w + n)
+
+	if fill := w + n - b.read.Load(); fill > b.maxFill.Load() {
+		b.maxFill.Store(fill)
+	}
+
+	return int(n)
+}
+
+// Read reads up to len(out) samples, returns how many were read.
+// Only the consumer may call it.
+func (b *Buffer) Read(out []float32) int {
+	for {
+		r := b.read.Load()
+		n := min(uint64(len(out)), b.write.Load()-r)
+
+		for i := range n {
+			out[i] = math.Float32frombits(b.buf[(r+i)&b.mask].Load())
+		}
+
+		// fails if the producer dropped what we just copied
+		if b.read.CompareAndSwap(r, r+n) {
+			if int(n) < len(out) {
+				b.underruns.Add(1)
+			}
+			return int(n)
+		}
+	}
+}
+
+func (b *Buffer) Stats() Stats {
+	return Stats{
+		Fill:      b.Len(),
+		Capacity:  b.Cap(),
+		MaxFill:   int(b.maxFill.Load()),
+		Dropped:   b.dropped.Load(),
+		Underruns: b.underruns.Load(),
+	}
+}
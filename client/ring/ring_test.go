@@ -0,0 +1,131 @@
+package ring
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestReadWrite(t *testing.T) {
+	b := New(6, DropNewest)
+	if b.Cap() != 8 {
+		t.Fatalf("cap = %d, want 8", b.Cap())
+	}
+
+	if n := b.Write([]float32{1, 2, 3}); n != 3 {
+		t.Fatalf("wrote %d, want 3", n)
+	}
+
+	out := make([]float32, 5)
+	if n := b.Read(out); n != 3 || out[0] != 1 || out[2] != 3 {
+		t.Fatalf("read %d %v", n, out)
+	}
+	if s := b.Stats(); s.Underruns != 1 || s.Fill != 0 || s.MaxFill != 3 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestDropNewest(t *testing.T) {
+	b := New(4, DropNewest)
+
+	if n := b.Write([]float32{1, 2, 3, 4, 5, 6}); n != 4 {
+		t.Fatalf("wrote %d, want 4", n)
+	}
+
+	out := make([]float32, 4)
+	b.Read(out)
+	if out[0] != 1 || out[3] != 4 {
+		t.Fatalf("read %v, want the first samples", out)
+	}
+	if s := b.Stats(); s.Dropped != 2 {
+		t.Fatalf("dropped %d, want 2", s.Dropped)
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	b := New(4, DropOldest)
+
+	b.Write([]float32{1, 2, 3})
+	if n := b.Write([]float32{4, 5, 6}); n != 3 {
+		t.Fatalf("wrote %d, want 3", n)
+	}
+
+	out := make([]float32, 4)
+	if n := b.Read(out); n != 4 || out[0] != 3 || out[3] != 6 {
+		t.Fatalf("read %d %v, want the last samples", n, out)
+	}
+	if s := b.Stats(); s.Dropped != 2 {
+		t.Fatalf("dropped %d, want 2", s.Dropped)
+	}
+
+	// a write larger than the buffer keeps its tail
+	b.Write([]float32{7, 8, 9, 10, 11, 12})
+	b.Read(out)
+	if out[0] != 9 || out[3] != 12 {
+		t.Fatalf("read %v, want the tail", out)
+	}
+}
+
+// run with -race, the producer writes an increasing sequence and
+// the consumer checks it never goes back or repeats
+func testConcurrent(t *testing.T, policy Policy) []float32 {
+	const total = 50000
+
+	b := New(256, policy)
+
+	var (
+		wg  sync.WaitGroup
+		got []float32
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		out := make([]float32, 37)
+		for len(got) == 0 || got[len(got)-1] < total-1 {
+			n := b.Read(out)
+			got = append(got, out[:n]...)
+			if n == 0 {
+				runtime.Gosched()
+			}
+		}
+	}()
+
+	block := make([]float32, 23)
+	for next := 0; next < total; {
+		for i := range block {
+			block[i] = float32(next + i)
+		}
+		block = block[:min(len(block), total-next)]
+
+		n := b.Write(block)
+		next += n
+		if n == 0 {
+			// buffer full, give the reader a chance
+			runtime.Gosched()
+		}
+	}
+	wg.Wait()
+
+	for i := 1; i < len(got); i++ {
+		if got[i] <= got[i-1] {
+			t.Fatalf("sample %d is %v after %v", i, got[i], got[i-1])
+		}
+	}
+	return got
+}
+
+func TestConcurrentDropNewest(t *testing.T) {
+	got := testConcurrent(t, DropNewest)
+
+	// nothing is lost when the writer retries
+	for i, s := range got {
+		if s != float32(i) {
+			t.Fatalf("sample %d is %v", i, s)
+		}
+	}
+}
+
+func TestConcurrentDropOldest(t *testing.T) {
+	testConcurrent(t, DropOldest)
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/crolbar/lekvc/lekvc/resample"
+	p "github.com/crolbar/lekvc/lekvcs/protocol"
+	"github.com/crolbar/lekvc/lekvcs/record"
+)
+
+// Session is one connection to the server and the clients seen on it.
+// The reader goroutine owns the connection state, the audio callbacks
+// and the ui only go through the methods below.
+type Session struct {
+	conn net.Conn
+
+	id       uint8
+	name     string
+	wireRate uint32
+
+	// given by the server to resume this session after a drop
+	token []byte
+	// whether the server took us back under an earlier token
+	resumed bool
+
+	// never closed, the loops stop on done instead
+	out  chan p.Msg
+	done chan struct{}
+
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	err       error
+
+	// copy on write so the playback callback can read it without locking,
+	// only the reader goroutine replaces it
+	clients atomic.Pointer[map[uint8]*Client]
+
+	// round trip time to the server in ns, 0 until the first Pong
+	rtt atomic.Int64
+	// round trip times of the others to the server, from the server's Ping
+	peerRTTs atomic.Pointer[map[uint8]time.Duration]
+
+	sendMu sync.Mutex
+	// processing to wire rate
+	sendResampler *resample.Resampler
+	// Simple accumulator for resampling capture input to consistent frame sizes
+	sendAccumulator []float32
+	// frame size on the network
+	wireFramesize int
+
+	// ids the mic goes to instead of the room, nil for everyone
+	whisper atomic.Pointer[[]uint8]
+}
+
+// the session audio and chat go to, nil while disconnected
+var session atomic.Pointer[Session]
+
+const (
+	handshakeTimeout  = 5 * time.Second
+	heartbeatInterval = 5 * time.Second
+	// the server pings every heartbeatInterval, nothing for this long means it's gone
+	idleTimeout = 15 * time.Second
+)
+
+// KickedError is why the server closed the connection or refused us,
+// reconnecting right away would only be refused again
+type KickedError string
+
+func (e KickedError) Error() string {
+	return string(e)
+}
+
+// Dial connects to the server and registers as username,
+// resuming the session of token if the server still has it
+func Dial(address, username string, rate uint32, token []byte, key string) (*Session, error) {
+	conn, err := net.DialTimeout("tcp", address, handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewSession(conn, username, rate, token, key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSession does the handshake on conn, asking for the given wire rate,
+// and starts the reader and writer goroutines
+func NewSession(conn net.Conn, username string, rate uint32, token []byte, key string) (*Session, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	data, err := p.EncodeMsg(
+		p.NewMsg(p.InitClient, 0, p.EncodeInitClient(rate, token, key), username),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(data); err != nil {
+		return nil, err
+	}
+
+	msg, err := p.ReadMsg(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Type == p.Kick {
+		return nil, KickedError(msg.Payload)
+	}
+	if msg.Type != p.InitClient {
+		return nil, errors.New("wrong msg type recived on init client")
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	wireRate, newToken, _ := p.DecodeInitClient(msg.Payload)
+
+	s := &Session{
+		conn:     conn,
+		id:       msg.ID,
+		name:     msg.ClientName,
+		wireRate: wireRate,
+		token:    newToken,
+		resumed:  len(token) > 0 && bytes.Equal(token, newToken),
+
+		out:  make(chan p.Msg, 50),
+		done: make(chan struct{}),
+
+		sendAccumulator: make([]float32, 0, targetFramesize*2),
+	}
+
+	s.sendResampler, err = resample.New(int(sampleRate), int(s.wireRate))
+	if err != nil {
+		return nil, err
+	}
+	s.wireFramesize = targetFramesize * int(s.wireRate) / int(sampleRate)
+
+	s.clients.Store(&map[uint8]*Client{})
+
+	s.wg.Add(3)
+	go s.readLoop()
+	go s.writeLoop()
+	go s.heartbeatLoop()
+
+	return s, nil
+}
+
+func (s *Session) ID() uint8 {
+	return s.id
+}
+
+func (s *Session) Name() string {
+	return s.name
+}
+
+func (s *Session) WireRate() uint32 {
+	return s.wireRate
+}
+
+// Token is what Dial needs to resume this session, nil if the server can't resume
+func (s *Session) Token() []byte {
+	return s.token
+}
+
+func (s *Session) Resumed() bool {
+	return s.resumed
+}
+
+// RTT returns the round trip time to the server, 0 if not measured yet
+func (s *Session) RTT() time.Duration {
+	return time.Duration(s.rtt.Load())
+}
+
+// PeerRTT estimates the round trip time to another client through the server
+func (s *Session) PeerRTT(id uint8) (time.Duration, bool) {
+	rtts := s.peerRTTs.Load()
+	if rtts == nil || s.RTT() == 0 {
+		return 0, false
+	}
+
+	rtt, ok := (*rtts)[id]
+	return s.RTT() + rtt, ok
+}
+
+// Clients returns the remote clients, the map must not be modified
+func (s *Session) Clients() map[uint8]*Client {
+	return *s.clients.Load()
+}
+
+func (s *Session) setClient(c *Client) {
+	clients := maps.Clone(s.Clients())
+	clients[c.id] = c
+	s.clients.Store(&clients)
+}
+
+func (s *Session) removeClient(id uint8) {
+	clients := maps.Clone(s.Clients())
+	delete(clients, id)
+	s.clients.Store(&clients)
+}
+
+// Done is closed when the session has ended
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the session ended, nil after Close
+func (s *Session) Err() error {
+	<-s.done
+	return s.err
+}
+
+// Close ends the session, it is safe to call more than once
+func (s *Session) Close() {
+	s.closeWith(nil)
+}
+
+func (s *Session) closeWith(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+// Leave tells the server we are gone for good, so the others see us leave
+// right away instead of after the resume window, and ends the session
+func (s *Session) Leave() {
+	timeout := time.After(time.Second)
+
+	select {
+	case s.out <- p.NewMsgNP(p.ClientLeave, s.id, s.name):
+		// the writer closes the session once it is sent
+		select {
+		case <-s.done:
+		case <-timeout:
+		}
+	case <-s.done:
+	case <-timeout:
+	}
+
+	s.Close()
+}
+
+// Wait blocks until the reader and writer goroutines have returned
+func (s *Session) Wait() {
+	s.wg.Wait()
+}
+
+// Send queues a message, dropping it if the queue is full or the session ended
+func (s *Session) Send(msg p.Msg) bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+
+	select {
+	case s.out <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// SendText queues a chat message, waiting for room in the queue
+func (s *Session) SendText(text string) bool {
+	select {
+	case s.out <- p.NewMsg(p.Text, s.id, []byte(text), s.name):
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// SendCommand asks the server to run a moderation command
+func (s *Session) SendCommand(line string) bool {
+	select {
+	case s.out <- p.NewMsgP(p.Command, s.id, []byte(line)):
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// SendDirect sends a chat line only to the given clients
+func (s *Session) SendDirect(targets []uint8, text string) bool {
+	select {
+	case s.out <- p.NewMsg(p.DirectText, s.id, p.EncodeTargeted(targets, []byte(text)), s.name):
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// SetWhisper sends the mic only to targets from now on, none goes back to the room
+func (s *Session) SetWhisper(targets []uint8) {
+	if len(targets) == 0 {
+		s.whisper.Store(nil)
+		return
+	}
+	s.whisper.Store(&targets)
+}
+
+// Whisper returns who the mic goes to, nil for the room
+func (s *Session) Whisper() []uint8 {
+	if targets := s.whisper.Load(); targets != nil {
+		return *targets
+	}
+	return nil
+}
+
+// SendAudio resamples captured audio to the wire rate and sends it in whole frames
+func (s *Session) SendAudio(samples []float32) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.sendAccumulator = append(s.sendAccumulator, s.sendResampler.Process(samples)...)
+
+	// send frame only if we have enough samples
+	for len(s.sendAccumulator) >= s.wireFramesize {
+		frame := make([]float32, s.wireFramesize)
+		copy(frame, s.sendAccumulator[:s.wireFramesize])
+
+		if targets := s.Whisper(); targets != nil {
+			s.Send(p.NewMsg(p.Whisper, s.id, p.EncodeTargeted(targets, float32ToBytes(frame)), s.name))
+		} else {
+			s.Send(p.NewMsg(p.Audio, s.id, float32ToBytes(frame), s.name))
+		}
+
+		// remove used samples
+		s.sendAccumulator = s.sendAccumulator[s.wireFramesize:]
+	}
+
+	// Prevent accumulator from growing indefinitely (keep max 2x wireFramesize)
+	if len(s.sendAccumulator) > s.wireFramesize*2 {
+		s.sendAccumulator = s.sendAccumulator[len(s.sendAccumulator)-s.wireFramesize:]
+	}
+}
+
+func (s *Session) newClient(id uint8, name string) *Client {
+	// the rates were checked when the send resampler was created
+	resampler, _ := resample.New(int(s.wireRate), int(sampleRate))
+
+	return &Client{
+		id:           id,
+		name:         name,
+		jitterBuffer: NewJitterBuffer(targetFramesize, int(sampleRate)),
+		lastSamples:  make([]float32, 0),
+		resampler:    resampler,
+		drift:        NewDriftCompensator(int(sampleRate)),
+	}
+}
+
+func (s *Session) audioHandle(id uint8, payload []byte) {
+	client := s.Clients()[id]
+	if client == nil || client.jitterBuffer == nil {
+		return
+	}
+
+	samples := client.resampler.Process(record.DecodeSamples(nil, payload))
+	samples = client.drift.Process(samples)
+	client.pending = append(client.pending, samples...)
+
+	// the jitter buffer expects whole frames at the processing rate
+	for len(client.pending) >= targetFramesize {
+		client.jitterBuffer.Add(client.pending[:targetFramesize])
+		client.pending = client.pending[targetFramesize:]
+	}
+}
+
+// a whisper after this much quiet is announced again
+const whisperGap = 2 * time.Second
+
+func (s *Session) whisperHandle(msg *p.Msg) {
+	_, audio, err := p.DecodeTargeted(msg.Payload)
+	if err != nil {
+		return
+	}
+
+	if client := s.Clients()[msg.ID]; client != nil {
+		now := time.Now()
+		if last := client.whisperAt.Swap(now.UnixNano()); now.Sub(time.Unix(0, last)) > whisperGap {
+			ChatPrintDirect("[whisper]", msg.ID, msg.ClientName, "is whispering to you")
+		}
+	}
+
+	s.audioHandle(msg.ID, audio)
+}
+
+func (s *Session) readLoop() {
+	defer s.wg.Done()
+
+	// older servers don't ping, only time out once this one has
+	heartbeat := false
+
+	for {
+		if heartbeat {
+			s.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+
+		msg, err := p.ReadMsg(s.conn)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			s.closeWith(errors.New("server stopped responding"))
+			return
+		}
+		// assuming conn is closed
+		if err != nil {
+			s.closeWith(err)
+			return
+		}
+
+		switch msg.Type {
+		case p.Ping:
+			heartbeat = true
+			s.handlePing(msg.Payload)
+			continue
+		case p.Pong:
+			heartbeat = true
+			s.handlePong(msg.Payload)
+			continue
+		case p.Kick:
+			s.closeWith(KickedError(msg.Payload))
+			return
+		case p.History:
+			// the sender may have left long ago, don't make a client for them
+			if sent, text, err := p.DecodeHistory(msg.Payload); err == nil {
+				ChatPrintHistory(sent, msg.ID, msg.ClientName, text)
+			}
+			continue
+		}
+
+		// CREATE CLIENT
+		{
+			// if the msg is not from us or we don't have the client registered
+			if _, ok := s.Clients()[msg.ID]; msg.ID != s.id && !ok {
+				s.setClient(s.newClient(msg.ID, msg.ClientName))
+			}
+		}
+
+		switch msg.Type {
+		case p.Audio:
+			s.audioHandle(msg.ID, msg.Payload)
+		case p.Whisper:
+			s.whisperHandle(msg)
+		case p.DirectText:
+			if _, text, err := p.DecodeTargeted(msg.Payload); err == nil {
+				ChatPrintDirect("[dm]", msg.ID, msg.ClientName, string(text))
+				recordText(msg.ClientName+" (dm)", string(text))
+			}
+		case p.Text:
+			var sender string
+			if msg.ID != s.id {
+				sender = msg.ClientName
+			} else {
+				// server is sending msg back with our id, server telling us something
+				sender = "SERVER"
+			}
+			if action, ok := meAction(string(msg.Payload)); ok && msg.ID != s.id {
+				ChatPrintAction(msg.ID, sender, action)
+				recordText(sender, "* "+action)
+				break
+			}
+			ChatPrintMsg(sender, msg)
+			recordText(sender, string(msg.Payload))
+		case p.ClientJoin:
+			ChatPrintServer(fmt.Sprintf("\x1b[34m%s\x1b[m", string(msg.Payload)))
+			recordText("SERVER", string(msg.Payload))
+		case p.ClientReconnect:
+			ChatPrintServer(fmt.Sprintf("\x1b[36m%s\x1b[m", string(msg.Payload)))
+			recordText("SERVER", string(msg.Payload))
+		case p.ClientLeave:
+			ChatPrintServer(fmt.Sprintf("\x1b[38;5;124m%s\x1b[m", string(msg.Payload)))
+			recordText("SERVER", string(msg.Payload))
+
+			// REMOVE CLIENT
+			{
+				s.removeClient(msg.ID)
+			}
+		}
+	}
+}
+
+func (s *Session) writeLoop() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case msg := <-s.out:
+			data, _ := p.EncodeMsg(msg)
+			if _, err := s.conn.Write(data); err != nil {
+				s.closeWith(err)
+				return
+			}
+			if msg.Type == p.ClientLeave {
+				s.closeWith(nil)
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Session) heartbeatLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.Send(p.NewMsgP(p.Ping, s.id, p.EncodePing(now, nil)))
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Session) handlePing(payload []byte) {
+	if rtts, err := p.DecodePing(payload); err == nil {
+		s.peerRTTs.Store(&rtts)
+	}
+
+	s.Send(p.NewMsgP(p.Pong, s.id, p.EncodePong(payload)))
+}
+
+func (s *Session) handlePong(payload []byte) {
+	sent, err := p.DecodePong(payload)
+	if err != nil {
+		return
+	}
+	s.rtt.Store(int64(time.Since(sent)))
+}
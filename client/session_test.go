@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	p "github.com/crolbar/lekvc/lekvcs/protocol"
+)
+
+func writeMsg(t *testing.T, conn net.Conn, msg p.Msg) {
+	data, err := p.EncodeMsg(msg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	conn.Write(data)
+}
+
+var testToken = bytes.Repeat([]byte{7}, p.ResumeTokenSize)
+
+// fakeServer answers the handshake on conn, giving the client id 1,
+// any token it is sent resumes
+func fakeServer(t *testing.T, conn net.Conn) {
+	msg, err := p.ReadMsg(conn)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if msg.Type != p.InitClient {
+		t.Errorf("first message is %d, want InitClient", msg.Type)
+	}
+
+	_, token, _ := p.DecodeInitClient(msg.Payload)
+	if token == nil {
+		token = testToken
+	}
+
+	writeMsg(t, conn, p.NewMsg(p.InitClient, 1, p.EncodeInitClient(p.DefaultSampleRate, token, ""), msg.ClientName))
+}
+
+func newTestSession(t *testing.T, token []byte) (*Session, net.Conn) {
+	server, client := net.Pipe()
+
+	go fakeServer(t, server)
+
+	s, err := NewSession(client, "tester", p.DefaultSampleRate, token, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID() != 1 || s.Name() != "tester" {
+		t.Fatalf("got id %d name %q", s.ID(), s.Name())
+	}
+
+	session.Store(s)
+	t.Cleanup(func() { session.Store(nil) })
+
+	return s, server
+}
+
+// run with -race, the server talks while the audio callbacks and the ui use the session
+func TestSessionConcurrentUse(t *testing.T) {
+	s, server := newTestSession(t, nil)
+
+	// drain what the client sends, net.Pipe writes block until read
+	go func() {
+		for {
+			if _, err := p.ReadMsg(server); err != nil {
+				return
+			}
+		}
+	}()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	// playback callback
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				mix(480)
+			}
+		}
+	}()
+
+	// capture sender and chat
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				s.SendAudio(make([]float32, 480))
+				if i%50 == 0 {
+					s.SendText("hello")
+				}
+			}
+		}
+	}()
+
+	// ui
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				for _, c := range s.Clients() {
+					c.drift.PPM()
+				}
+			}
+		}
+	}()
+
+	frame := float32ToBytes(make([]float32, targetFramesize))
+	for round := range 20 {
+		other := uint8(2 + round%3)
+		writeMsg(t, server, p.NewMsgP(p.ClientJoin, other, []byte("join")))
+		for range 5 {
+			writeMsg(t, server, p.NewMsg(p.Audio, other, frame, "other"))
+		}
+		writeMsg(t, server, p.NewMsg(p.Text, other, []byte("hi"), "other"))
+		writeMsg(t, server, p.NewMsgP(p.ClientLeave, other, []byte("leave")))
+	}
+
+	server.Close()
+
+	<-s.Done()
+	if s.Err() == nil {
+		t.Error("session ended by the server has no error")
+	}
+
+	close(stop)
+	wg.Wait()
+	s.Wait()
+
+	// nothing can be sent after the end
+	if s.SendText("late") {
+		t.Error("SendText succeeded on a closed session")
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	s, server := newTestSession(t, nil)
+	if s.Resumed() || !bytes.Equal(s.Token(), testToken) {
+		t.Fatalf("new session: resumed %v token %v", s.Resumed(), s.Token())
+	}
+	server.Close()
+	s.Wait()
+
+	s, server = newTestSession(t, s.Token())
+	defer server.Close()
+	if !s.Resumed() {
+		t.Error("session with a known token did not resume")
+	}
+	s.Close()
+	s.Wait()
+}
+
+func TestSessionLeave(t *testing.T) {
+	s, server := newTestSession(t, nil)
+	defer server.Close()
+
+	go s.Leave()
+
+	msg, err := p.ReadMsg(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != p.ClientLeave {
+		t.Errorf("got message %d, want ClientLeave", msg.Type)
+	}
+
+	s.Wait()
+	if err := s.Err(); err != nil {
+		t.Errorf("Err after Leave = %v, want nil", err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	s, server := newTestSession(t, nil)
+	defer server.Close()
+
+	s.Close()
+	s.Close()
+	s.Wait()
+
+	if err := s.Err(); err != nil {
+		t.Errorf("Err after Close = %v, want nil", err)
+	}
+	if s.Send(p.NewMsgP(p.Text, s.ID(), []byte("late"))) {
+		t.Error("Send succeeded on a closed session")
+	}
+}
+
+func TestSessionHandshakeWrongType(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		p.ReadMsg(server)
+		writeMsg(t, server, p.NewMsgP(p.Text, 0, []byte("nope")))
+	}()
+
+	if _, err := NewSession(client, "tester", p.DefaultSampleRate, nil, ""); err == nil {
+		t.Error("handshake accepted a Text message")
+	}
+}
+
+func TestSessionPing(t *testing.T) {
+	s, server := newTestSession(t, nil)
+	defer server.Close()
+
+	sent := time.Now()
+	writeMsg(t, server, p.NewMsgP(p.Ping, s.ID(), p.EncodePing(sent, map[uint8]time.Duration{2: 30 * time.Millisecond})))
+
+	msg, err := p.ReadMsg(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != p.Pong {
+		t.Fatalf("got message %d, want Pong", msg.Type)
+	}
+	if echoed, err := p.DecodePong(msg.Payload); err != nil || !echoed.Equal(sent.Round(0)) {
+		t.Errorf("pong carries %v, want %v", echoed, sent)
+	}
+
+	// answer a ping of the client so it knows its own rtt
+	go func() {
+		for {
+			msg, err := p.ReadMsg(server)
+			if err != nil {
+				return
+			}
+			if msg.Type == p.Ping {
+				writeMsg(t, server, p.NewMsgP(p.Pong, s.ID(), p.EncodePong(msg.Payload)))
+			}
+		}
+	}()
+	s.Send(p.NewMsgP(p.Ping, s.ID(), p.EncodePing(time.Now(), nil)))
+
+	deadline := time.Now().Add(time.Second)
+	for s.RTT() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	rtt, ok := s.PeerRTT(2)
+	if !ok || rtt < 30*time.Millisecond {
+		t.Errorf("peer rtt = %v %v, want at least 30ms", rtt, ok)
+	}
+
+	s.Close()
+	s.Wait()
+}
+
+func TestSessionKicked(t *testing.T) {
+	s, server := newTestSession(t, nil)
+	defer server.Close()
+
+	writeMsg(t, server, p.NewMsg(p.Kick, s.ID(), []byte("kicked by admin"), ""))
+	s.Wait()
+
+	var kicked KickedError
+	if err := s.Err(); !errors.As(err, &kicked) || kicked != "kicked by admin" {
+		t.Errorf("Err after Kick = %v, want the kick reason", err)
+	}
+}
+
+func TestSessionHandshakeRejected(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		p.ReadMsg(server)
+		writeMsg(t, server, p.NewMsgP(p.Kick, 0, []byte("banned permanently")))
+	}()
+
+	_, err := NewSession(client, "tester", p.DefaultSampleRate, nil, "")
+	var kicked KickedError
+	if !errors.As(err, &kicked) {
+		t.Errorf("handshake error = %v, want a KickedError", err)
+	}
+}
+
+func TestSessionWhisper(t *testing.T) {
+	s, server := newTestSession(t, nil)
+	defer server.Close()
+
+	s.SetWhisper([]uint8{2, 3})
+	s.SendAudio(make([]float32, targetFramesize))
+
+	msg, err := p.ReadMsg(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != p.Whisper {
+		t.Fatalf("got message %s, want whisper", msg.Type)
+	}
+	targets, audio, err := p.DecodeTargeted(msg.Payload)
+	if err != nil || !bytes.Equal(targets, []byte{2, 3}) || len(audio) != s.wireFramesize*4 {
+		t.Errorf("whisper to %v with %d bytes, want [2 3] with %d", targets, len(audio), s.wireFramesize*4)
+	}
+
+	s.SetWhisper(nil)
+	s.SendAudio(make([]float32, targetFramesize))
+
+	if msg, err = p.ReadMsg(server); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != p.Audio {
+		t.Errorf("got message %s after whisper off, want audio", msg.Type)
+	}
+}
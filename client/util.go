@@ -4,63 +4,12 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math"
+	"strings"
 	"time"
 
 	p "github.com/crolbar/lekvc/lekvcs/protocol"
 )
 
-type RingBuffer struct {
-	buf   []float32
-	size  int
-	read  int
-	write int
-}
-
-func NewRingBuffer(size int) *RingBuffer {
-	return &RingBuffer{
-		buf:  make([]float32, size),
-		size: size,
-	}
-}
-
-func (r *RingBuffer) Write(samples []float32) int {
-	n := 0
-	for _, s := range samples {
-		next := (r.write + 1) % r.size
-		if next == r.read {
-			break // buffer full
-		}
-		r.buf[r.write] = s
-		r.write = next
-		n++
-	}
-	return n
-}
-
-func (r *RingBuffer) Read(out []float32) int {
-	n := 0
-	for i := range out {
-		if r.read == r.write {
-			break // buffer empty
-		}
-		out[i] = r.buf[r.read]
-		r.read = (r.read + 1) % r.size
-		n++
-	}
-	return n
-}
-
-func bytesToFloat32(b []byte) []float32 {
-	size := len(b) / 4
-	out := make([]float32, size)
-
-	for i := range out {
-		out[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[i*4:]))
-	}
-
-	return out
-}
-
 func float32ToBytes(f []float32) []byte {
 	out := make([]byte, len(f)*4)
 	for i, v := range f {
@@ -129,15 +78,19 @@ func ChatPrintServer(text string) {
 }
 
 func Prompt() {
+	input.mu.Lock()
+	line := string(input.line)
+	input.mu.Unlock()
+
 	now := time.Now()
 	fmtTime := now.Format("15:04:05")
-	fmt.Printf("\x1b[38;5;238m[%s]\x1b[m => ", fmtTime)
+	fmt.Printf("\x1b[38;5;238m[%s]\x1b[m => %s", fmtTime, line)
 }
 
 func ChatPrint(sender string, text string) {
 	now := time.Now()
 	fmtTime := now.Format("15:04:05")
-	fmt.Printf("\r\x1b[38;5;238m[%s]\x1b[m %s => %s\n",
+	fmt.Printf("\r\x1b[K\x1b[38;5;238m[%s]\x1b[m %s => %s\n",
 		fmtTime,
 		sender,
 		text)
@@ -149,10 +102,66 @@ func generateClientColorFromID(id uint8) int {
 	return (int(id)*98+21)%255
 }
 
+// ChatPrintDirect prints a private message with a tag so it stands out from the room
+func ChatPrintDirect(tag string, id uint8, name string, text string) {
+	now := time.Now()
+	fmtTime := now.Format("15:04:05")
+	fmt.Printf("\r\x1b[K\x1b[38;5;238m[%s]\x1b[35m %s\x1b[38;5;%dm %s\x1b[m => %s\n",
+		fmtTime,
+		tag,
+		generateClientColorFromID(id),
+		name,
+		text)
+
+	Prompt()
+}
+
+// ChatPrintAction prints a /me line, the name is part of the sentence
+func ChatPrintAction(id uint8, name string, action string) {
+	now := time.Now()
+	fmtTime := now.Format("15:04:05")
+	fmt.Printf("\r\x1b[K\x1b[38;5;238m[%s]\x1b[m * \x1b[38;5;%dm%s\x1b[m %s\n",
+		fmtTime,
+		generateClientColorFromID(id),
+		name,
+		action)
+
+	Prompt()
+}
+
+// meAction returns the action of a line sent with /me
+func meAction(text string) (string, bool) {
+	return strings.CutPrefix(text, "/me ")
+}
+
+// ChatPrintHistory prints an older chat line with the time it was sent, dimmed
+func ChatPrintHistory(sent time.Time, id uint8, name string, text string) {
+	fmtTime := sent.Format("15:04:05")
+	if !sameDay(sent, time.Now()) {
+		fmtTime = sent.Format("Jan 2 15:04")
+	}
+	if action, ok := meAction(text); ok {
+		text = "* " + name + " " + action
+	}
+	fmt.Printf("\r\x1b[K\x1b[38;5;238m[%s]\x1b[38;5;%dm %s\x1b[38;5;244m => %s\x1b[m\n",
+		fmtTime,
+		generateClientColorFromID(id),
+		name,
+		text)
+
+	Prompt()
+}
+
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
+
 func ChatPrintMsg(sender string, msg *p.Msg) {
 	now := time.Now()
 	fmtTime := now.Format("15:04:05")
-	fmt.Printf("\r\x1b[38;5;238m[%s]\x1b[38;5;%dm %s\x1b[m => %s\n",
+	fmt.Printf("\r\x1b[K\x1b[38;5;238m[%s]\x1b[38;5;%dm %s\x1b[m => %s\n",
 		fmtTime,
 		generateClientColorFromID(msg.ID),
 		sender,
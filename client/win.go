@@ -15,3 +15,22 @@ func enableANSI() {
 	mode |= windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING
 	windows.SetConsoleMode(h, mode)
 }
+
+// enableCbreak stops the console from buffering lines and echoing,
+// so the line editor sees every key. Ctrl+C still interrupts.
+func enableCbreak() (restore func(), err error) {
+	h := windows.Handle(os.Stdin.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(h, &mode); err != nil {
+		return nil, err
+	}
+
+	cbreak := mode&^(windows.ENABLE_LINE_INPUT|windows.ENABLE_ECHO_INPUT) | windows.ENABLE_VIRTUAL_TERMINAL_INPUT
+	if err := windows.SetConsoleMode(h, cbreak); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		windows.SetConsoleMode(h, mode)
+	}, nil
+}
@@ -0,0 +1,81 @@
+// Package cmdline splits the command lines typed into the client and the
+// server console, the client and the server have to agree on the quoting
+package cmdline
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Split splits a command line into words the way a shell does,
+// quotes keep spaces inside a word and a backslash escapes the next character
+func Split(line string) ([]string, error) {
+	words, _, err := SplitN(line, -1)
+	return words, err
+}
+
+// SplitN splits the first n words of line like Split and returns the rest
+// of the line as it was typed, for commands ending in free text.
+// A negative n splits every word
+func SplitN(line string, n int) (words []string, rest string, err error) {
+	var (
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+
+	for i, r := range line {
+		if len(words) == n && !inWord {
+			return words, strings.TrimSpace(line[i:]), nil
+		}
+
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, "", fmt.Errorf("missing closing %c", quote)
+	}
+	if escaped {
+		return nil, "", errors.New("nothing to escape after the last \\")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, "", nil
+}
+
+// Quote quotes s if Split wouldn't give it back as one word
+func Quote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
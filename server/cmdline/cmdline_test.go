@@ -0,0 +1,79 @@
+package cmdline
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"/msg bob hi there", []string{"/msg", "bob", "hi", "there"}},
+		{`/msg "bob smith" 'it''s'`, []string{"/msg", "bob smith", "its"}},
+		{`/msg bob "say \"hi\""`, []string{"/msg", "bob", `say "hi"`}},
+		{`/nick a\ b ""`, []string{"/nick", "a b", ""}},
+		{`/x 'no \escape'`, []string{"/x", `no \escape`}},
+		{"  ", nil},
+	}
+	for _, tt := range tests {
+		got, err := Split(tt.line)
+		if err != nil {
+			t.Errorf("Split(%q): %v", tt.line, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Split(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+
+	for _, line := range []string{`/msg "bob`, `/msg 'bob`, `/msg bob\`} {
+		if _, err := Split(line); err == nil {
+			t.Errorf("Split(%q) succeeded", line)
+		}
+	}
+}
+
+func TestSplitN(t *testing.T) {
+	tests := []struct {
+		line  string
+		n     int
+		words []string
+		rest  string
+	}{
+		{"doesn't care", 0, nil, "doesn't care"},
+		{"  waves  ", 0, nil, "waves"},
+		{"bob it's fine", 1, []string{"bob"}, "it's fine"},
+		{`bob "hi"`, 1, []string{"bob"}, `"hi"`},
+		{`"bob smith"   say  it`, 1, []string{"bob smith"}, "say  it"},
+		{"bob", 1, []string{"bob"}, ""},
+		{"bob ", 1, []string{"bob"}, ""},
+		{"", 1, nil, ""},
+		{"/kick eve spamming 'a lot", 2, []string{"/kick", "eve"}, "spamming 'a lot"},
+	}
+	for _, tt := range tests {
+		words, rest, err := SplitN(tt.line, tt.n)
+		if err != nil {
+			t.Errorf("SplitN(%q, %d): %v", tt.line, tt.n, err)
+			continue
+		}
+		if !slices.Equal(words, tt.words) || rest != tt.rest {
+			t.Errorf("SplitN(%q, %d) = %q, %q, want %q, %q", tt.line, tt.n, words, rest, tt.words, tt.rest)
+		}
+	}
+
+	// only the words split have to be quoted right
+	if _, _, err := SplitN(`"bob it's`, 1); err == nil {
+		t.Error(`SplitN("\"bob it's", 1) succeeded`)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for _, s := range []string{"bob", "bob smith", "", `it's "quoted" \ here`} {
+		got, err := Split(Quote(s))
+		if err != nil || len(got) != 1 || got[0] != s {
+			t.Errorf("Split(Quote(%q)) = %q, %v", s, got, err)
+		}
+	}
+}
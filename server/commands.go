@@ -0,0 +1,120 @@
+package main
+
+import "github.com/crolbar/lekvc/lekvcs/cmdline"
+
+type cmd struct {
+	f    func(from *Client, args []string)
+	desc string
+	// least role that can run it
+	role Role
+
+	// the line after the first words arguments is passed as typed,
+	// as one last argument, for commands ending in free text
+	text  bool
+	words int
+}
+
+// args splits what follows the command name into its arguments
+func (c cmd) args(line string) ([]string, error) {
+	if !c.text {
+		return cmdline.Split(line)
+	}
+
+	args, rest, err := cmdline.SplitN(line, c.words)
+	if rest != "" {
+		args = append(args, rest)
+	}
+	return args, err
+}
+
+var commands map[string]cmd
+
+func InitCommands() {
+	commands = map[string]cmd{
+		"/help": cmd{
+			f:    handleHelp,
+			desc: "commands you can run",
+			role: Guest,
+		},
+
+		"/history": cmd{
+			f:    handleHistory,
+			desc: "older chat: /history [n]",
+			role: Guest,
+		},
+
+		"/list": cmd{
+			f:    handleWho,
+			desc: "connected clients with their role, address and token",
+			role: Moderator,
+		},
+		"/who": cmd{
+			f:    handleWho,
+			desc: "connected clients with their role, address and token",
+			role: Moderator,
+		},
+
+		"/kick": cmd{
+			f:     handleKick,
+			desc:  "disconnect someone: /kick <name|id> [reason]",
+			role:  Moderator,
+			text:  true,
+			words: 1,
+		},
+		"/ban": cmd{
+			f:     handleBan,
+			desc:  "keep someone out: /ban <name|id|name:x|ip:x|token:x> [duration|perm] [reason]",
+			role:  Moderator,
+			text:  true,
+			words: 1,
+		},
+		"/unban": cmd{
+			f:    handleUnban,
+			desc: "lift bans: /unban <name|ip:x|token:x>",
+			role: Moderator,
+		},
+		"/bans": cmd{
+			f:    handleBans,
+			desc: "list bans",
+			role: Moderator,
+		},
+
+		"/broadcast": cmd{
+			f:    handleBroadcast,
+			desc: "tell everyone something: /broadcast <text>",
+			role: Admin,
+			text: true,
+		},
+		"/rooms": cmd{
+			f:    handleRooms,
+			desc: "rooms and how many are in them",
+			role: Moderator,
+		},
+		"/recording": cmd{
+			f:    handleRecording,
+			desc: "record the room into the -record directory: /recording [on|off]",
+			role: Moderator,
+		},
+		"/stats": cmd{
+			f:    handleStats,
+			desc: "connection details of a client: /stats <name|id>",
+			role: Moderator,
+		},
+		"/shutdown": cmd{
+			f:    handleShutdown,
+			desc: "disconnect everyone and stop: /shutdown [delay]",
+			role: Admin,
+		},
+
+		"/mute": cmd{
+			f:    muteCommand(true),
+			desc: "drop someone's audio: /mute <name|id>",
+			role: Moderator,
+		},
+		"/unmute": cmd{
+			f:    muteCommand(false),
+			desc: "/unmute <name|id>",
+			role: Moderator,
+		},
+	}
+}
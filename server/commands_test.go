@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestCommandArgs(t *testing.T) {
+	InitCommands()
+
+	tests := []struct {
+		command, line string
+		want          []string
+	}{
+		{"/kick", `eve it's "spam"`, []string{"eve", `it's "spam"`}},
+		{"/kick", `"eve smith"`, []string{"eve smith"}},
+		{"/ban", "ip:10.0.0.1 1h don't", []string{"ip:10.0.0.1", "1h don't"}},
+		{"/broadcast", `back in 5', "maybe"`, []string{`back in 5', "maybe"`}},
+		{"/broadcast", "", nil},
+		{"/mute", `"eve smith"`, []string{"eve smith"}},
+	}
+
+	for _, tt := range tests {
+		got, err := commands[tt.command].args(tt.line)
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.command, tt.line, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s %s: %q, want %q", tt.command, tt.line, got, tt.want)
+		}
+	}
+
+	if _, err := commands["/mute"].args(`"eve`); err == nil {
+		t.Error("an unclosed quote was accepted")
+	}
+}
+
+func TestBanReason(t *testing.T) {
+	defer func() { bans = nil }()
+
+	tests := []struct {
+		line      string
+		permanent bool
+		reason    string
+	}{
+		{"name:eve", true, ""},
+		{`name:eve 1h it's "spam"`, false, `it's "spam"`},
+		{"name:eve perm for good", true, "for good"},
+		{"name:eve spamming", true, "spamming"},
+	}
+
+	console := newConsole(io.Discard)
+	for _, tt := range tests {
+		bans = nil
+		console.handleCommand("/ban " + tt.line)
+		if len(bans) != 1 {
+			t.Fatalf("/ban %s: %d bans", tt.line, len(bans))
+		}
+		if b := bans[0]; b.Until.IsZero() != tt.permanent || b.Reason != tt.reason {
+			t.Errorf("/ban %s: until %v, reason %q, want permanent %v, reason %q", tt.line, b.Until, b.Reason, tt.permanent, tt.reason)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// newConsole returns the identity commands typed on an admin console run as
+func newConsole(w io.Writer) *Client {
+	return &Client{name: "console", role: Admin, console: w, log: slog.With("console", true)}
+}
+
+// how long a console reply waits for a reader that stopped reading
+var consoleWriteTimeout = 5 * time.Second
+
+// flushReplies writes the queued replies of a console,
+// a console that doesn't take them in time is closed
+func (c *Client) flushReplies() {
+	replies := c.consoleReplies
+	c.consoleReplies = c.consoleReplies[:0]
+
+	conn, isConn := c.console.(net.Conn)
+	if isConn {
+		conn.SetWriteDeadline(time.Now().Add(consoleWriteTimeout))
+	}
+	for _, text := range replies {
+		if _, err := fmt.Fprintln(c.console, text); err != nil {
+			c.log.Warn("console stopped reading", "err", err)
+			if isConn {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// runConsole runs every line read from r as a command, the slash is optional
+func runConsole(r io.Reader, w io.Writer) {
+	console := newConsole(w)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "/") {
+			line = "/" + line
+		}
+		console.handleCommand(line)
+	}
+}
+
+// the console socket, closing it on shutdown removes the file
+var consoleListener net.Listener
+
+// listenConsole serves the admin console on a unix socket at path,
+// for when stdin isn't a terminal like under systemd
+func listenConsole(path string) error {
+	// a socket left behind by an earlier run, never anything else
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return err
+	}
+
+	consoleListener = ln
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			// closed on shutdown
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				slog.Error("console accept failed", "err", err)
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				runConsole(conn, conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+func handleHelp(from *Client, args []string) {
+	names := slices.Sorted(func(yield func(string) bool) {
+		for name, c := range commands {
+			if c.role <= from.role && !yield(name) {
+				return
+			}
+		}
+	})
+
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%s => %s", name, commands[name].desc)
+	}
+	reply(from, b.String())
+}
+
+func handleBroadcast(from *Client, args []string) {
+	if len(args) == 0 {
+		reply(from, "usage: /broadcast <text>")
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	announce(strings.Join(args, " "))
+}
+
+// there is one room, everyone connected is in it
+func handleRooms(from *Client, args []string) {
+	mu.Lock()
+	n := len(clients)
+	mu.Unlock()
+
+	text := fmt.Sprintf("1 room, %d clients, %d Hz", n, sampleRate)
+	if recording.Load() != nil {
+		text += ", recording"
+	}
+	reply(from, text)
+}
+
+func handleStats(from *Client, args []string) {
+	if len(args) < 1 {
+		reply(from, "usage: /stats <name|id>")
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	c := findClient(args[0])
+	if c == nil {
+		reply(from, "no client "+args[0])
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "id %d, name %s, role %s\n", c.id, c.name, c.role)
+	fmt.Fprintf(&b, "address %s, token %s\n", c.conn.RemoteAddr(), tokenID(c.token))
+	fmt.Fprintf(&b, "connected for %s", time.Since(c.joined).Round(time.Second))
+	if rtt := c.rtt.Load(); rtt > 0 {
+		fmt.Fprintf(&b, ", rtt %s", time.Duration(rtt).Round(time.Millisecond))
+	}
+	fmt.Fprintf(&b, "\ncontrol queue %d/%d, audio queue %d/%d, audio dropped %d",
+		len(c.ch), cap(c.ch), len(c.audio), cap(c.audio), c.drops.Load())
+	if paused := time.Until(time.Unix(0, c.audioPausedUntil.Load())); paused > 0 {
+		fmt.Fprintf(&b, ", audio paused for %s", paused.Round(time.Second))
+	}
+	if c.muted.Load() {
+		b.WriteString(", muted")
+	}
+	reply(from, b.String())
+}
+
+func handleShutdown(from *Client, args []string) {
+	delay := shutdownDelay
+	if len(args) > 0 {
+		var err error
+		delay, err = time.ParseDuration(args[0])
+		if err != nil || delay < 0 {
+			reply(from, "usage: /shutdown [delay like 30s]")
+			return
+		}
+	}
+
+	go shutdown(delay)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsoleCloseIsQuiet(t *testing.T) {
+	var logged bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logged, nil)))
+
+	path := filepath.Join(t.TempDir(), "console.sock")
+	if err := listenConsole(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { consoleListener = nil }()
+
+	consoleListener.Close()
+	// the accept loop has to notice
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket is still there: %v", err)
+	}
+	if strings.Contains(logged.String(), "level=ERROR") {
+		t.Errorf("closing the console logged an error: %s", logged.String())
+	}
+}
+
+func TestConsoleReplyWaitsOutsideLock(t *testing.T) {
+	InitCommands()
+	defer func(d time.Duration) { consoleWriteTimeout = d }(consoleWriteTimeout)
+	consoleWriteTimeout = 200 * time.Millisecond
+
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runConsole(server, server)
+	}()
+
+	// replies under mu, and nobody reads it
+	if _, err := client.Write([]byte("stats nobody\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	locked := make(chan struct{})
+	go func() {
+		mu.Lock()
+		mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("mu is held while the console reply waits")
+	}
+
+	// the console is given up on once the write times out
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the console wasn't closed")
+	}
+}
+
+func TestConsoleReplies(t *testing.T) {
+	InitCommands()
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		runConsole(server, server)
+	}()
+
+	go client.Write([]byte("/stats nobody\nrooms\n"))
+
+	r := bufio.NewReader(client)
+	for _, want := range []string{"no client nobody\n", "1 room, "} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, want) {
+			t.Errorf("got %q, want %q", line, want)
+		}
+	}
+}
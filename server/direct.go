@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+
+	p "github.com/crolbar/lekvc/lekvcs/protocol"
+)
+
+// sendToTargets relays a DirectText or Whisper to the clients it names,
+// they get it with c's id and name and the same list of targets.
+// Private messages are left out of the recording.
+func (c *Client) sendToTargets(msg *p.Msg) {
+	targets, _, err := p.DecodeTargeted(msg.Payload)
+	if err != nil {
+		return
+	}
+
+	out := p.NewMsg(msg.Type, c.id, msg.Payload, c.name)
+
+	mu.Lock()
+	var missing []uint8
+	for _, id := range targets {
+		other, ok := clients[id]
+		if !ok || other == c {
+			missing = append(missing, id)
+			continue
+		}
+		other.send(out)
+	}
+	mu.Unlock()
+
+	// audio is sent every frame, telling once per frame would be a flood
+	if len(missing) > 0 && msg.Type == p.DirectText {
+		c.sendServerText(fmt.Sprintf("no client with id %v", missing))
+	}
+}
+
+func (c *Client) handleDirectText(msg *p.Msg) {
+	c.sendToTargets(msg)
+}
+
+func (c *Client) handleWhisper(msg *p.Msg) {
+	if c.muted.Load() {
+		return
+	}
+	c.sendToTargets(msg)
+}
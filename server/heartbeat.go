@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	p "github.com/crolbar/lekvc/lekvcs/protocol"
+)
+
+const heartbeatInterval = 5 * time.Second
+
+// a client that sent nothing, not even a Pong, for this long is dropped
+var idleTimeout = 15 * time.Second
+
+// heartbeatLoop pings every client, sharing the round trip times
+// so the clients can show them for each other
+func heartbeatLoop() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		mu.Lock()
+		rtts := make(map[ClientID]time.Duration, len(clients))
+		for _, c := range clients {
+			if rtt := c.rtt.Load(); rtt > 0 {
+				rtts[c.id] = time.Duration(rtt)
+			}
+		}
+
+		payload := p.EncodePing(now, rtts)
+		for _, c := range clients {
+			c.send(p.NewMsgP(p.Ping, c.id, payload))
+		}
+		mu.Unlock()
+	}
+}
+
+func (c *Client) handlePing(payload []byte) {
+	c.send(p.NewMsgP(p.Pong, c.id, p.EncodePong(payload)))
+}
+
+func (c *Client) handlePong(payload []byte) {
+	sent, err := p.DecodePong(payload)
+	if err != nil {
+		return
+	}
+	c.rtt.Store(int64(time.Since(sent)))
+}
+
+// isDisconnect reports whether a read error is the peer going away
+// rather than something worth printing
+func isDisconnect(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	p "github.com/crolbar/lekvc/lekvcs/protocol"
+)
+
+var (
+	// chat lines kept for the room
+	historySize = 500
+	// lines replayed to someone joining
+	historyReplay = 20
+)
+
+// historyEntry is one chat line of the room
+type historyEntry struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	ID   ClientID  `json:"id"`
+	Name string    `json:"name"`
+	Text string    `json:"text"`
+}
+
+var (
+	// oldest first, at most historySize
+	history   []historyEntry
+	historyMu sync.Mutex
+	// the append-only log, nil unless -history-file
+	historyLog *os.File
+)
+
+// openHistory loads the end of the log at path and keeps appending to it
+func openHistory(path string) error {
+	f, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var e historyEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				slog.Warn("skipping bad history line", "file", path, "err", err)
+				continue
+			}
+			keepHistory(e)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	historyLog, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	return err
+}
+
+// keepHistory appends e dropping the oldest line past historySize, historyMu must be held
+func keepHistory(e historyEntry) {
+	history = append(history, e)
+	if over := len(history) - historySize; over > 0 {
+		history = append(history[:0], history[over:]...)
+	}
+}
+
+// addHistory remembers a chat line of c
+func (c *Client) addHistory(text string) {
+	if historySize <= 0 {
+		return
+	}
+
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	e := historyEntry{Time: time.Now(), ID: c.id, Name: c.name, Text: text}
+	if len(history) > 0 {
+		e.Seq = history[len(history)-1].Seq + 1
+	}
+	keepHistory(e)
+
+	if historyLog != nil {
+		data, _ := json.Marshal(e)
+		if _, err := historyLog.Write(append(data, '\n')); err != nil {
+			slog.Error("writing history failed", "err", err)
+		}
+	}
+}
+
+// historyBefore returns up to n lines said before seq, oldest first
+func historyBefore(seq uint64, n int) []historyEntry {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	end := len(history)
+	for end > 0 && history[end-1].Seq >= seq {
+		end--
+	}
+	start := max(0, end-n)
+	return append([]historyEntry(nil), history[start:end]...)
+}
+
+// sendHistory sends lines to c and moves its cursor to the oldest of them
+func (c *Client) sendHistory(entries []historyEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	if c.console != nil {
+		var b strings.Builder
+		for i, e := range entries {
+			if i > 0 {
+				b.WriteString("\n")
+			}
+			fmt.Fprintf(&b, "[%s] %s: %s", e.Time.Format(time.DateTime), e.Name, e.Text)
+		}
+		reply(c, b.String())
+	} else {
+		for _, e := range entries {
+			c.send(p.NewMsg(p.History, e.ID, p.EncodeHistory(e.Time, e.Text), e.Name))
+		}
+	}
+
+	c.historyCursor.Store(entries[0].Seq)
+}
+
+// replayHistory catches a client that just joined up on the chat
+func (c *Client) replayHistory() {
+	c.historyCursor.Store(^uint64(0))
+	c.sendHistory(historyBefore(^uint64(0), historyReplay))
+}
+
+func handleHistory(from *Client, args []string) {
+	n := historyReplay
+	if len(args) > 0 {
+		var err error
+		n, err = strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			reply(from, "usage: /history [n]")
+			return
+		}
+	}
+	// the lines go out on the control queue, leave room for everything else
+	n = min(n, controlQueueSize/2)
+
+	// the console starts from the newest line every time
+	if from.console != nil {
+		from.historyCursor.Store(^uint64(0))
+	}
+
+	entries := historyBefore(from.historyCursor.Load(), n)
+	if len(entries) == 0 {
+		reply(from, "no older messages")
+		return
+	}
+	reply(from, fmt.Sprintf("%d messages from %s", len(entries), entries[0].Time.Format(time.DateTime)))
+	from.sendHistory(entries)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	p "github.com/crolbar/lekvc/lekvcs/protocol"
+)
+
+// testHistory empties the room's history for a test with room for size lines
+func testHistory(t *testing.T, size int) {
+	t.Helper()
+	prevSize, prevReplay := historySize, historyReplay
+	historyMu.Lock()
+	history = nil
+	historyMu.Unlock()
+	historySize = size
+
+	t.Cleanup(func() {
+		historyMu.Lock()
+		history = nil
+		if historyLog != nil {
+			historyLog.Close()
+			historyLog = nil
+		}
+		historyMu.Unlock()
+		historySize, historyReplay = prevSize, prevReplay
+	})
+}
+
+// say adds n numbered lines to the history
+func say(c *Client, from, n int) {
+	for i := from; i < from+n; i++ {
+		c.addHistory(fmt.Sprint("line ", i))
+	}
+}
+
+// queuedHistory takes the History messages queued for c
+func queuedHistory(t *testing.T, c *Client) []string {
+	t.Helper()
+	var lines []string
+	for {
+		select {
+		case msg := <-c.ch:
+			if msg.Type != p.History {
+				continue
+			}
+			_, text, err := p.DecodeHistory(msg.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, text)
+		default:
+			return lines
+		}
+	}
+}
+
+// readHistory reads n History messages from conn skipping everything else
+func readHistory(t *testing.T, conn net.Conn, n int) []string {
+	t.Helper()
+	var lines []string
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(lines) < n {
+		msg, err := p.ReadMsg(conn)
+		if err != nil {
+			t.Fatalf("after %q: %v", lines, err)
+		}
+		if msg.Type != p.History {
+			continue
+		}
+		_, text, err := p.DecodeHistory(msg.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, text)
+	}
+	return lines
+}
+
+func equalLines(got []string, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHistoryBound(t *testing.T) {
+	testHistory(t, 3)
+	c, _ := newTestClient(1)
+
+	say(c, 0, 5)
+
+	if len(history) != 3 {
+		t.Fatalf("kept %d lines, want 3", len(history))
+	}
+	for i, e := range history {
+		if want := uint64(i + 2); e.Seq != want || e.Text != fmt.Sprint("line ", want) {
+			t.Errorf("line %d is %d %q", i, e.Seq, e.Text)
+		}
+	}
+
+	if got := historyBefore(4, 10); len(got) != 2 || got[0].Seq != 2 {
+		t.Errorf("before 4 got %+v", got)
+	}
+	if got := historyBefore(2, 10); len(got) != 0 {
+		t.Errorf("before the oldest line got %+v", got)
+	}
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	testHistory(t, 0)
+	c, _ := newTestClient(1)
+
+	say(c, 0, 3)
+	if len(history) != 0 {
+		t.Errorf("kept %d lines with the history off", len(history))
+	}
+}
+
+func TestHistoryPaging(t *testing.T) {
+	InitCommands()
+	testHistory(t, 100)
+	historyReplay = 3
+	c, _ := newTestClient(1)
+
+	say(c, 0, 8)
+
+	c.replayHistory()
+	if got := queuedHistory(t, c); !equalLines(got, "line 5", "line 6", "line 7") {
+		t.Fatalf("replayed %q", got)
+	}
+
+	// every call goes further back from where the last one stopped
+	handleHistory(c, []string{"2"})
+	if got := queuedHistory(t, c); !equalLines(got, "line 3", "line 4") {
+		t.Fatalf("first page %q", got)
+	}
+	handleHistory(c, []string{"2"})
+	if got := queuedHistory(t, c); !equalLines(got, "line 1", "line 2") {
+		t.Fatalf("second page %q", got)
+	}
+	handleHistory(c, nil)
+	if got := queuedHistory(t, c); !equalLines(got, "line 0") {
+		t.Fatalf("last page %q", got)
+	}
+
+	handleHistory(c, nil)
+	if got := queuedHistory(t, c); len(got) != 0 {
+		t.Fatalf("paged past the oldest line: %q", got)
+	}
+}
+
+func TestHistoryReplayOnJoin(t *testing.T) {
+	testHistory(t, 100)
+	historyReplay = 2
+	addr := serve(t)
+
+	alice, _ := join(t, addr, "alice", nil)
+	for _, text := range []string{"one", "two", "three"} {
+		data, _ := p.EncodeMsg(p.NewMsg(p.Text, 0, []byte(text), ""))
+		if _, err := alice.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the lines are kept by alice's read loop, wait for the last one
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		historyMu.Lock()
+		n := len(history)
+		historyMu.Unlock()
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("kept %d of 3 lines", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	bob, _ := join(t, addr, "bob", nil)
+	if got := readHistory(t, bob, 2); !equalLines(got, "two", "three") {
+		t.Errorf("bob got %q", got)
+	}
+}
+
+func TestHistoryPagingSurvivesResume(t *testing.T) {
+	InitCommands()
+	testHistory(t, 100)
+	historyReplay = 2
+	c, _ := newTestClient(1)
+	say(c, 0, 8)
+	addr := serve(t)
+
+	page := func(conn net.Conn) []string {
+		data, _ := p.EncodeMsg(p.NewMsg(p.Command, 0, []byte("/history 2"), ""))
+		if _, err := conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		return readHistory(t, conn, 2)
+	}
+
+	old, init := join(t, addr, "alice", nil)
+	_, token, _ := p.DecodeInitClient(init.Payload)
+	if got := readHistory(t, old, 2); !equalLines(got, "line 6", "line 7") {
+		t.Fatalf("replayed %q", got)
+	}
+	if got := page(old); !equalLines(got, "line 4", "line 5") {
+		t.Fatalf("first page %q", got)
+	}
+
+	// the resumed connection carries on from the old one's cursor
+	conn, _ := join(t, addr, "alice", token)
+	if got := page(conn); !equalLines(got, "line 2", "line 3") {
+		t.Fatalf("page after resuming %q", got)
+	}
+}
+
+func TestHistoryReload(t *testing.T) {
+	testHistory(t, 3)
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	c, _ := newTestClient(1)
+
+	if err := openHistory(path); err != nil {
+		t.Fatal(err)
+	}
+	say(c, 0, 5)
+	historyLog.Close()
+	historyLog = nil
+
+	// a torn last line is skipped, not fatal
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("{\"seq\":\n")
+	f.Close()
+
+	// the log keeps every line, only the ring is bounded
+	f, _ = os.Open(path)
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		lines++
+	}
+	f.Close()
+	if lines != 6 {
+		t.Errorf("the log has %d lines, want 6", lines)
+	}
+
+	history = nil
+	if err := openHistory(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].Text != "line 2" || history[2].Seq != 4 {
+		t.Fatalf("reloaded %+v", history)
+	}
+
+	// new lines number on from the reloaded ones
+	say(c, 5, 1)
+	if last := history[len(history)-1]; last.Seq != 5 || last.Text != "line 5" || last.Name != "test" {
+		t.Errorf("the next line is %+v", last)
+	}
+}
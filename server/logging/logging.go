@@ -0,0 +1,193 @@
+// Package logging sets up log/slog for the server and the client,
+// colored lines for terminals and text or JSON for everything else.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Color on a terminal, Text otherwise
+	Auto  = "auto"
+	Text  = "text"
+	JSON  = "json"
+	Color = "color"
+)
+
+// EventKey is the attribute that picks the color of a line in the Color format
+const EventKey = "event"
+
+// colors of the events, lines without one are colored by level
+var eventColors = map[string]string{
+	"join":       "\x1b[34m",
+	"reconnect":  "\x1b[36m",
+	"leave":      "\x1b[31m",
+	"drop":       "\x1b[33m",
+	"timeout":    "\x1b[33m",
+	"moderation": "\x1b[35m",
+}
+
+var levelColors = map[slog.Level]string{
+	slog.LevelDebug: "\x1b[38;5;244m",
+	slog.LevelInfo:  "",
+	slog.LevelWarn:  "\x1b[33m",
+	slog.LevelError: "\x1b[31m",
+}
+
+// IsTerminal reports whether f is a character device, a terminal in practice
+func IsTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// New returns a logger writing to w in the given format,
+// Auto only picks Color for a terminal
+func New(w io.Writer, format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	if format == Auto {
+		format = Text
+		if f, ok := w.(*os.File); ok && IsTerminal(f) {
+			format = Color
+		}
+	}
+
+	switch format {
+	case Text:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case JSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case Color:
+		return slog.New(NewColorHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, want auto, text, json or color", format)
+}
+
+// ColorHandler writes one colored line per record for people watching a terminal
+type ColorHandler struct {
+	opts slog.HandlerOptions
+
+	mu *sync.Mutex
+	w  io.Writer
+
+	// preformatted attributes from WithAttrs
+	attrs  string
+	event  string
+	prefix string
+}
+
+func NewColorHandler(w io.Writer, opts *slog.HandlerOptions) *ColorHandler {
+	h := &ColorHandler{mu: &sync.Mutex{}, w: w}
+	if opts != nil {
+		h.opts = *opts
+	}
+	return h
+}
+
+func (h *ColorHandler) Enabled(_ context.Context, level slog.Level) bool {
+	min := slog.LevelInfo
+	if h.opts.Level != nil {
+		min = h.opts.Level.Level()
+	}
+	return level >= min
+}
+
+func (h *ColorHandler) Handle(_ context.Context, r slog.Record) error {
+	var attrs strings.Builder
+	attrs.WriteString(h.attrs)
+
+	event := h.event
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == EventKey && h.prefix == "" {
+			event = a.Value.String()
+			return true
+		}
+		h.appendAttr(&attrs, h.prefix, a)
+		return true
+	})
+
+	color, ok := eventColors[event]
+	if !ok {
+		color = levelColors[r.Level]
+	}
+
+	var b strings.Builder
+	if !r.Time.IsZero() {
+		fmt.Fprintf(&b, "\x1b[38;5;238m[%s]\x1b[m ", r.Time.Format(time.TimeOnly))
+	}
+	if r.Level != slog.LevelInfo {
+		fmt.Fprintf(&b, "%s%s\x1b[m ", levelColors[r.Level], r.Level)
+	}
+	fmt.Fprintf(&b, "%s%s\x1b[m", color, r.Message)
+	if attrs.Len() > 0 {
+		fmt.Fprintf(&b, "\x1b[38;5;244m%s\x1b[m", attrs.String())
+	}
+	b.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *ColorHandler) appendAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			h.appendAttr(b, prefix, ga)
+		}
+		return
+	}
+
+	value := a.Value.String()
+	if strings.ContainsAny(value, " \"=") || value == "" {
+		value = fmt.Sprintf("%q", value)
+	}
+	fmt.Fprintf(b, " %s%s=%s", prefix, a.Key, value)
+}
+
+func (h *ColorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+
+	var b strings.Builder
+	b.WriteString(h.attrs)
+	for _, a := range attrs {
+		if a.Key == EventKey && h.prefix == "" {
+			h2.event = a.Value.String()
+			continue
+		}
+		h.appendAttr(&b, h.prefix, a)
+	}
+	h2.attrs = b.String()
+	return &h2
+}
+
+func (h *ColorHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	h2 := *h
+	h2.prefix += name + "."
+	return &h2
+}
@@ -0,0 +1,112 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handle writes a record without a time, so the line is always the same
+func handle(h slog.Handler, level slog.Level, msg string, attrs ...slog.Attr) {
+	r := slog.NewRecord(time.Time{}, level, msg, 0)
+	r.AddAttrs(attrs...)
+	h.Handle(context.Background(), r)
+}
+
+func TestColorHandlerLevels(t *testing.T) {
+	tests := []struct {
+		level slog.Level
+		attrs []slog.Attr
+		want  string
+	}{
+		{slog.LevelInfo, nil, "hello\x1b[m\n"},
+		{slog.LevelDebug, nil, "\x1b[38;5;244mDEBUG\x1b[m \x1b[38;5;244mhello\x1b[m\n"},
+		{slog.LevelWarn, nil, "\x1b[33mWARN\x1b[m \x1b[33mhello\x1b[m\n"},
+		{slog.LevelError, nil, "\x1b[31mERROR\x1b[m \x1b[31mhello\x1b[m\n"},
+		// the event picks the color of the message, the level is still shown
+		{slog.LevelInfo, []slog.Attr{slog.String(EventKey, "join")}, "\x1b[34mhello\x1b[m\n"},
+		{slog.LevelWarn, []slog.Attr{slog.String(EventKey, "leave")}, "\x1b[33mWARN\x1b[m \x1b[31mhello\x1b[m\n"},
+		{slog.LevelInfo, []slog.Attr{slog.String(EventKey, "nope")}, "hello\x1b[m\n"},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		h := NewColorHandler(&b, &slog.HandlerOptions{Level: slog.LevelDebug})
+		handle(h, tt.level, "hello", tt.attrs...)
+		if b.String() != tt.want {
+			t.Errorf("%s %v: got %q, want %q", tt.level, tt.attrs, b.String(), tt.want)
+		}
+	}
+}
+
+func TestColorHandlerEnabled(t *testing.T) {
+	h := NewColorHandler(&bytes.Buffer{}, nil)
+	if h.Enabled(context.Background(), slog.LevelDebug) || !h.Enabled(context.Background(), slog.LevelInfo) {
+		t.Error("without options only info and up should be enabled")
+	}
+
+	h = NewColorHandler(&bytes.Buffer{}, &slog.HandlerOptions{Level: slog.LevelError})
+	if h.Enabled(context.Background(), slog.LevelWarn) {
+		t.Error("warn is enabled at the error level")
+	}
+}
+
+func TestColorHandlerAttrs(t *testing.T) {
+	var b bytes.Buffer
+	base := NewColorHandler(&b, nil)
+
+	h := base.WithAttrs([]slog.Attr{slog.Int("id", 3), slog.String(EventKey, "join")}).
+		WithGroup("conn").
+		WithAttrs([]slog.Attr{slog.String("addr", "1.2.3.4:5")}).
+		WithGroup("")
+	handle(h, slog.LevelInfo, "hello",
+		slog.String("name", "a b"),
+		slog.String("empty", ""),
+		// only a top level event colors the line
+		slog.String(EventKey, "leave"),
+		slog.Group("rtt", slog.Int("ms", 12)),
+	)
+
+	want := "\x1b[34mhello\x1b[m\x1b[38;5;244m id=3 conn.addr=1.2.3.4:5 conn.name=\"a b\" conn.empty=\"\" conn.event=leave conn.rtt.ms=12\x1b[m\n"
+	if b.String() != want {
+		t.Errorf("got  %q\nwant %q", b.String(), want)
+	}
+
+	// the derived handlers leave the one they came from alone
+	b.Reset()
+	handle(base, slog.LevelInfo, "plain")
+	if b.String() != "plain\x1b[m\n" {
+		t.Errorf("the base handler wrote %q", b.String())
+	}
+}
+
+func TestColorHandlerTime(t *testing.T) {
+	var b bytes.Buffer
+	slog.New(NewColorHandler(&b, nil)).Info("hello")
+	if !strings.HasPrefix(b.String(), "\x1b[38;5;238m[") || !strings.Contains(b.String(), "]\x1b[m hello") {
+		t.Errorf("no time in %q", b.String())
+	}
+}
+
+func TestAutoWithoutTerminal(t *testing.T) {
+	var b bytes.Buffer
+	logger, err := New(&b, Auto, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hello", EventKey, "join", "name", "a b")
+
+	line := b.String()
+	if strings.Contains(line, "\x1b") {
+		t.Errorf("colors written to a buffer: %q", line)
+	}
+	if !strings.Contains(line, `level=INFO msg=hello event=join name="a b"`) {
+		t.Errorf("not the text format: %q", line)
+	}
+
+	if _, err := New(&b, "fancy", slog.LevelInfo); err == nil {
+		t.Error("an unknown format was accepted")
+	}
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/crolbar/lekvc/lekvcs/logging"
 	p "github.com/crolbar/lekvc/lekvcs/protocol"
 )
 
@@ -16,7 +22,53 @@ type Client struct {
 	id   ClientID
 	name string
 	conn net.Conn
-	ch   chan p.Msg
+	// control and chat, reliable
+	ch chan p.Msg
+	// audio, drops the oldest when full
+	audio chan p.Msg
+
+	// lets the client resume as itself after a drop
+	token []byte
+
+	// last measured round trip time in ns, 0 until the first Pong
+	rtt atomic.Int64
+
+	role Role
+	// audio is dropped while a moderator has the client muted
+	muted atomic.Bool
+	// kicked clients can't resume
+	kicked atomic.Bool
+	// the client resumed on another connection while this one was half-open
+	replaced atomic.Bool
+	// the writer closes the connection once the queue is empty
+	closing atomic.Bool
+
+	joined time.Time
+
+	// audio frames dropped because the audio queue was full
+	drops atomic.Uint64
+	// when the client started dropping audio in ns, 0 while it keeps up
+	backlogSince atomic.Int64
+	// no audio is queued for a downgraded client until then, in ns
+	audioPausedUntil atomic.Int64
+	downgrades       atomic.Int32
+
+	limits *limits
+	// audio and chat are dropped until then in ns, set by limitMute
+	limitedUntil atomic.Int64
+
+	// where replies go for an admin console, which isn't in clients
+	console io.Writer
+	// replies of the command running on the console, written once it is done
+	// so a console that stopped reading never holds mu
+	consoleReplies []string
+
+	// carries the id, name and address of the client
+	log *slog.Logger
+
+	// /history goes back from the oldest line sent so far,
+	// atomic as a resume copies it from a connection that may still be reading
+	historyCursor atomic.Uint64
 }
 
 type ClientID = uint8
@@ -26,8 +78,15 @@ var (
 	mu      sync.Mutex
 
 	nextClientID ClientID = 1
+
+	// audio is forwarded as is so every client of the room uses this rate
+	sampleRate uint32 = p.DefaultSampleRate
 )
 
+func clientLogger(c *Client) *slog.Logger {
+	return slog.With("client_id", c.id, "name", c.name, "remote", c.conn.RemoteAddr().String())
+}
+
 func (c *Client) sendToOthers(msg p.Msg) {
 	mu.Lock()
 	for _, other := range clients {
@@ -35,15 +94,21 @@ func (c *Client) sendToOthers(msg p.Msg) {
 			continue
 		}
 
-		select {
-		case other.ch <- msg:
-		default:
-		}
+		other.send(msg)
 	}
 	mu.Unlock()
 }
 
+// sendServerText sends a text message that the client shows as coming from the server
+func (c *Client) sendServerText(text string) {
+	c.send(p.NewMsg(p.Text, c.id, []byte(text), ""))
+}
+
 func (c *Client) handleRecivedAudio(samples []byte) {
+	if c.muted.Load() {
+		return
+	}
+
 	msg := p.NewMsg(
 		p.Audio,
 		c.id,
@@ -51,6 +116,10 @@ func (c *Client) handleRecivedAudio(samples []byte) {
 		c.name,
 	)
 
+	if r := recording.Load(); r != nil {
+		r.Audio(c.id, c.name, samples)
+	}
+
 	c.sendToOthers(msg)
 }
 
@@ -62,54 +131,117 @@ func (c *Client) handleRecivedText(text []byte) {
 		c.name,
 	)
 
+	if r := recording.Load(); r != nil {
+		r.Text(c.name, string(text))
+	}
+	c.addHistory(string(text))
+
 	c.sendToOthers(msg)
 }
 
 func (c *Client) readLoop() {
 	defer func() {
 		mu.Lock()
-		delete(clients, c.id)
+		// the client may have resumed on a new connection already
+		if clients[c.id] == c {
+			delete(clients, c.id)
+		}
 		mu.Unlock()
 		c.conn.Close()
 		close(c.ch)
+		connections.Done()
 	}()
 
-	for {
+	left := false
+	for !left {
+		// anything, at least the Pong to our heartbeat, keeps the client alive
+		c.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+
 		msg, err := p.ReadMsg(c.conn)
-		if opErr, ok := err.(*net.OpError); (ok && opErr.Err.Error() == "read: connection reset by peer") ||
-			err == io.EOF {
-			c.notifyClientLeave()
+		if isTimeout(err) {
+			c.log.Warn("client timed out", logging.EventKey, "timeout")
 			break
 		}
 		if err != nil {
-			panic(err)
+			if errors.Is(err, p.ErrMalformed) {
+				metrics.decodeErrors.Add(1)
+			}
+			if !isDisconnect(err) {
+				c.log.Error("read failed", "err", err)
+			}
+			break
+		}
+		countReceived(msg)
+
+		if !c.allow(msg) {
+			continue
 		}
 
 		switch msg.Type {
 		case p.Audio:
-			// fmt.Println("recived audio from", msg.ClientName, c.conn.RemoteAddr())
 			c.handleRecivedAudio(msg.Payload)
 		case p.Text:
 			c.handleRecivedText(msg.Payload)
+		case p.Ping:
+			c.handlePing(msg.Payload)
+		case p.Pong:
+			c.handlePong(msg.Payload)
+		case p.Command:
+			c.handleCommand(string(msg.Payload))
+		case p.DirectText:
+			c.handleDirectText(msg)
+		case p.Whisper:
+			c.handleWhisper(msg)
+		case p.ClientLeave:
+			left = true
 
 			// case p.InitClient:
 			// case p.ClientJoin:
-			// case p.ClientLeave:
 		}
 	}
+
+	if c.replaced.Load() {
+		return
+	}
+	if left || c.kicked.Load() || resumeGrace == 0 {
+		c.notifyClientLeave()
+	} else {
+		c.suspend()
+	}
 }
 
 func (c *Client) writeLoop() {
-	for msg := range c.ch {
+	for {
+		msg, ok := c.next()
+		if !ok {
+			return
+		}
+
 		data, _ := p.EncodeMsg(msg)
-		c.conn.Write(data)
+
+		// a client that stopped reading altogether is gone
+		c.conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+		if _, err := c.conn.Write(data); err != nil {
+			c.conn.Close()
+			return
+		}
+		countSent(msg, len(data))
+
+		if msg.Type == p.Kick || (c.closing.Load() && len(c.ch) == 0) {
+			c.conn.Close()
+		}
 	}
 }
 
 func (c *Client) notifyClientJoin() {
 	joinMsg := fmt.Sprintf("CLIENT %s(%s) CONNECTED", c.name, c.conn.RemoteAddr().String())
 
-	fmt.Printf("\x1b[34m%s\x1b[m\n", joinMsg)
+	c.log.Info("client connected", "role", c.role, logging.EventKey, "join")
+
+	if r := recording.Load(); r != nil {
+		r.Text("SERVER", joinMsg)
+		c.sendServerText(recordingNotice)
+	}
 
 	c.sendToOthers(p.NewMsgP(
 		p.ClientJoin,
@@ -121,7 +253,12 @@ func (c *Client) notifyClientJoin() {
 func (c *Client) notifyClientLeave() {
 	discMsg := fmt.Sprintf("CLIENT %s(%s) DISCONNECTED", c.name, c.conn.RemoteAddr().String())
 
-	fmt.Printf("\x1b[31m%s\x1b[m\n", discMsg)
+	c.log.Info("client disconnected", logging.EventKey, "leave")
+
+	if r := recording.Load(); r != nil {
+		r.Text("SERVER", discMsg)
+		r.Leave(c.id)
+	}
 
 	c.sendToOthers(p.NewMsgP(
 		p.ClientLeave,
@@ -137,76 +274,275 @@ func handleInitClient(conn net.Conn) {
 	msg, err := p.ReadMsg(conn)
 	if err != nil {
 		conn.Close()
-		fmt.Println("init client read err: ", err)
+		slog.Warn("handshake read failed", "remote", conn.RemoteAddr().String(), "err", err)
+		if errors.Is(err, p.ErrMalformed) {
+			metrics.decodeErrors.Add(1)
+		}
+		countHandshakeFailure("read")
 		return
 	}
+	countReceived(msg)
 
 	conn.SetReadDeadline(time.Time{})
 
 	// first msg should always be init client
 	if msg.Type != p.InitClient {
 		conn.Close()
+		countHandshakeFailure("protocol")
 		return
 	}
 	// magic value for id in initClient is 0
 	if msg.ID != 0 {
 		conn.Close()
+		countHandshakeFailure("protocol")
+		return
+	}
+
+	requested, token, key := p.DecodeInitClient(msg.Payload)
+
+	name := msg.ClientName
+	if ban := findBan(name, remoteIP(conn), tokenID(token)); ban != nil {
+		reject(conn, "banned "+ban.describe())
+		countHandshakeFailure("banned")
 		return
 	}
 
-	var name string
+	role, err := authenticate(name, key)
+	if err != nil {
+		reject(conn, err.Error())
+		countHandshakeFailure("auth")
+		return
+	}
+
+	c := &Client{
+		conn:   conn,
+		ch:     make(chan p.Msg, controlQueueSize),
+		audio:  make(chan p.Msg, audioQueueSize),
+		limits: newLimits(),
+		role:   role,
+		joined: time.Now(),
+	}
+
 	mu.Lock()
-	if msg.ClientNameSize > 0 {
-		name = msg.ClientName
-	} else {
-		name = fmt.Sprintf("Client%d", nextClientID)
+	// checked under mu so drain never misses a client
+	if shuttingDown.Load() {
+		mu.Unlock()
+		reject(conn, "the server is shutting down")
+		countHandshakeFailure("shutdown")
+		return
+	}
+
+	// the client came back before its old connection timed out
+	ghost := liveClient(token)
+
+	if tooManyFrom(remoteIP(conn), ghost) {
+		mu.Unlock()
+		reject(conn, "too many connections from your address")
+		countHandshakeFailure("per_ip")
+		return
 	}
 
-	c := Client{
-		id:   nextClientID,
-		name: name,
-		conn: conn,
-		ch:   make(chan p.Msg, 50),
+	prev, resumed := takeSuspended(token)
+	if !resumed && ghost != nil {
+		ghost.replace()
+		prev, resumed = ghost, true
 	}
-	clients[nextClientID] = &c
-	nextClientID += 1 // can get to 0
+	if resumed {
+		c.id, c.name, c.token, c.role = prev.id, prev.name, prev.token, prev.role
+		c.muted.Store(prev.muted.Load())
+		// /history keeps paging from where the old connection was
+		c.historyCursor.Store(prev.historyCursor.Load())
+	} else {
+		id, ok := allocateID()
+		if !ok {
+			mu.Unlock()
+			conn.Close()
+			slog.Warn("server full, rejecting client", "remote", conn.RemoteAddr().String())
+			countHandshakeFailure("full")
+			return
+		}
+
+		c.id = id
+		c.token = newResumeToken()
+		if msg.ClientNameSize > 0 {
+			c.name = msg.ClientName
+		} else {
+			c.name = fmt.Sprintf("Client%d", id)
+		}
+		c.muted.Store(mutedNames[c.name])
+	}
+	c.log = clientLogger(c)
+	clients[c.id] = c
+	connections.Add(1)
 	mu.Unlock()
 
-	// send back id and name to the client
+	if requested != sampleRate {
+		c.log.Warn("client asked for another rate", "requested", requested, "rate", sampleRate)
+	}
+
+	// send back id, name, the wire rate and the resume token to the client
 	{
-		data, err := p.EncodeMsg(
-			p.NewMsgNP(
-				p.InitClient,
-				c.id,
-				c.name,
-			),
+		reply := p.NewMsg(
+			p.InitClient,
+			c.id,
+			p.EncodeInitClient(sampleRate, c.token, ""),
+			c.name,
 		)
+		data, err := p.EncodeMsg(reply)
 		if err != nil {
 			panic(err)
 		}
 
-		conn.Write(data)
+		if _, err := conn.Write(data); err == nil {
+			countSent(reply, len(data))
+		}
+	}
+
+	if c.role > Guest && !resumed {
+		c.sendServerText("signed in as " + c.role.String())
 	}
 
-	c.notifyClientJoin()
+	if resumed {
+		c.notifyClientReconnect()
+	} else {
+		c.replayHistory()
+		c.notifyClientJoin()
+	}
 	go c.writeLoop()
 	go c.readLoop()
 }
 
 func main() {
-	ln, err := net.Listen("tcp", Address)
+	flag.StringVar(&recordDir, "record", "", "directory moderators can record the room into with /recording, empty disables it")
+	recordStart := flag.Bool("record-start", false, "record the room from startup, needs -record")
+	rate := flag.Uint("rate", p.DefaultSampleRate, "audio sample rate on the wire")
+	flag.DurationVar(&idleTimeout, "idle-timeout", idleTimeout, "drop clients silent for this long")
+	flag.DurationVar(&resumeGrace, "resume-grace", resumeGrace, "how long a dropped client can resume its session, 0 disables")
+	usersPath := flag.String("users", "", "json file of registered names with their key hash and role")
+	bansPath := flag.String("bans", "bans.json", "where bans are kept across restarts")
+	metricsAddr := flag.String("metrics", "", "serve Prometheus metrics over http on this address, like :9100")
+	flag.DurationVar(&shutdownDelay, "shutdown-delay", shutdownDelay, "countdown announced to the room before shutting down")
+	flag.DurationVar(&drainTimeout, "drain-timeout", drainTimeout, "how long clients get to receive what is queued for them on shutdown")
+	flag.DurationVar(&slowClientAfter, "slow-client-after", slowClientAfter, "act on clients that keep dropping audio for this long")
+	flag.StringVar(&slowClientAction, "slow-client", slowClientAction, "what to do with slow clients: downgrade pauses their audio, disconnect drops them")
+	flag.Float64Var(&textPerSecond, "limit-text", textPerSecond, "chat lines and commands a client may send per second, 0 disables")
+	flag.Float64Var(&audioPerSecond, "limit-audio", audioPerSecond, "audio frames a client may send per second, 0 disables")
+	flag.Float64Var(&bytesPerSecond, "limit-bytes", bytesPerSecond, "bytes of audio and chat a client may send per second, 0 disables, -1 fits the audio rate")
+	flag.StringVar(&limitAction, "limit-action", limitAction, "past a limit: drop, warn, mute or disconnect")
+	flag.DurationVar(&limitMuteFor, "limit-mute", limitMuteFor, "how long -limit-action mute keeps a client quiet")
+	flag.IntVar(&maxPerIP, "max-per-ip", maxPerIP, "connected clients from one address, 0 disables")
+	flag.Float64Var(&handshakesPerMinute, "limit-handshakes", handshakesPerMinute, "connections an address may open per minute, 0 disables")
+	flag.IntVar(&historySize, "history", historySize, "chat lines kept for /history, 0 disables")
+	flag.IntVar(&historyReplay, "history-replay", historyReplay, "chat lines replayed to someone joining")
+	historyPath := flag.String("history-file", "", "keep the chat in this append-only log across restarts")
+	consolePath := flag.String("console", "", "also serve the admin console on a unix socket at this path")
+	keyToHash := flag.String("hash-key", "", "print the hash of a key for the users file and exit")
+	logFormat := flag.String("log-format", logging.Auto, "log as auto, text, json or color, auto colors terminals only")
+	logLevel := flag.String("log-level", "info", "least level logged: debug, info, warn or error")
+	flag.Parse()
+
+	if slowClientAction != slowClientDowngrade && slowClientAction != slowClientDisconnect {
+		fmt.Fprintln(os.Stderr, "-slow-client must be downgrade or disconnect")
+		os.Exit(2)
+	}
+	switch limitAction {
+	case limitDrop, limitWarn, limitMute, limitDisconnect:
+	default:
+		fmt.Fprintln(os.Stderr, "-limit-action must be drop, warn, mute or disconnect")
+		os.Exit(2)
+	}
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger, err := logging.New(os.Stderr, *logFormat, level)
 	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	if *keyToHash != "" {
+		fmt.Println(hashKey(*keyToHash))
+		return
+	}
+
+	if *usersPath != "" {
+		if err := loadUsers(*usersPath); err != nil {
+			panic(err)
+		}
+	}
+	if err := loadBans(*bansPath); err != nil {
 		panic(err)
 	}
-	fmt.Println("Server listening on " + Address)
+
+	if *historyPath != "" {
+		if err := openHistory(*historyPath); err != nil {
+			panic(err)
+		}
+	}
+
+	InitCommands()
+
+	sampleRate = uint32(*rate)
+	if bytesPerSecond < 0 {
+		// float32 mono with half again for headers and chat
+		bytesPerSecond = float64(sampleRate) * 4 * 1.5
+	}
+	recordFormat.SampleRate = int(sampleRate)
+
+	if *recordStart {
+		if recordDir == "" {
+			fmt.Fprintln(os.Stderr, "-record-start needs -record")
+			os.Exit(2)
+		}
+		if _, err = startRecording(); err != nil {
+			panic(err)
+		}
+	}
+
+	listener, err = net.Listen("tcp", Address)
+	if err != nil {
+		panic(err)
+	}
+	slog.Info("server listening", "addr", Address)
+
+	go heartbeatLoop()
+	go handleSignals()
+
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+		slog.Info("serving metrics", "url", "http://"+*metricsAddr+"/metrics")
+	}
+
+	go runConsole(os.Stdin, os.Stdout)
+	if *consolePath != "" {
+		if err := listenConsole(*consolePath); err != nil {
+			panic(err)
+		}
+		slog.Info("admin console listening", "socket", *consolePath)
+	}
 
 	for {
-		conn, err := ln.Accept()
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
 		if err != nil {
-			fmt.Println("\x1b[31m" + "err: " + err.Error() + "\x1b[m")
+			slog.Error("accept failed", "err", err)
+			continue
+		}
+
+		if !allowHandshake(conn) {
+			conn.Close()
+			countHandshakeFailure("rate")
 			continue
 		}
 
 		go handleInitClient(conn)
 	}
+
+	<-drained
 }
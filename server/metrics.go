@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	p "github.com/crolbar/lekvc/lekvcs/protocol"
+)
+
+// counts by message type, the last slot takes the types we don't know
+type typeCounters [p.MsgTypeCount + 1]atomic.Uint64
+
+func (t *typeCounters) add(msgType p.MsgType, n uint64) {
+	t[min(int(msgType), p.MsgTypeCount)].Add(n)
+}
+
+// counts by a label value only known at run time
+type labeledCounters struct {
+	mu sync.Mutex
+	m  map[string]*atomic.Uint64
+}
+
+func (l *labeledCounters) add(label string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.m == nil {
+		l.m = make(map[string]*atomic.Uint64)
+	}
+	if l.m[label] == nil {
+		l.m[label] = new(atomic.Uint64)
+	}
+	l.m[label].Add(1)
+}
+
+func (l *labeledCounters) write(w io.Writer, name, label string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	values := make([]string, 0, len(l.m))
+	for v := range l.m {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, labelValue(v), l.m[v].Load())
+	}
+}
+
+var metrics struct {
+	messagesIn, bytesIn   typeCounters
+	messagesOut, bytesOut typeCounters
+
+	// audio frames that didn't fit a client's queue
+	queueDrops   atomic.Uint64
+	decodeErrors atomic.Uint64
+
+	handshakeFailures labeledCounters
+	// clients downgraded or disconnected for not keeping up, by action
+	slowClients labeledCounters
+	// messages over a client's rate limits, by type
+	rateLimited labeledCounters
+}
+
+var startTime = time.Now()
+
+func countReceived(msg *p.Msg) {
+	metrics.messagesIn.add(msg.Type, 1)
+	metrics.bytesIn.add(msg.Type, uint64(p.MsgHeaderSize+int(msg.Size)))
+}
+
+func countSent(msg p.Msg, n int) {
+	metrics.messagesOut.add(msg.Type, 1)
+	metrics.bytesOut.add(msg.Type, uint64(n))
+}
+
+// countDrop records a message c had no room for
+func (c *Client) countDrop() {
+	c.drops.Add(1)
+	metrics.queueDrops.Add(1)
+}
+
+func countHandshakeFailure(reason string) {
+	metrics.handshakeFailures.add(reason)
+}
+
+// serveMetrics exposes the metrics in the Prometheus text format on addr
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("metrics listener failed", "err", err)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue escapes a client supplied label value
+func labelValue(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeByType(w io.Writer, name, help string, counters *typeCounters) {
+	writeHeader(w, name, "counter", help)
+	for t := range counters {
+		fmt.Fprintf(w, "%s{type=\"%s\"} %d\n", name, p.MsgType(t), counters[t].Load())
+	}
+}
+
+func writeMetrics(w io.Writer) {
+	type clientDrops struct {
+		id      ClientID
+		name    string
+		drops   uint64
+		control int
+		audio   int
+	}
+
+	mu.Lock()
+	connected := len(clients)
+	waiting := len(suspendedClients)
+	perClient := make([]clientDrops, 0, len(clients))
+	for _, c := range clients {
+		perClient = append(perClient, clientDrops{c.id, c.name, c.drops.Load(), len(c.ch), len(c.audio)})
+	}
+	mu.Unlock()
+	sort.Slice(perClient, func(i, j int) bool { return perClient[i].id < perClient[j].id })
+
+	// labeled by room already so dashboards keep working once there are more
+	writeHeader(w, "lekvcs_clients", "gauge", "Connected clients per room.")
+	fmt.Fprintf(w, "lekvcs_clients{room=\"default\"} %d\n", connected)
+	writeHeader(w, "lekvcs_suspended_clients", "gauge", "Dropped clients that can still resume.")
+	fmt.Fprintf(w, "lekvcs_suspended_clients %d\n", waiting)
+
+	writeByType(w, "lekvcs_messages_received_total", "Messages read from clients.", &metrics.messagesIn)
+	writeByType(w, "lekvcs_bytes_received_total", "Bytes read from clients.", &metrics.bytesIn)
+	writeByType(w, "lekvcs_messages_sent_total", "Messages written to clients.", &metrics.messagesOut)
+	writeByType(w, "lekvcs_bytes_sent_total", "Bytes written to clients.", &metrics.bytesOut)
+
+	writeHeader(w, "lekvcs_queue_drops_total", "counter", "Audio frames dropped because a client's audio queue was full.")
+	fmt.Fprintf(w, "lekvcs_queue_drops_total %d\n", metrics.queueDrops.Load())
+
+	writeHeader(w, "lekvcs_client_queue_drops_total", "counter", "Audio frames dropped per connected client.")
+	for _, c := range perClient {
+		fmt.Fprintf(w, "lekvcs_client_queue_drops_total{id=\"%d\",name=\"%s\"} %d\n", c.id, labelValue(c.name), c.drops)
+	}
+	writeHeader(w, "lekvcs_client_queue_length", "gauge", "Messages waiting in a connected client's send queue.")
+	for _, c := range perClient {
+		fmt.Fprintf(w, "lekvcs_client_queue_length{id=\"%d\",name=\"%s\",queue=\"control\"} %d\n", c.id, labelValue(c.name), c.control)
+		fmt.Fprintf(w, "lekvcs_client_queue_length{id=\"%d\",name=\"%s\",queue=\"audio\"} %d\n", c.id, labelValue(c.name), c.audio)
+	}
+
+	writeHeader(w, "lekvcs_slow_clients_total", "counter", "Clients that couldn't keep up, by what was done about it.")
+	metrics.slowClients.write(w, "lekvcs_slow_clients_total", "action")
+
+	writeHeader(w, "lekvcs_rate_limited_total", "counter", "Messages dropped for going over a client's rate limits, by type.")
+	metrics.rateLimited.write(w, "lekvcs_rate_limited_total", "type")
+
+	writeHeader(w, "lekvcs_handshake_failures_total", "counter", "Connections that never became clients, by reason.")
+	metrics.handshakeFailures.write(w, "lekvcs_handshake_failures_total", "reason")
+
+	writeHeader(w, "lekvcs_decode_errors_total", "counter", "Malformed messages read from clients.")
+	fmt.Fprintf(w, "lekvcs_decode_errors_total %d\n", metrics.decodeErrors.Load())
+
+	writeRuntimeMetrics(w)
+}
+
+func writeRuntimeMetrics(w io.Writer) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	writeHeader(w, "go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+	writeHeader(w, "go_threads", "gauge", "Number of OS threads created.")
+	threads, _ := runtime.ThreadCreateProfile(nil)
+	fmt.Fprintf(w, "go_threads %d\n", threads)
+
+	writeHeader(w, "go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.")
+	fmt.Fprintf(w, "go_memstats_alloc_bytes %d\n", m.Alloc)
+	writeHeader(w, "go_memstats_alloc_bytes_total", "counter", "Total number of bytes allocated, even if freed.")
+	fmt.Fprintf(w, "go_memstats_alloc_bytes_total %d\n", m.TotalAlloc)
+	writeHeader(w, "go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.")
+	fmt.Fprintf(w, "go_memstats_sys_bytes %d\n", m.Sys)
+	writeHeader(w, "go_memstats_heap_objects", "gauge", "Number of allocated objects.")
+	fmt.Fprintf(w, "go_memstats_heap_objects %d\n", m.HeapObjects)
+	writeHeader(w, "go_gc_cycles_total", "counter", "Number of completed GC cycles.")
+	fmt.Fprintf(w, "go_gc_cycles_total %d\n", m.NumGC)
+	writeHeader(w, "go_gc_pause_seconds_total", "counter", "Total time spent in GC stop-the-world pauses.")
+	fmt.Fprintf(w, "go_gc_pause_seconds_total %g\n", time.Duration(m.PauseTotalNs).Seconds())
+
+	writeHeader(w, "process_start_time_seconds", "gauge", "Start time of the process since unix epoch in seconds.")
+	fmt.Fprintf(w, "process_start_time_seconds %d\n", startTime.Unix())
+}
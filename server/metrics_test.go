@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	p "github.com/crolbar/lekvc/lekvcs/protocol"
+)
+
+// scrape parses the text format into samples by series,
+// checking every family is declared with HELP and TYPE before its samples
+func scrape(t *testing.T) map[string]float64 {
+	t.Helper()
+
+	var b bytes.Buffer
+	writeMetrics(&b)
+
+	samples := make(map[string]float64)
+	help := make(map[string]bool)
+	types := make(map[string]string)
+
+	scanner := bufio.NewScanner(&b)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if rest, ok := strings.CutPrefix(line, "# HELP "); ok {
+			name, text, _ := strings.Cut(rest, " ")
+			if text == "" || help[name] {
+				t.Errorf("bad or repeated HELP: %q", line)
+			}
+			help[name] = true
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			name, kind, _ := strings.Cut(rest, " ")
+			if !help[name] || types[name] != "" {
+				t.Errorf("TYPE without HELP or repeated: %q", line)
+			}
+			if kind != "counter" && kind != "gauge" {
+				t.Errorf("unknown type: %q", line)
+			}
+			if kind == "counter" && !strings.HasSuffix(name, "_total") {
+				t.Errorf("counter %s doesn't end in _total", name)
+			}
+			types[name] = kind
+			continue
+		}
+
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			t.Fatalf("malformed line %q", line)
+		}
+		series, value := line[:i], line[i+1:]
+		name, _, _ := strings.Cut(series, "{")
+		if types[name] == "" {
+			t.Errorf("%s has no TYPE before its samples", name)
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Errorf("bad value in %q", line)
+		}
+		samples[series] = v
+	}
+	return samples
+}
+
+func TestMetricsOutput(t *testing.T) {
+	c, _ := newTestClient(7)
+	c.name = "eve \"the\" \\ bad\nname"
+	mu.Lock()
+	clients[c.id] = c
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		delete(clients, c.id)
+		mu.Unlock()
+	}()
+
+	before := scrape(t)
+
+	// three chat lines in, one out to each of two others, two dropped frames
+	for range 3 {
+		countReceived(&p.Msg{Type: p.Text, Size: 10})
+	}
+	countSent(p.Msg{Type: p.Text}, 20)
+	countSent(p.Msg{Type: p.Text}, 20)
+	c.countDrop()
+	c.countDrop()
+	metrics.rateLimited.add("text")
+	countHandshakeFailure("bad name")
+
+	after := scrape(t)
+
+	tests := []struct {
+		series string
+		delta  float64
+	}{
+		{`lekvcs_messages_received_total{type="text"}`, 3},
+		{`lekvcs_bytes_received_total{type="text"}`, 3 * (p.MsgHeaderSize + 10)},
+		{`lekvcs_messages_sent_total{type="text"}`, 2},
+		{`lekvcs_bytes_sent_total{type="text"}`, 40},
+		{`lekvcs_messages_received_total{type="audio"}`, 0},
+		{`lekvcs_queue_drops_total`, 2},
+		{`lekvcs_rate_limited_total{type="text"}`, 1},
+		{`lekvcs_handshake_failures_total{reason="bad name"}`, 1},
+	}
+	for _, tt := range tests {
+		got, ok := after[tt.series]
+		if !ok {
+			t.Errorf("%s is missing", tt.series)
+			continue
+		}
+		if got-before[tt.series] != tt.delta {
+			t.Errorf("%s went from %v to %v, want +%v", tt.series, before[tt.series], got, tt.delta)
+		}
+	}
+
+	// the name is escaped so the line stays one valid sample
+	name := `eve \"the\" \\ bad\nname`
+	if got := after[`lekvcs_client_queue_drops_total{id="7",name="`+name+`"}`]; got != 2 {
+		t.Errorf("drops of the client are %v, want 2", got)
+	}
+	if _, ok := after[`lekvcs_client_queue_length{id="7",name="`+name+`",queue="audio"}`]; !ok {
+		t.Error("the client's audio queue length is missing")
+	}
+	if after[`lekvcs_clients{room="default"}`] < 1 {
+		t.Error("the client isn't counted as connected")
+	}
+	for _, name := range []string{"go_goroutines", "process_start_time_seconds"} {
+		if after[name] <= 0 {
+			t.Errorf("%s is %v", name, after[name])
+		}
+	}
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crolbar/lekvc/lekvcs/cmdline"
+	"github.com/crolbar/lekvc/lekvcs/logging"
+	p "github.com/crolbar/lekvc/lekvcs/protocol"
+)
+
+type Role int
+
+const (
+	// connected without a key
+	Guest Role = iota
+	Member
+	Moderator
+	Admin
+)
+
+func (r Role) String() string {
+	switch r {
+	case Guest:
+		return "guest"
+	case Member:
+		return "member"
+	case Moderator:
+		return "moderator"
+	case Admin:
+		return "admin"
+	}
+	return "unknown"
+}
+
+func (r *Role) UnmarshalText(text []byte) error {
+	for role := Guest; role <= Admin; role++ {
+		if string(text) == role.String() {
+			*r = role
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown role %q", text)
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// user is a registered identity, anyone connecting under its name has to know the key
+type user struct {
+	// sha256 of the key in hex, see -hash-key
+	Key  string `json:"key"`
+	Role Role   `json:"role"`
+}
+
+// registered users by name, nil lets everyone in as a guest
+var users map[string]user
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func loadUsers(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// members unless the file says otherwise
+	var loaded map[string]struct {
+		Key  string `json:"key"`
+		Role *Role  `json:"role"`
+	}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return err
+	}
+
+	users = make(map[string]user, len(loaded))
+	for name, u := range loaded {
+		role := Member
+		if u.Role != nil {
+			role = *u.Role
+		}
+		users[name] = user{Key: strings.ToLower(u.Key), Role: role}
+	}
+	return nil
+}
+
+// authenticate returns the role of name, registered names need their key
+func authenticate(name, key string) (Role, error) {
+	u, ok := users[name]
+	if !ok {
+		return Guest, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashKey(key)), []byte(u.Key)) != 1 {
+		return Guest, fmt.Errorf("wrong key for %s", name)
+	}
+	return u.Role, nil
+}
+
+// Ban keeps out anyone matching one of its non empty fields
+type Ban struct {
+	Name  string `json:"name,omitempty"`
+	IP    string `json:"ip,omitempty"`
+	Token string `json:"token,omitempty"`
+
+	// zero for a permanent ban
+	Until  time.Time `json:"until,omitzero"`
+	By     string    `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+	// role of who banned, only a higher one can lift the ban
+	Role Role `json:"role"`
+}
+
+func (b *Ban) expired(now time.Time) bool {
+	return !b.Until.IsZero() && now.After(b.Until)
+}
+
+// liftableBy reports whether from may lift the ban, the console can lift any
+func (b *Ban) liftableBy(from *Client) bool {
+	return from.console != nil || from.role > b.Role
+}
+
+func (b *Ban) matches(name, ip, token string) bool {
+	return (b.Name != "" && b.Name == name) ||
+		(b.IP != "" && b.IP == ip) ||
+		(b.Token != "" && b.Token == token)
+}
+
+func (b *Ban) target() string {
+	var parts []string
+	if b.Name != "" {
+		parts = append(parts, "name:"+b.Name)
+	}
+	if b.IP != "" {
+		parts = append(parts, "ip:"+b.IP)
+	}
+	if b.Token != "" {
+		parts = append(parts, "token:"+b.Token)
+	}
+	return strings.Join(parts, " ")
+}
+
+// describe says how long the ban lasts and why
+func (b *Ban) describe() string {
+	msg := "permanently"
+	if !b.Until.IsZero() {
+		msg = "until " + b.Until.Format(time.DateTime)
+	}
+	if b.Reason != "" {
+		msg += ": " + b.Reason
+	}
+	return msg
+}
+
+var (
+	bans    []*Ban
+	banMu   sync.Mutex
+	banPath string
+)
+
+func loadBans(path string) error {
+	banPath = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return err
+	}
+
+	// guests can't ban, bans saved before the role was kept count as an admin's
+	for _, b := range bans {
+		if b.Role == Guest {
+			b.Role = Admin
+		}
+	}
+	return nil
+}
+
+// saveBans writes the bans that haven't expired, banMu must be held
+func saveBans() error {
+	now := time.Now()
+	bans = slices.DeleteFunc(bans, func(b *Ban) bool { return b.expired(now) })
+
+	if banPath == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// replace the file in one go so a crash never leaves it half written
+	tmp := banPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, banPath)
+}
+
+func addBan(b *Ban) {
+	banMu.Lock()
+	defer banMu.Unlock()
+
+	bans = append(bans, b)
+	if err := saveBans(); err != nil {
+		slog.Error("saving bans failed", "err", err)
+	}
+}
+
+// removeBans lifts every ban with a field equal to target that from outranks,
+// returning how many it lifted and how many it had to keep
+func removeBans(from *Client, target string) (removed, kept int) {
+	banMu.Lock()
+	defer banMu.Unlock()
+
+	name, ip, token := parseBanTarget(target)
+	n := len(bans)
+	bans = slices.DeleteFunc(bans, func(b *Ban) bool {
+		if !b.matches(name, ip, token) {
+			return false
+		}
+		if !b.liftableBy(from) {
+			kept++
+			return false
+		}
+		return true
+	})
+	removed = n - len(bans)
+
+	if removed > 0 {
+		if err := saveBans(); err != nil {
+			slog.Error("saving bans failed", "err", err)
+		}
+	}
+	return removed, kept
+}
+
+// findBan returns the ban keeping out the given client, nil if there is none
+func findBan(name, ip, token string) *Ban {
+	banMu.Lock()
+	defer banMu.Unlock()
+
+	now := time.Now()
+	for _, b := range bans {
+		if !b.expired(now) && b.matches(name, ip, token) {
+			return b
+		}
+	}
+	return nil
+}
+
+// parseBanTarget splits name:x, ip:x and token:x, anything else is a name
+func parseBanTarget(target string) (name, ip, token string) {
+	if v, ok := strings.CutPrefix(target, "ip:"); ok {
+		return "", v, ""
+	}
+	if v, ok := strings.CutPrefix(target, "token:"); ok {
+		return "", "", v
+	}
+	return strings.TrimPrefix(target, "name:"), "", ""
+}
+
+// tokenID identifies a resume token in bans and /who without giving it away
+func tokenID(token []byte) string {
+	if len(token) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(token)
+	return hex.EncodeToString(sum[:8])
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// names muted by a moderator, kept when they reconnect, guarded by mu
+var mutedNames = make(map[string]bool)
+
+// reject tells a client why it can't join and closes the connection
+func reject(conn net.Conn, reason string) {
+	slog.Warn("rejecting client", "remote", conn.RemoteAddr().String(), "reason", reason)
+
+	msg := p.NewMsgP(p.Kick, 0, []byte(reason))
+	if data, err := p.EncodeMsg(msg); err == nil {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write(data); err == nil {
+			countSent(msg, len(data))
+		}
+	}
+	conn.Close()
+}
+
+// kick closes the connection of c after telling it why, mu must be held
+func (c *Client) kick(reason string) {
+	c.kicked.Store(true)
+
+	select {
+	case c.ch <- p.NewMsg(p.Kick, c.id, []byte(reason), ""):
+		// the writer closes the connection once it is sent
+	default:
+		c.conn.Close()
+	}
+}
+
+// announce tells everyone in the room about a moderation action, mu must be held
+func announce(text string) {
+	slog.Info("announcement", "text", text, logging.EventKey, "moderation")
+
+	if r := recording.Load(); r != nil {
+		r.Text("SERVER", text)
+	}
+
+	for _, c := range clients {
+		c.sendServerText(text)
+	}
+}
+
+// findClient looks a connected client up by name or id, mu must be held
+func findClient(target string) *Client {
+	for _, c := range clients {
+		if c.name == target {
+			return c
+		}
+	}
+	if id, err := strconv.ParseUint(target, 10, 8); err == nil {
+		return clients[ClientID(id)]
+	}
+	return nil
+}
+
+func nameOf(from *Client) string {
+	if from.console != nil {
+		return "the server"
+	}
+	return from.name
+}
+
+// reply answers whoever ran a command
+func reply(from *Client, text string) {
+	if from.console != nil {
+		from.consoleReplies = append(from.consoleReplies, text)
+		return
+	}
+	from.sendServerText(text)
+}
+
+// outranks reports whether from may act on c, the console can do anything
+func outranks(from *Client, c *Client) bool {
+	return from.console != nil || (from != c && from.role > c.role)
+}
+
+// targetClient finds the client a command is aimed at, replying if it can't, mu must be held
+func targetClient(from *Client, args []string, usage string) *Client {
+	if len(args) < 1 {
+		reply(from, "usage: "+usage)
+		return nil
+	}
+
+	c := findClient(args[0])
+	if c == nil {
+		reply(from, "no client "+args[0])
+		return nil
+	}
+	if !outranks(from, c) {
+		reply(from, "you can't do that to "+c.name)
+		return nil
+	}
+	return c
+}
+
+func handleWho(from *Client, args []string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("[id]  [name]  [role]  [ip]  [token]")
+	for _, c := range clients {
+		fmt.Fprintf(&b, "\n%d  %s  %s  %s  %s", c.id, c.name, c.role, remoteIP(c.conn), tokenID(c.token))
+		if c.muted.Load() {
+			b.WriteString("  (muted)")
+		}
+	}
+	reply(from, b.String())
+}
+
+func handleKick(from *Client, args []string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	c := targetClient(from, args, "/kick <name|id> [reason]")
+	if c == nil {
+		return
+	}
+
+	reason := strings.Join(args[1:], " ")
+	msg := fmt.Sprintf("%s was kicked by %s", c.name, nameOf(from))
+	if reason != "" {
+		msg += ": " + reason
+	}
+
+	announce(msg)
+	c.kick(msg)
+}
+
+func handleBan(from *Client, args []string) {
+	const usage = "/ban <name|id|name:x|ip:x|token:x> [duration|perm] [reason]"
+	if len(args) < 1 {
+		reply(from, "usage: "+usage)
+		return
+	}
+
+	ban := &Ban{By: nameOf(from), Role: from.role}
+
+	// the reason is the rest of the line as typed, after the duration if there is one
+	var reason string
+	if len(args) > 1 {
+		reason = args[1]
+	}
+	first, after, _ := strings.Cut(reason, " ")
+	if d, err := time.ParseDuration(first); err == nil && d > 0 {
+		ban.Until = time.Now().Add(d)
+		reason = after
+	} else if first == "perm" {
+		reason = after
+	}
+	ban.Reason = strings.TrimSpace(reason)
+
+	if ban.Until.IsZero() && from.role < Admin {
+		reply(from, "only admins can ban permanently, give a duration like 30m")
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// a connected client is banned by everything that identifies it
+	var c *Client
+	if !strings.Contains(args[0], ":") {
+		c = findClient(args[0])
+	}
+	if c != nil {
+		if !outranks(from, c) {
+			reply(from, "you can't do that to "+c.name)
+			return
+		}
+		ban.Name, ban.IP, ban.Token = c.name, remoteIP(c.conn), tokenID(c.token)
+	} else {
+		ban.Name, ban.IP, ban.Token = parseBanTarget(args[0])
+		if u, ok := users[ban.Name]; ok && from.console == nil && u.Role >= from.role {
+			reply(from, "you can't do that to "+ban.Name)
+			return
+		}
+	}
+
+	if ban.Name == "" && ban.IP == "" && ban.Token == "" {
+		reply(from, "usage: "+usage)
+		return
+	}
+
+	addBan(ban)
+
+	who := ban.target()
+	if c != nil {
+		who = c.name
+	}
+	msg := fmt.Sprintf("%s was banned by %s %s", who, nameOf(from), ban.describe())
+	announce(msg)
+
+	// everyone connected under a banned name or address goes
+	for _, other := range clients {
+		if ban.matches(other.name, remoteIP(other.conn), tokenID(other.token)) && outranks(from, other) {
+			other.kick(msg)
+		}
+	}
+}
+
+func handleUnban(from *Client, args []string) {
+	if len(args) < 1 {
+		reply(from, "usage: /unban <name|ip:x|token:x>")
+		return
+	}
+
+	n, kept := removeBans(from, args[0])
+	if kept > 0 {
+		reply(from, fmt.Sprintf("you can't lift %d ban(s) on %s, they were set by someone of your role or higher", kept, args[0]))
+	}
+	if n == 0 {
+		if kept == 0 {
+			reply(from, "no ban matches "+args[0])
+		}
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	announce(fmt.Sprintf("%s was unbanned by %s", args[0], nameOf(from)))
+}
+
+func handleBans(from *Client, args []string) {
+	banMu.Lock()
+	defer banMu.Unlock()
+
+	now := time.Now()
+	var b strings.Builder
+	b.WriteString("[target]  [ban]  [by]")
+	for _, ban := range bans {
+		if ban.expired(now) {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s  %s  %s", ban.target(), ban.describe(), ban.By)
+	}
+	reply(from, b.String())
+}
+
+func muteCommand(muted bool) func(from *Client, args []string) {
+	action, usage := "muted", "/mute <name|id>"
+	if !muted {
+		action, usage = "unmuted", "/unmute <name|id>"
+	}
+
+	return func(from *Client, args []string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		c := targetClient(from, args, usage)
+		if c == nil {
+			return
+		}
+
+		c.muted.Store(muted)
+		if muted {
+			mutedNames[c.name] = true
+		} else {
+			delete(mutedNames, c.name)
+		}
+
+		announce(fmt.Sprintf("%s was %s by %s", c.name, action, nameOf(from)))
+	}
+}
+
+// handleCommand runs a command line sent by c
+func (c *Client) handleCommand(line string) {
+	if c.console != nil {
+		// the handlers have let go of mu by then
+		defer c.flushReplies()
+	}
+
+	name, rest, err := cmdline.SplitN(line, 1)
+	if err != nil {
+		reply(c, err.Error())
+		return
+	}
+	if len(name) == 0 {
+		return
+	}
+
+	command, ok := commands[name[0]]
+	if !ok {
+		reply(c, "unknown command "+name[0])
+		return
+	}
+	if c.role < command.role {
+		reply(c, name[0]+" needs the "+command.role.String()+" role")
+		return
+	}
+
+	args, err := command.args(rest)
+	if err != nil {
+		reply(c, name[0]+": "+err.Error())
+		return
+	}
+
+	if c.console == nil {
+		c.log.Info("command", "line", line, "role", c.role, logging.EventKey, "moderation")
+	}
+	command.f(c, args)
+}
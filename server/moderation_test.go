@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestUnbanNeedsRank(t *testing.T) {
+	defer func() { bans = nil }()
+
+	tests := []struct {
+		by, lifter Role
+		console    bool
+		lifted     bool
+	}{
+		{Moderator, Moderator, false, false},
+		{Moderator, Admin, false, true},
+		{Admin, Moderator, false, false},
+		{Admin, Admin, false, false},
+		{Admin, Admin, true, true},
+		{Member, Moderator, false, true},
+	}
+
+	for _, tt := range tests {
+		bans = []*Ban{{Name: "eve", By: "someone", Role: tt.by}}
+		from := &Client{role: tt.lifter}
+		if tt.console {
+			from = newConsole(io.Discard)
+		}
+
+		removed, kept := removeBans(from, "eve")
+		if tt.lifted && (removed != 1 || kept != 0 || len(bans) != 0) {
+			t.Errorf("%s lifting a ban by a %s: removed %d, kept %d, want it lifted", tt.lifter, tt.by, removed, kept)
+		}
+		if !tt.lifted && (removed != 0 || kept != 1 || len(bans) != 1) {
+			t.Errorf("%s lifting a ban by a %s: removed %d, kept %d, want it kept", tt.lifter, tt.by, removed, kept)
+		}
+	}
+}
+
+func TestBanMatches(t *testing.T) {
+	tests := []struct {
+		ban             Ban
+		name, ip, token string
+		want            bool
+	}{
+		{Ban{Name: "eve"}, "eve", "10.0.0.1", "abc", true},
+		{Ban{Name: "eve"}, "Eve", "10.0.0.1", "abc", false},
+		{Ban{IP: "10.0.0.1"}, "bob", "10.0.0.1", "abc", true},
+		{Ban{IP: "10.0.0.1"}, "bob", "10.0.0.2", "abc", false},
+		{Ban{Token: "abc"}, "bob", "10.0.0.2", "abc", true},
+		{Ban{Name: "eve", IP: "10.0.0.1"}, "bob", "10.0.0.1", "", true},
+		{Ban{Name: "eve", IP: "10.0.0.1", Token: "abc"}, "bob", "10.0.0.2", "def", false},
+		// empty fields match nothing, not clients without a token
+		{Ban{Name: "eve"}, "bob", "", "", false},
+		{Ban{}, "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.ban.matches(tt.name, tt.ip, tt.token); got != tt.want {
+			t.Errorf("%+v matching %q %q %q: %v, want %v", tt.ban, tt.name, tt.ip, tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestBanExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		until time.Time
+		want  bool
+	}{
+		{time.Time{}, false},
+		{now.Add(time.Minute), false},
+		{now.Add(-time.Minute), true},
+	}
+
+	for _, tt := range tests {
+		b := Ban{Name: "eve", Until: tt.until}
+		if got := b.expired(now); got != tt.want {
+			t.Errorf("ban until %v expired: %v, want %v", tt.until, got, tt.want)
+		}
+	}
+}
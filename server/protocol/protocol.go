@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 )
@@ -18,9 +19,56 @@ const (
 
 	// server sender only
 	ClientJoin
+	// also sent by a client leaving for good, so the server doesn't wait for it to resume
 	ClientLeave
+	// a client resumed its session after a drop
+	ClientReconnect
+
+	// client + server, appended so older peers keep their numbering
+	Ping
+	Pong
+
+	// client sender only, a moderation command line for the server
+	Command
+	// server sender only, the payload says why the connection is closed
+	Kick
+
+	// client + server, a chat line or audio only for the clients in the
+	// payload, see EncodeTargeted, the server sends it with the sender's id
+	DirectText
+	Whisper
+
+	// server sender only, a chat line said earlier, see EncodeHistory,
+	// the id and name are of the sender back then
+	History
 )
 
+var msgTypeNames = [...]string{
+	Audio:           "audio",
+	Text:            "text",
+	InitClient:      "init_client",
+	ClientJoin:      "client_join",
+	ClientLeave:     "client_leave",
+	ClientReconnect: "client_reconnect",
+	Ping:            "ping",
+	Pong:            "pong",
+	Command:         "command",
+	Kick:            "kick",
+	DirectText:      "direct_text",
+	Whisper:         "whisper",
+	History:         "history",
+}
+
+// MsgTypeCount is one past the highest known type
+const MsgTypeCount = len(msgTypeNames)
+
+func (t MsgType) String() string {
+	if int(t) < len(msgTypeNames) {
+		return msgTypeNames[t]
+	}
+	return "unknown"
+}
+
 const MsgHeaderSize = 1 + 1 + 2
 
 type Msg struct {
@@ -83,6 +131,9 @@ func EncodeMsg(msg Msg) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// ErrMalformed is wrapped by the errors of ReadMsg for messages that don't decode
+var ErrMalformed = errors.New("malformed message")
+
 func ReadMsg(conn net.Conn) (*Msg, error) {
 	var (
 		msg = Msg{}
@@ -99,7 +150,7 @@ func ReadMsg(conn net.Conn) (*Msg, error) {
 			return nil, err
 		}
 		if n != MsgHeaderSize {
-			return nil, errors.New("Packet is not of HeaderSize lenght")
+			return nil, fmt.Errorf("%w: packet is not of HeaderSize lenght", ErrMalformed)
 		}
 	}
 
@@ -113,7 +164,7 @@ func ReadMsg(conn net.Conn) (*Msg, error) {
 	off += 2
 
 	if msg.Size == 0 {
-		return nil, errors.New("invalid msg.Size = 0")
+		return nil, fmt.Errorf("%w: invalid msg.Size = 0", ErrMalformed)
 	}
 
 	// Read the rest of the msg
@@ -124,20 +175,30 @@ func ReadMsg(conn net.Conn) (*Msg, error) {
 			return nil, err
 		}
 		if n != int(msg.Size) {
-			return nil, errors.New("Packet has wrong msg.Size field or has no payload + clientName.")
+			return nil, fmt.Errorf("%w: packet has wrong msg.Size field or has no payload + clientName", ErrMalformed)
 		}
 		off = 0
 	}
 
+	if len(msgBuf) < 2 {
+		return nil, fmt.Errorf("%w: no payload size", ErrMalformed)
+	}
 	msg.PayloadSize = binary.LittleEndian.Uint16(msgBuf[off:])
 	off += 2
 
+	if len(msgBuf) < off+int(msg.PayloadSize)+2 {
+		return nil, fmt.Errorf("%w: payload size %d past the end", ErrMalformed, msg.PayloadSize)
+	}
+
 	msg.Payload = msgBuf[off : off+int(msg.PayloadSize)]
 	off += int(msg.PayloadSize)
 
 	msg.ClientNameSize = binary.LittleEndian.Uint16(msgBuf[off:])
 	off += 2
 
+	if len(msgBuf) < off+int(msg.ClientNameSize) {
+		return nil, fmt.Errorf("%w: client name size %d past the end", ErrMalformed, msg.ClientNameSize)
+	}
 	msg.ClientName = string(msgBuf[off : off+int(msg.ClientNameSize)])
 
 	return &msg, nil
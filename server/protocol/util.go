@@ -1,5 +1,13 @@
 package protocol
 
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
 func NewMsg(t MsgType, id uint8, payload []byte, name string) Msg {
 	return Msg{
 		Type: t,
@@ -34,3 +42,102 @@ func NewMsgP(t MsgType, id uint8, payload []byte) Msg {
 		Payload:     payload,
 	}
 }
+
+// DefaultSampleRate is the wire rate of peers that don't negotiate one
+const DefaultSampleRate = 48000
+
+const ResumeTokenSize = 16
+
+// EncodeInitClient builds the InitClient payload, the client sends the
+// rate it would like, the token of the session it wants to resume if any and
+// the key proving who it is if it has one, the server replies with the rate
+// of the room and the token of this session
+func EncodeInitClient(rate uint32, token []byte, key string) []byte {
+	payload := binary.LittleEndian.AppendUint32(nil, rate)
+	if len(token) == 0 && len(key) == 0 {
+		return payload
+	}
+
+	// a zero token stands for none when only the key is sent
+	payload = append(payload, make([]byte, ResumeTokenSize)...)
+	copy(payload[4:], token)
+	return append(payload, key...)
+}
+
+func DecodeInitClient(payload []byte) (rate uint32, token []byte, key string) {
+	if len(payload) < 4 {
+		return DefaultSampleRate, nil, ""
+	}
+	if len(payload) >= 4+ResumeTokenSize {
+		token = payload[4 : 4+ResumeTokenSize]
+		if bytes.Count(token, []byte{0}) == ResumeTokenSize {
+			token = nil
+		}
+		key = string(payload[4+ResumeTokenSize:])
+	}
+	return binary.LittleEndian.Uint32(payload), token, key
+}
+
+// EncodeTargeted prefixes data with the ids of the clients it is meant for
+func EncodeTargeted(targets []uint8, data []byte) []byte {
+	payload := append([]byte{uint8(len(targets))}, targets...)
+	return append(payload, data...)
+}
+
+func DecodeTargeted(payload []byte) (targets []uint8, data []byte, err error) {
+	if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+		return nil, nil, errors.New("targeted payload too short")
+	}
+	n := int(payload[0])
+	return payload[1 : 1+n], payload[1+n:], nil
+}
+
+// EncodeHistory builds a History payload from when a line was said and the line
+func EncodeHistory(sent time.Time, text string) []byte {
+	return append(binary.LittleEndian.AppendUint64(nil, uint64(sent.UnixNano())), text...)
+}
+
+func DecodeHistory(payload []byte) (sent time.Time, text string, err error) {
+	if len(payload) < 8 {
+		return time.Time{}, "", errors.New("history payload too short")
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(payload))), string(payload[8:]), nil
+}
+
+const pingStampSize = 8
+
+// EncodePing builds a Ping payload, the receiver echoes the timestamp back in a Pong.
+// The server appends the round trip time it measured to every client.
+func EncodePing(sent time.Time, rtts map[uint8]time.Duration) []byte {
+	payload := binary.LittleEndian.AppendUint64(nil, uint64(sent.UnixNano()))
+	for id, rtt := range rtts {
+		payload = append(payload, id)
+		payload = binary.LittleEndian.AppendUint16(payload, uint16(min(rtt.Milliseconds(), math.MaxUint16)))
+	}
+	return payload
+}
+
+func DecodePing(payload []byte) (rtts map[uint8]time.Duration, err error) {
+	if len(payload) < pingStampSize {
+		return nil, errors.New("ping payload too short")
+	}
+
+	rtts = make(map[uint8]time.Duration)
+	for rest := payload[pingStampSize:]; len(rest) >= 3; rest = rest[3:] {
+		rtts[rest[0]] = time.Duration(binary.LittleEndian.Uint16(rest[1:])) * time.Millisecond
+	}
+	return rtts, nil
+}
+
+// EncodePong answers a Ping payload
+func EncodePong(ping []byte) []byte {
+	return ping[:min(len(ping), pingStampSize)]
+}
+
+// DecodePong returns when the answered Ping was sent
+func DecodePong(payload []byte) (time.Time, error) {
+	if len(payload) < pingStampSize {
+		return time.Time{}, errors.New("pong payload too short")
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(payload))), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	p "github.com/crolbar/lekvc/lekvcs/protocol"
+)
+
+const (
+	// chat and control messages waiting for a client, these are never
+	// dropped so a client that lets the queue fill up is disconnected
+	controlQueueSize = 256
+	// audio waiting for a client, the oldest frame goes when it is full
+	audioQueueSize = 20
+)
+
+const (
+	slowClientDowngrade  = "downgrade"
+	slowClientDisconnect = "disconnect"
+)
+
+var (
+	// how long a client may keep dropping audio before slowClientAction
+	slowClientAfter = 5 * time.Second
+	// downgrade pauses the audio sent to the client, disconnect drops it
+	slowClientAction = slowClientDowngrade
+	// how long a downgraded client goes without audio before trying again
+	downgradeFor = 10 * time.Second
+	// a client downgraded this many times is disconnected instead
+	maxDowngrades = int32(3)
+)
+
+// send queues msg for c, audio may be dropped but anything else is delivered
+// or the connection is closed, mu must be held unless c is the caller's own client
+func (c *Client) send(msg p.Msg) {
+	if msg.Type == p.Audio || msg.Type == p.Whisper {
+		c.queueAudio(msg)
+		return
+	}
+
+	select {
+	case c.ch <- msg:
+	default:
+		c.log.Warn("send queue full, disconnecting", "queue", cap(c.ch))
+		metrics.slowClients.add(slowClientDisconnect)
+		c.conn.Close()
+	}
+}
+
+func (c *Client) queueAudio(msg p.Msg) {
+	now := time.Now()
+	if now.UnixNano() < c.audioPausedUntil.Load() {
+		return
+	}
+
+	for {
+		select {
+		case c.audio <- msg:
+			return
+		default:
+		}
+
+		// full, make room by dropping the oldest frame
+		select {
+		case <-c.audio:
+			c.countDrop()
+			c.backlogged(now)
+		default:
+		}
+	}
+}
+
+// backlogged notes that c dropped audio, acting once it has kept at it for slowClientAfter
+func (c *Client) backlogged(now time.Time) {
+	since := c.backlogSince.Load()
+	if since == 0 {
+		c.backlogSince.CompareAndSwap(0, now.UnixNano())
+		return
+	}
+	if now.Sub(time.Unix(0, since)) < slowClientAfter {
+		return
+	}
+
+	c.backlogSince.Store(0)
+
+	if slowClientAction == slowClientDisconnect || c.downgrades.Add(1) > maxDowngrades {
+		c.log.Warn("client can't keep up, disconnecting", "dropped", c.drops.Load())
+		metrics.slowClients.add(slowClientDisconnect)
+		c.conn.Close()
+		return
+	}
+
+	c.log.Warn("client can't keep up, pausing its audio", "dropped", c.drops.Load(), "for", downgradeFor)
+	metrics.slowClients.add(slowClientDowngrade)
+	c.audioPausedUntil.Store(now.Add(downgradeFor).UnixNano())
+
+	// what is queued is late already
+	for len(c.audio) > 0 {
+		select {
+		case <-c.audio:
+		default:
+		}
+	}
+
+	c.sendServerText(fmt.Sprintf("your connection can't keep up, audio is paused for %s", downgradeFor))
+}
+
+// next returns the next message for the writer, control before audio,
+// false once the client is gone
+func (c *Client) next() (p.Msg, bool) {
+	select {
+	case msg, ok := <-c.ch:
+		return msg, ok
+	default:
+	}
+
+	select {
+	case msg, ok := <-c.ch:
+		return msg, ok
+	case msg := <-c.audio:
+		if len(c.audio) == 0 {
+			// caught up
+			c.backlogSince.Store(0)
+		}
+		return msg, true
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	p "github.com/crolbar/lekvc/lekvcs/protocol"
+)
+
+// testConn is a connection that only records being closed
+type testConn struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+func (c *testConn) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+}
+
+func newTestClient(id ClientID) (*Client, *testConn) {
+	conn := &testConn{}
+	return &Client{
+		id:    id,
+		name:  "test",
+		conn:  conn,
+		ch:    make(chan p.Msg, controlQueueSize),
+		audio: make(chan p.Msg, audioQueueSize),
+		log:   slog.Default(),
+	}, conn
+}
+
+func TestSlowClient(t *testing.T) {
+	defer func(action string) { slowClientAction = action }(slowClientAction)
+
+	tests := []struct {
+		name        string
+		action      string
+		downgrades  int32
+		dropping    time.Duration
+		paused      bool
+		closed      bool
+		backlogLeft bool
+	}{
+		{"briefly behind", slowClientDowngrade, 0, slowClientAfter / 2, false, false, true},
+		{"downgraded", slowClientDowngrade, 0, slowClientAfter, true, false, false},
+		{"downgraded too often", slowClientDowngrade, maxDowngrades, slowClientAfter, false, true, false},
+		{"disconnect", slowClientDisconnect, 0, slowClientAfter, false, true, false},
+	}
+
+	for _, tt := range tests {
+		slowClientAction = tt.action
+		c, conn := newTestClient(1)
+		c.downgrades.Store(tt.downgrades)
+
+		start := time.Now()
+		for range audioQueueSize {
+			c.audio <- p.NewMsg(p.Audio, 2, nil, "")
+		}
+		c.backlogged(start)
+		c.backlogged(start.Add(tt.dropping))
+
+		paused := c.audioPausedUntil.Load() > start.UnixNano()
+		if paused != tt.paused {
+			t.Errorf("%s: audio paused %v, want %v", tt.name, paused, tt.paused)
+		}
+		if conn.closed.Load() != tt.closed {
+			t.Errorf("%s: closed %v, want %v", tt.name, conn.closed.Load(), tt.closed)
+		}
+		if (c.backlogSince.Load() != 0) != tt.backlogLeft {
+			t.Errorf("%s: still counted as backlogged %v, want %v", tt.name, c.backlogSince.Load() != 0, tt.backlogLeft)
+		}
+
+		if tt.paused {
+			// what was queued is dropped and the client is told why
+			if len(c.audio) != 0 {
+				t.Errorf("%s: %d frames still queued", tt.name, len(c.audio))
+			}
+			if len(c.ch) != 1 {
+				t.Errorf("%s: %d control messages, want the notice", tt.name, len(c.ch))
+			}
+
+			// no audio is queued while paused
+			c.queueAudio(p.NewMsg(p.Audio, 2, nil, ""))
+			if len(c.audio) != 0 {
+				t.Errorf("%s: audio queued while paused", tt.name)
+			}
+		}
+	}
+}
+
+func TestQueueAudioDropsOldest(t *testing.T) {
+	c, _ := newTestClient(1)
+
+	for i := range audioQueueSize + 3 {
+		c.queueAudio(p.NewMsg(p.Audio, uint8(i), nil, ""))
+	}
+
+	if c.drops.Load() != 3 {
+		t.Errorf("%d drops, want 3", c.drops.Load())
+	}
+	if msg := <-c.audio; msg.ID != 3 {
+		t.Errorf("oldest queued frame is %d, want 3", msg.ID)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	p "github.com/crolbar/lekvc/lekvcs/protocol"
+)
+
+const (
+	limitDrop       = "drop"
+	limitWarn       = "warn"
+	limitMute       = "mute"
+	limitDisconnect = "disconnect"
+)
+
+var (
+	// per client, 0 disables a limit
+	textPerSecond  = 2.0
+	audioPerSecond = 60.0
+	// below 0 it is sized for the audio at the room's rate
+	bytesPerSecond = -1.0
+
+	// what happens past a limit besides dropping the message
+	limitAction = limitWarn
+	// how long limitMute keeps a client quiet
+	limitMuteFor = 30 * time.Second
+
+	// connected clients from one address, 0 disables
+	maxPerIP = 8
+	// handshakes an address may start per minute, 0 disables
+	handshakesPerMinute = 20.0
+)
+
+// at most one warning about it per this long
+const limitWarnEvery = 5 * time.Second
+
+// bucket is a token bucket, refilled at rate tokens a second up to burst
+type bucket struct {
+	rate, burst float64
+
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate, burst float64) *bucket {
+	return &bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take removes n tokens if there are enough, nil buckets never run out
+func (b *bucket) take(now time.Time, n float64) bool {
+	if b == nil {
+		return true
+	}
+
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+func (b *bucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// limits of one client, only touched by its read loop
+type limits struct {
+	text, audio, bytes *bucket
+
+	lastWarn time.Time
+}
+
+func newLimits() *limits {
+	l := &limits{}
+	// a second of traffic can come at once
+	if textPerSecond > 0 {
+		l.text = newBucket(textPerSecond, max(textPerSecond*2, 5))
+	}
+	if audioPerSecond > 0 {
+		l.audio = newBucket(audioPerSecond, audioPerSecond)
+	}
+	if bytesPerSecond > 0 {
+		l.bytes = newBucket(bytesPerSecond, bytesPerSecond)
+	}
+	return l
+}
+
+// allow reports whether msg is within the limits of c, acting on it if not
+func (c *Client) allow(msg *p.Msg) bool {
+	// the rest keeps the connection going and is small
+	switch msg.Type {
+	case p.Audio, p.Whisper, p.Text, p.DirectText, p.Command:
+	default:
+		return true
+	}
+
+	now := time.Now()
+	if now.UnixNano() < c.limitedUntil.Load() && msg.Type != p.Command {
+		return false
+	}
+
+	ok := c.limits.bytes.take(now, float64(p.MsgHeaderSize+int(msg.Size)))
+	switch msg.Type {
+	case p.Text, p.DirectText, p.Command:
+		ok = c.limits.text.take(now, 1) && ok
+	case p.Audio, p.Whisper:
+		ok = c.limits.audio.take(now, 1) && ok
+	}
+	if ok {
+		return true
+	}
+
+	metrics.rateLimited.add(msg.Type.String())
+
+	switch limitAction {
+	case limitWarn:
+		if now.Sub(c.limits.lastWarn) >= limitWarnEvery {
+			c.limits.lastWarn = now
+			c.log.Warn("rate limited", "type", msg.Type)
+			c.sendServerText("you are sending too fast, some of your messages were dropped")
+		}
+	case limitMute:
+		if now.UnixNano() >= c.limitedUntil.Load() {
+			c.log.Warn("rate limited, muting", "type", msg.Type, "for", limitMuteFor)
+			c.limitedUntil.Store(now.Add(limitMuteFor).UnixNano())
+			c.sendServerText(fmt.Sprintf("you are sending too fast, muted for %s", limitMuteFor))
+		}
+	case limitDisconnect:
+		c.log.Warn("rate limited, disconnecting", "type", msg.Type)
+		mu.Lock()
+		c.kick("kicked for flooding")
+		mu.Unlock()
+	}
+	return false
+}
+
+// handshake buckets by address
+var (
+	handshakes   = make(map[string]*bucket)
+	handshakesMu sync.Mutex
+)
+
+// allowHandshake reports whether the address of conn may start another handshake
+func allowHandshake(conn net.Conn) bool {
+	if handshakesPerMinute <= 0 {
+		return true
+	}
+
+	ip := remoteIP(conn)
+	now := time.Now()
+
+	handshakesMu.Lock()
+	defer handshakesMu.Unlock()
+
+	// forget addresses that have been quiet long enough to be full again
+	if len(handshakes) > 1024 {
+		for addr, b := range handshakes {
+			if b.full(now) {
+				delete(handshakes, addr)
+			}
+		}
+	}
+
+	b, ok := handshakes[ip]
+	if !ok {
+		b = newBucket(handshakesPerMinute/60, handshakesPerMinute)
+		handshakes[ip] = b
+	}
+	return b.take(now, 1)
+}
+
+// tooManyFrom reports whether ip is at maxPerIP connected clients, not counting
+// except, the connection a resuming client replaces, mu must be held
+func tooManyFrom(ip string, except *Client) bool {
+	if maxPerIP <= 0 {
+		return false
+	}
+
+	n := 0
+	for _, c := range clients {
+		if c != except && remoteIP(c.conn) == ip {
+			n++
+		}
+	}
+	return n >= maxPerIP
+}
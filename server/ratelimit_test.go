@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	type step struct {
+		after time.Duration
+		take  float64
+		ok    bool
+	}
+
+	tests := []struct {
+		name        string
+		rate, burst float64
+		steps       []step
+	}{
+		{"burst then empty", 1, 3, []step{
+			{0, 1, true}, {0, 1, true}, {0, 1, true}, {0, 1, false},
+		}},
+		{"refills at rate", 2, 2, []step{
+			{0, 2, true}, {0, 1, false},
+			{500 * time.Millisecond, 1, true}, {0, 1, false},
+			{time.Second, 2, true},
+		}},
+		{"never past burst", 10, 4, []step{
+			{time.Hour, 4, true}, {0, 1, false},
+		}},
+		{"failed take keeps tokens", 1, 5, []step{
+			{0, 3, true}, {0, 3, false}, {0, 2, true},
+		}},
+		{"fractional", 0.5, 1, []step{
+			{0, 1, true}, {time.Second, 1, false}, {time.Second, 1, true},
+		}},
+	}
+
+	for _, tt := range tests {
+		b := newBucket(tt.rate, tt.burst)
+		now := b.last
+		for i, s := range tt.steps {
+			now = now.Add(s.after)
+			if got := b.take(now, s.take); got != s.ok {
+				t.Errorf("%s: step %d taking %v got %v, want %v", tt.name, i, s.take, got, s.ok)
+			}
+		}
+	}
+}
+
+func TestBucketFull(t *testing.T) {
+	b := newBucket(1, 2)
+	now := b.last
+	if !b.full(now) {
+		t.Error("a new bucket isn't full")
+	}
+
+	b.take(now, 2)
+	if b.full(now.Add(time.Second)) {
+		t.Error("full after refilling half")
+	}
+	if !b.full(now.Add(2 * time.Second)) {
+		t.Error("not full after refilling all")
+	}
+
+	var none *bucket
+	if !none.take(now, 1000) {
+		t.Error("a nil bucket ran out")
+	}
+}
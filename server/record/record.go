@@ -0,0 +1,105 @@
+// Package record holds what the client and server recorders share:
+// how late audio may arrive, how tracks are named and the chat transcript
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Slack is how late audio can arrive and still be written as is instead of after a gap
+const Slack = 100 * time.Millisecond
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// FileName makes a client name safe to use in a file name
+func FileName(name string) string {
+	return unsafeFileChars.ReplaceAllString(name, "_")
+}
+
+// DecodeSamples decodes the little-endian float32 audio of the wire
+// into dst[:0], only allocating when dst is too small
+func DecodeSamples(dst []float32, b []byte) []float32 {
+	n := len(b) / 4
+	if cap(dst) < n {
+		dst = make([]float32, n)
+	}
+	dst = dst[:n]
+
+	for i := range dst {
+		dst[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[i*4:]))
+	}
+	return dst
+}
+
+// Transcript is the chat of a recording, every line stamped with the time since it started
+type Transcript struct {
+	mu sync.Mutex
+
+	start time.Time
+	w     *bufio.Writer
+	file  *os.File
+}
+
+// CreateTranscript creates the transcript file of a recording that started at start
+func CreateTranscript(path string, start time.Time) (*Transcript, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Transcript{
+		start: start,
+		w:     bufio.NewWriter(file),
+		file:  file,
+	}
+	fmt.Fprintf(t.w, "# recording started %s\n", start.Format(time.RFC3339))
+	if err := t.w.Flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Line adds a chat line, lines after Close are dropped
+func (t *Transcript) Line(sender, text string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.file == nil {
+		return
+	}
+
+	elapsed := time.Since(t.start)
+	fmt.Fprintf(t.w, "[%02d:%02d:%02d.%03d] %s: %s\n",
+		int(elapsed.Hours()),
+		int(elapsed.Minutes())%60,
+		int(elapsed.Seconds())%60,
+		elapsed.Milliseconds()%1000,
+		sender,
+		text)
+	t.w.Flush()
+}
+
+func (t *Transcript) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.file == nil {
+		return nil
+	}
+
+	fmt.Fprintf(t.w, "# recording stopped %s\n", time.Now().Format(time.RFC3339))
+	err := t.w.Flush()
+	if cerr := t.file.Close(); err == nil {
+		err = cerr
+	}
+	t.file = nil
+	return err
+}
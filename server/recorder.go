@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/crolbar/lekvc/lekvcs/logging"
+	"github.com/crolbar/lekvc/lekvcs/record"
+	"github.com/crolbar/lekvc/lekvcs/wav"
+)
+
+// the clients send mono float32 at the wire rate
+var recordFormat = wav.Format{SampleRate: 48000, Channels: 1, Encoding: wav.PCM16}
+
+// audio waiting for the writer, in chunks of a tenth of a second,
+// a stalled disk drops audio from the recording after this many
+const recordChunks = 64
+
+const (
+	recordingNotice  = "this call is being recorded by the server"
+	recordingStopped = "the server stopped recording this call"
+)
+
+// recordChunk is audio of a client handed from its readLoop to the writer goroutine,
+// or with leave set the end of its track
+type recordChunk struct {
+	id    ClientID
+	name  string
+	leave bool
+	// when the last sample arrived
+	at      time.Time
+	samples []float32
+}
+
+// Recorder writes every speaker of the room to their own track,
+// aligned by arrival time, plus a transcript of the chat.
+// Audio only queues the samples, a goroutine does all the file work
+// so a slow disk never holds up the readLoops.
+type Recorder struct {
+	dir   string
+	start time.Time
+
+	// filled chunks to the writer and empty ones back, never more than recordChunks
+	chunks  chan recordChunk
+	free    chan []float32
+	dropped atomic.Uint64
+	stop    chan struct{}
+	stopped chan struct{}
+
+	// only touched by the writer, and by Stop once it finished
+	tracks map[ClientID]*wav.Track
+	// numbers the tracks so a client rejoining with the same id and name gets a new file
+	seq int
+
+	transcript *record.Transcript
+}
+
+var (
+	// the running recording of the room, nil when it isn't recorded
+	recording atomic.Pointer[Recorder]
+	// where /recording puts its sessions, empty disables recording
+	recordDir string
+)
+
+// StartRecorder creates a new session directory inside dir
+func StartRecorder(dir string) (*Recorder, error) {
+	start := time.Now()
+	r := &Recorder{
+		dir:     filepath.Join(dir, "lekvcs-"+start.Format("20060102-150405")),
+		start:   start,
+		chunks:  make(chan recordChunk, recordChunks),
+		free:    make(chan []float32, recordChunks),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		tracks:  make(map[ClientID]*wav.Track),
+	}
+	for range recordChunks {
+		r.free <- make([]float32, 0, recordFormat.SampleRate/10)
+	}
+
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	var err error
+	r.transcript, err = record.CreateTranscript(filepath.Join(r.dir, "chat.txt"), start)
+	if err != nil {
+		return nil, err
+	}
+
+	go r.writeLoop()
+
+	return r, nil
+}
+
+func (r *Recorder) Dir() string {
+	return r.dir
+}
+
+// Audio records an audio payload of a client at the time it arrived,
+// it never blocks and drops the audio when the writer is too far behind
+func (r *Recorder) Audio(id ClientID, name string, payload []byte) {
+	now := time.Now()
+
+	for len(payload) >= 4 {
+		var buf []float32
+		select {
+		case buf = <-r.free:
+		default:
+			r.dropped.Add(1)
+			return
+		}
+
+		buf = record.DecodeSamples(buf, payload[:min(len(payload), cap(buf)*4)])
+		payload = payload[len(buf)*4:]
+
+		// the end of this chunk arrived before the rest
+		at := now.Add(-time.Duration(len(payload)/4) * time.Second / time.Duration(recordFormat.SampleRate))
+
+		select {
+		case r.chunks <- recordChunk{id: id, name: name, at: at, samples: buf}:
+		default:
+			// the queue is full of tracks to finish
+			r.free <- buf[:0]
+			r.dropped.Add(1)
+			return
+		}
+	}
+}
+
+// Leave finishes the track of a client that disconnected
+func (r *Recorder) Leave(id ClientID) {
+	select {
+	case r.chunks <- recordChunk{id: id, leave: true}:
+	case <-r.stopped:
+	}
+}
+
+func (r *Recorder) writeLoop() {
+	defer close(r.stopped)
+
+	for {
+		select {
+		case c := <-r.chunks:
+			r.write(c)
+		case <-r.stop:
+			// what was queued before Stop still goes in
+			for {
+				select {
+				case c := <-r.chunks:
+					r.write(c)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *Recorder) write(c recordChunk) {
+	if c.leave {
+		track, ok := r.tracks[c.id]
+		if !ok {
+			return
+		}
+		delete(r.tracks, c.id)
+
+		if err := closeTrack(track, r.start); err != nil {
+			slog.Error("closing track failed", "client_id", c.id, "err", err)
+		}
+		return
+	}
+	defer func() { r.free <- c.samples[:0] }()
+
+	track, ok := r.tracks[c.id]
+	if !ok {
+		var err error
+		r.seq++
+		path := filepath.Join(r.dir, fmt.Sprintf("%03d-%d-%s.wav", r.seq, c.id, record.FileName(c.name)))
+		track, err = wav.CreateTrack(path, recordFormat, r.start, record.Slack)
+		if err != nil {
+			slog.Error("creating track failed", "client_id", c.id, "name", c.name, "err", err)
+			return
+		}
+		r.tracks[c.id] = track
+	}
+
+	if err := track.WriteAt(c.at, c.samples); err != nil {
+		slog.Error("writing track failed", "client_id", c.id, "err", err)
+	}
+}
+
+// Text adds a line to the transcript
+func (r *Recorder) Text(sender, text string) {
+	r.transcript.Line(sender, text)
+}
+
+// Stop writes what is still queued and finishes every track and the transcript
+func (r *Recorder) Stop() error {
+	close(r.stop)
+	<-r.stopped
+
+	if n := r.dropped.Load(); n > 0 {
+		slog.Warn("the disk fell behind the recording, audio is missing", "chunks", n, "dir", r.dir)
+	}
+
+	var errs []error
+	for _, track := range r.tracks {
+		errs = append(errs, closeTrack(track, r.start))
+	}
+	clear(r.tracks)
+	errs = append(errs, r.transcript.Close())
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startRecording starts recording the room and tells everyone in it, mu must be held
+func startRecording() (*Recorder, error) {
+	if r := recording.Load(); r != nil {
+		return r, nil
+	}
+
+	r, err := StartRecorder(recordDir)
+	if err != nil {
+		return nil, err
+	}
+	recording.Store(r)
+	slog.Info("recording", "dir", r.Dir(), logging.EventKey, "recording")
+
+	announce(recordingNotice)
+	return r, nil
+}
+
+// stopRecording finishes the recording of the room and tells everyone in it, mu must be held
+func stopRecording() error {
+	r := recording.Swap(nil)
+	if r == nil {
+		return nil
+	}
+
+	slog.Info("recording stopped", "dir", r.Dir(), logging.EventKey, "recording")
+	for _, c := range clients {
+		c.sendServerText(recordingStopped)
+	}
+	return r.Stop()
+}
+
+func handleRecording(from *Client, args []string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(args) == 0 {
+		if r := recording.Load(); r != nil {
+			reply(from, "recording into "+r.Dir())
+		} else {
+			reply(from, "not recording")
+		}
+		return
+	}
+
+	switch args[0] {
+	case "on", "start":
+		if recordDir == "" {
+			reply(from, "recording is disabled, start the server with -record <dir>")
+			return
+		}
+		r, err := startRecording()
+		if err != nil {
+			reply(from, "starting the recording failed: "+err.Error())
+			return
+		}
+		reply(from, "recording into "+r.Dir())
+	case "off", "stop":
+		if recording.Load() == nil {
+			reply(from, "not recording")
+			return
+		}
+		if err := stopRecording(); err != nil {
+			reply(from, "finishing the recording failed: "+err.Error())
+			return
+		}
+		reply(from, "recording stopped")
+	default:
+		reply(from, "usage: /recording [on|off]")
+	}
+}
+
+// closeTrack pads the track with silence up to now so every track
+// lines up with the start of the session
+func closeTrack(track *wav.Track, start time.Time) error {
+	end := int64(time.Since(start).Seconds() * float64(recordFormat.SampleRate))
+	err := track.Pad(end)
+	if cerr := track.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
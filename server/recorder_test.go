@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crolbar/lekvc/lekvcs/wav"
+)
+
+func payload(samples []float32) []byte {
+	b := make([]byte, len(samples)*4)
+	for i, s := range samples {
+		binary.LittleEndian.PutUint32(b[i*4:], math.Float32bits(s))
+	}
+	return b
+}
+
+func TestRecorderWritesQueuedAudio(t *testing.T) {
+	r, err := StartRecorder(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := make([]float32, 480)
+	for i := range frame {
+		frame[i] = 0.5
+	}
+	// more than a chunk at once is split
+	r.Audio(1, "alice", payload(make([]float32, recordFormat.SampleRate/4)))
+	for range 10 {
+		r.Audio(1, "alice", payload(frame))
+		r.Audio(2, "bob/../x", payload(frame))
+	}
+	r.Text("alice", "hi")
+	r.Leave(2)
+	// rejoining gets a new track
+	r.Audio(2, "bob/../x", payload(frame))
+
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.dropped.Load(); n != 0 {
+		t.Errorf("dropped %d chunks", n)
+	}
+
+	for _, name := range []string{"001-1-alice.wav", "002-2-bob_.._x.wav", "003-2-bob_.._x.wav"} {
+		samples, _, err := wav.ReadFile(filepath.Join(r.Dir(), name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(samples) < len(frame) {
+			t.Errorf("%s has %d samples", name, len(samples))
+		}
+	}
+
+	chat, err := os.ReadFile(filepath.Join(r.Dir(), "chat.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(chat), "] alice: hi\n") || !strings.Contains(string(chat), "# recording stopped") {
+		t.Errorf("transcript is\n%s", chat)
+	}
+}
+
+func TestRecorderDropsWhenFull(t *testing.T) {
+	r, err := StartRecorder(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hold the writer up the way a stalled disk would
+	close(r.stop)
+	<-r.stopped
+
+	for range 2 * recordChunks {
+		r.Audio(1, "alice", payload(make([]float32, 480)))
+	}
+	if r.dropped.Load() == 0 {
+		t.Error("nothing was dropped with the writer stuck")
+	}
+	r.transcript.Close()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/crolbar/lekvc/lekvcs/logging"
+	p "github.com/crolbar/lekvc/lekvcs/protocol"
+)
+
+// how long a dropped client can come back as itself, 0 disables resuming
+var resumeGrace = 30 * time.Second
+
+// suspended is a dropped client whose id and name are kept for the grace window
+type suspended struct {
+	client *Client
+	timer  *time.Timer
+}
+
+// suspended clients by resume token, guarded by mu
+var suspendedClients = make(map[string]*suspended)
+
+func newResumeToken() []byte {
+	token := make([]byte, p.ResumeTokenSize)
+	rand.Read(token)
+	return token
+}
+
+// idInUse reports whether id belongs to a connected or suspended client, mu must be held
+func idInUse(id ClientID) bool {
+	if _, ok := clients[id]; ok {
+		return true
+	}
+	for _, s := range suspendedClients {
+		if s.client.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// allocateID returns the next free id, mu must be held
+func allocateID() (ClientID, bool) {
+	for range 256 {
+		id := nextClientID
+		nextClientID += 1 // can get to 0
+
+		// 0 is the magic id of InitClient
+		if id != 0 && !idInUse(id) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// takeSuspended removes and returns the client suspended under token, mu must be held
+func takeSuspended(token []byte) (*Client, bool) {
+	if len(token) == 0 {
+		return nil, false
+	}
+
+	s, ok := suspendedClients[string(token)]
+	if !ok {
+		return nil, false
+	}
+
+	s.timer.Stop()
+	delete(suspendedClients, string(token))
+	return s.client, true
+}
+
+// liveClient returns the connected client holding token, mu must be held.
+// It is still connected when its client resumes before the server noticed
+// the old connection was gone
+func liveClient(token []byte) *Client {
+	if len(token) == 0 {
+		return nil
+	}
+
+	for _, c := range clients {
+		if bytes.Equal(c.token, token) {
+			return c
+		}
+	}
+	return nil
+}
+
+// replace drops the half-open connection of a client that resumed on a new one,
+// its reader exits without telling the others it left, mu must be held
+func (c *Client) replace() {
+	c.log.Info("client resumed on a new connection, dropping the old one", logging.EventKey, "drop")
+
+	c.replaced.Store(true)
+	if clients[c.id] == c {
+		delete(clients, c.id)
+	}
+	c.conn.Close()
+}
+
+// suspend keeps the identity of a dropped client for the grace window,
+// the others are only told it left once the window passes
+func (c *Client) suspend() {
+	c.log.Warn("client dropped, waiting for it to resume", "grace", resumeGrace, logging.EventKey, "drop")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if clients[c.id] == c {
+		delete(clients, c.id)
+	}
+
+	s := &suspended{client: c}
+	s.timer = time.AfterFunc(resumeGrace, func() {
+		mu.Lock()
+		expired := suspendedClients[string(c.token)] == s
+		if expired {
+			delete(suspendedClients, string(c.token))
+		}
+		mu.Unlock()
+
+		if expired {
+			c.notifyClientLeave()
+		}
+	})
+	suspendedClients[string(c.token)] = s
+}
+
+func (c *Client) notifyClientReconnect() {
+	msg := fmt.Sprintf("CLIENT %s(%s) RECONNECTED", c.name, c.conn.RemoteAddr().String())
+
+	c.log.Info("client reconnected", logging.EventKey, "reconnect")
+
+	if r := recording.Load(); r != nil {
+		r.Text("SERVER", msg)
+		c.sendServerText(recordingNotice)
+	}
+
+	c.sendToOthers(p.NewMsgP(
+		p.ClientReconnect,
+		c.id,
+		[]byte(msg),
+	))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	p "github.com/crolbar/lekvc/lekvcs/protocol"
+)
+
+// serve accepts connections on a loopback port until the test ends
+func serve(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// runs after the connections of the test are closed
+	t.Cleanup(func() {
+		l.Close()
+		connections.Wait()
+
+		mu.Lock()
+		for token, s := range suspendedClients {
+			s.timer.Stop()
+			delete(suspendedClients, token)
+		}
+		mu.Unlock()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleInitClient(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// join connects as name, resuming the session of token if it is set
+func join(t *testing.T, addr, name string, token []byte) (net.Conn, *p.Msg) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	data, _ := p.EncodeMsg(p.NewMsg(p.InitClient, 0, p.EncodeInitClient(sampleRate, token, ""), name))
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err := p.ReadMsg(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != p.InitClient {
+		t.Fatalf("handshake answered with %d", msg.Type)
+	}
+	return conn, msg
+}
+
+func TestResumeHalfOpen(t *testing.T) {
+	addr := serve(t)
+
+	old, init := join(t, addr, "alice", nil)
+	_, token, _ := p.DecodeInitClient(init.Payload)
+	id := init.ID
+
+	watcher, _ := join(t, addr, "bob", nil)
+
+	// alice's network changed, the server still thinks the old connection is up
+	_, again := join(t, addr, "alice", token)
+	if again.ID != id || again.ClientName != "alice" {
+		t.Fatalf("resumed as %d %q, want %d alice", again.ID, again.ClientName, id)
+	}
+
+	// the old connection is closed by the server
+	old.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, err := p.ReadMsg(old); err != nil {
+			if isTimeout(err) {
+				t.Fatal("the half-open connection was kept")
+			}
+			break
+		}
+	}
+
+	// the others see alice reconnect, never leave
+	watcher.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for reconnected := false; !reconnected; {
+		msg, err := p.ReadMsg(watcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case msg.Type == p.ClientLeave && msg.ID == id:
+			t.Fatal("the others were told alice left")
+		case msg.Type == p.ClientReconnect && msg.ID == id:
+			reconnected = true
+		}
+	}
+
+	mu.Lock()
+	c := clients[id]
+	n := 0
+	for _, other := range clients {
+		if bytes.Equal(other.token, token) {
+			n++
+		}
+	}
+	mu.Unlock()
+	if c == nil || c.replaced.Load() || n != 1 {
+		t.Errorf("client %d is %v with %d clients holding its token, want the new connection alone", id, c, n)
+	}
+}
+
+func TestTakeSuspended(t *testing.T) {
+	defer func(grace time.Duration) { resumeGrace = grace }(resumeGrace)
+	resumeGrace = 50 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		wait    time.Duration
+		token   []byte
+		resumed bool
+	}{
+		{"within the grace window", 0, nil, true},
+		{"after the grace window", 4 * resumeGrace, nil, false},
+		{"unknown token", 0, []byte("someone else"), false},
+		{"no token", 0, []byte{}, false},
+	}
+
+	for _, tt := range tests {
+		c, _ := newTestClient(100)
+		c.token = newResumeToken()
+		c.suspend()
+
+		time.Sleep(tt.wait)
+
+		token := c.token
+		if tt.token != nil {
+			token = tt.token
+		}
+
+		mu.Lock()
+		prev, ok := takeSuspended(token)
+		_, left := suspendedClients[string(c.token)]
+		delete(suspendedClients, string(c.token))
+		mu.Unlock()
+
+		if ok != tt.resumed || (ok && prev != c) {
+			t.Errorf("%s: resumed %v as %p, want %v as %p", tt.name, ok, prev, tt.resumed, c)
+		}
+		// expired and taken sessions are forgotten, the others wait for their client
+		if wantLeft := !tt.resumed && tt.wait == 0; left != wantLeft {
+			t.Errorf("%s: still suspended %v, want %v", tt.name, left, wantLeft)
+		}
+	}
+}
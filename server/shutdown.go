@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	p "github.com/crolbar/lekvc/lekvcs/protocol"
+)
+
+var (
+	// countdown announced to the room before shutting down
+	shutdownDelay = 10 * time.Second
+	// how long the clients get to take what is queued for them
+	drainTimeout = 5 * time.Second
+)
+
+var (
+	listener net.Listener
+
+	shuttingDown atomic.Bool
+	// closed by a second signal to skip the countdown and the drain
+	hurry     = make(chan struct{})
+	hurryOnce sync.Once
+
+	// connected clients, done once their read loop has cleaned up
+	connections sync.WaitGroup
+
+	// closed once everyone is gone and the recording is finished
+	drained = make(chan struct{})
+)
+
+// the remaining times the countdown is announced at
+var countdownMarks = []time.Duration{
+	5 * time.Minute, time.Minute, 30 * time.Second, 10 * time.Second,
+	5 * time.Second, 3 * time.Second, 2 * time.Second, time.Second,
+}
+
+// handleSignals shuts down on the first SIGINT or SIGTERM and hurries on the second
+func handleSignals() {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	<-sig
+	go shutdown(shutdownDelay)
+
+	<-sig
+	slog.Warn("second signal, shutting down now")
+	hurryOnce.Do(func() { close(hurry) })
+}
+
+// shutdown stops accepting, counts down in the chat, lets the writers flush
+// what is queued and closes every connection, then finishes the recording
+func shutdown(delay time.Duration) {
+	if !shuttingDown.CompareAndSwap(false, true) {
+		return
+	}
+
+	slog.Info("shutting down", "delay", delay)
+	if listener != nil {
+		listener.Close()
+	}
+
+	countdown(delay)
+	drain()
+
+	if r := recording.Swap(nil); r != nil {
+		if err := r.Stop(); err != nil {
+			slog.Error("finishing the recording failed", "err", err)
+		}
+	}
+	if consoleListener != nil {
+		consoleListener.Close()
+	}
+
+	slog.Info("shut down")
+	close(drained)
+}
+
+// how often the countdown checks whether anyone is still connected
+const countdownPoll = 200 * time.Millisecond
+
+// countdown announces the shutdown until delay passes, it ends early
+// once nobody is connected since there is no one left to warn
+func countdown(delay time.Duration) {
+	end := time.Now().Add(delay)
+
+	poll := time.NewTicker(countdownPoll)
+	defer poll.Stop()
+
+	for remaining := delay; remaining > 0; {
+		if roomEmpty() {
+			slog.Info("nobody is connected, skipping the rest of the countdown")
+			return
+		}
+		mu.Lock()
+		announce(fmt.Sprintf("the server shuts down in %s", remaining.Round(time.Second)))
+		mu.Unlock()
+
+		// the next mark below what is left, 0 is the end
+		next := time.Duration(0)
+		for _, mark := range countdownMarks {
+			if mark < remaining {
+				next = mark
+				break
+			}
+		}
+
+		mark := time.After(time.Until(end.Add(-next)))
+		for waiting := true; waiting; {
+			select {
+			case <-mark:
+				waiting = false
+			case <-poll.C:
+				if roomEmpty() {
+					slog.Info("nobody is connected, skipping the rest of the countdown")
+					return
+				}
+			case <-hurry:
+				return
+			}
+		}
+		remaining = next
+	}
+}
+
+func roomEmpty() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(clients) == 0
+}
+
+// drain kicks everyone behind what is already queued for them and waits for
+// the connections to close, cutting them off after drainTimeout
+func drain() {
+	mu.Lock()
+	for _, c := range clients {
+		c.closeAfterFlush("the server shut down")
+	}
+	// nobody is coming back to resume
+	for token, s := range suspendedClients {
+		s.timer.Stop()
+		delete(suspendedClients, token)
+	}
+	mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		connections.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(drainTimeout):
+		slog.Warn("drain timed out, closing the remaining connections")
+	case <-hurry:
+	}
+
+	mu.Lock()
+	for _, c := range clients {
+		c.conn.Close()
+	}
+	mu.Unlock()
+
+	// the read loops return right away on a closed connection
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+}
+
+// closeAfterFlush sends text after everything queued for c and closes the
+// connection, unlike a kick the client reconnects on its own, mu must be held
+func (c *Client) closeAfterFlush(text string) {
+	// no resuming either, the server is going away
+	c.kicked.Store(true)
+	c.closing.Store(true)
+
+	select {
+	case c.ch <- p.NewMsg(p.Text, c.id, []byte(text), ""):
+	default:
+		c.conn.Close()
+	}
+}
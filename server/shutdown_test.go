@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	p "github.com/crolbar/lekvc/lekvcs/protocol"
+)
+
+func TestCountdownEndsWhenEmpty(t *testing.T) {
+	tests := []struct {
+		name  string
+		leave time.Duration // -1 for nobody connected at all
+	}{
+		{"nobody connected", -1},
+		{"last client leaves", 300 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		if tt.leave >= 0 {
+			c := &Client{id: 200, ch: make(chan p.Msg, controlQueueSize)}
+			mu.Lock()
+			clients[c.id] = c
+			mu.Unlock()
+
+			time.AfterFunc(tt.leave, func() {
+				mu.Lock()
+				delete(clients, c.id)
+				mu.Unlock()
+			})
+		}
+
+		start := time.Now()
+		countdown(time.Minute)
+		if took := time.Since(start); took > tt.leave+time.Second {
+			t.Errorf("%s: countdown took %s", tt.name, took)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package wav
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+)
+
+// Reader streams samples from a wav file
+type Reader struct {
+	file   *os.File
+	r      *bufio.Reader
+	format Format
+
+	// data bytes left to read
+	remaining int64
+
+	raw []byte
+}
+
+// Open opens a wav file and reads its header
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{
+		file: file,
+		r:    bufio.NewReader(file),
+	}
+
+	if err := r.readHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Reader) readHeader() error {
+	var riff struct {
+		ID   [4]byte
+		Size uint32
+		Wave [4]byte
+	}
+	if err := binary.Read(r.r, binary.LittleEndian, &riff); err != nil {
+		return err
+	}
+	if string(riff.ID[:]) != "RIFF" || string(riff.Wave[:]) != "WAVE" {
+		return errors.New("not a wav file")
+	}
+
+	gotFormat := false
+	for {
+		var chunk struct {
+			ID   [4]byte
+			Size uint32
+		}
+		if err := binary.Read(r.r, binary.LittleEndian, &chunk); err != nil {
+			if err == io.EOF {
+				return errors.New("wav file has no data chunk")
+			}
+			return err
+		}
+		// chunks are padded to an even size
+		padded := int64(chunk.Size) + int64(chunk.Size&1)
+
+		switch string(chunk.ID[:]) {
+		case "fmt ":
+			var c fmtChunk
+			if err := binary.Read(r.r, binary.LittleEndian, &c); err != nil {
+				return err
+			}
+			read := int64(16)
+
+			if c.Tag == formatExtensible && chunk.Size >= 40 {
+				var ext struct {
+					Size          uint16
+					ValidBits     uint16
+					ChannelMask   uint32
+					SubFormat     uint16
+					SubFormatRest [14]byte
+				}
+				if err := binary.Read(r.r, binary.LittleEndian, &ext); err != nil {
+					return err
+				}
+				read += 24
+				c.Tag = ext.SubFormat
+			}
+
+			// skip extension bytes
+			if _, err := r.r.Discard(int(padded - read)); err != nil {
+				return err
+			}
+
+			format, err := c.format()
+			if err != nil {
+				return err
+			}
+			r.format = format
+			gotFormat = true
+
+		case "data":
+			if !gotFormat {
+				return errors.New("wav data chunk before fmt chunk")
+			}
+			r.remaining = int64(chunk.Size)
+			// a writer that never got to finalize the header,
+			// or one streaming without knowing the length
+			if chunk.Size == 0 || chunk.Size == math.MaxUint32 {
+				r.remaining = math.MaxInt64
+			}
+			return nil
+
+		default:
+			if _, err := r.r.Discard(int(padded)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *Reader) Format() Format {
+	return r.format
+}
+
+// Read reads up to len(out) interleaved samples, returns io.EOF at the end of data.
+// A truncated file (e.g. a recording that was never finalized) reads until the file ends.
+func (r *Reader) Read(out []float32) (int, error) {
+	bps := r.format.bytesPerSample()
+
+	want := int64(len(out) * bps)
+	if want > r.remaining {
+		want = r.remaining - r.remaining%int64(bps)
+	}
+	if want == 0 {
+		return 0, io.EOF
+	}
+
+	if cap(r.raw) < int(want) {
+		r.raw = make([]byte, want)
+	}
+	raw := r.raw[:want]
+
+	n, err := io.ReadFull(r.r, raw)
+	n -= n % bps
+	r.remaining -= int64(n)
+
+	decode(raw[:n], r.format.Encoding, out[:n/bps])
+
+	if err == io.ErrUnexpectedEOF || (err == io.EOF && n == 0) {
+		r.remaining = 0
+		if n == 0 {
+			return 0, io.EOF
+		}
+		err = nil
+	}
+
+	return n / bps, err
+}
+
+// ReadAll reads all remaining samples
+func (r *Reader) ReadAll() ([]float32, error) {
+	var (
+		samples []float32
+		buf     = make([]float32, 4096*r.format.Channels)
+	)
+
+	for {
+		n, err := r.Read(buf)
+		samples = append(samples, buf[:n]...)
+		if err == io.EOF {
+			return samples, nil
+		}
+		if err != nil {
+			return samples, err
+		}
+	}
+}
+
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,79 @@
+package wav
+
+import "time"
+
+// Track is a Writer that keeps the audio aligned to wall-clock time,
+// gaps between writes longer than the slack are filled with silence
+type Track struct {
+	*Writer
+
+	start     time.Time
+	slack     int64
+	lastFlush time.Time
+}
+
+// how often a track updates its header so a crash loses little
+const trackFlushInterval = time.Second
+
+// silence is written this many samples at a time so a long gap doesn't need a buffer as long
+const padChunk = 4096
+
+var silence [padChunk]float32
+
+// CreateTrack creates a track whose sample 0 corresponds to start
+func CreateTrack(path string, format Format, start time.Time, slack time.Duration) (*Track, error) {
+	w, err := Create(path, format)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Track{
+		Writer:    w,
+		start:     start,
+		slack:     int64(slack.Seconds() * float64(format.SampleRate)),
+		lastFlush: start,
+	}, nil
+}
+
+// Frames returns the length of the track in frames
+func (t *Track) Frames() int64 {
+	return t.Samples() / int64(t.format.Channels)
+}
+
+// Pad appends silence until the track is frames long
+func (t *Track) Pad(frames int64) error {
+	gap := frames - t.Frames()
+	if gap <= 0 {
+		return nil
+	}
+
+	for n := gap * int64(t.format.Channels); n > 0; n -= padChunk {
+		if err := t.Write(silence[:min(n, padChunk)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteAt writes interleaved samples that finished arriving at the given time
+func (t *Track) WriteAt(at time.Time, samples []float32) error {
+	frames := int64(len(samples) / t.format.Channels)
+
+	// where the samples should start if they arrived on time
+	expected := int64(at.Sub(t.start).Seconds()*float64(t.format.SampleRate)) - frames
+	if expected-t.Frames() > t.slack {
+		if err := t.Pad(expected); err != nil {
+			return err
+		}
+	}
+
+	if err := t.Write(samples); err != nil {
+		return err
+	}
+
+	if at.Sub(t.lastFlush) >= trackFlushInterval {
+		t.lastFlush = at
+		return t.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+// Package wav reads and writes RIFF wave files as interleaved float32 samples
+package wav
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+type Encoding uint16
+
+const (
+	PCM16 Encoding = iota
+	PCM24
+	Float32
+)
+
+const (
+	formatPCM   = 1
+	formatFloat = 3
+	// the real tag is in the first two bytes of the sub format GUID
+	formatExtensible = 0xfffe
+)
+
+// size of the canonical header written by Writer
+const headerSize = 44
+
+// the most data bytes a header can describe, the RIFF size counts the header too
+const maxDataSize = math.MaxUint32 - (headerSize - 8)
+
+// ErrTooLarge is returned by writes past the 4 GiB a wav file can hold
+var ErrTooLarge = errors.New("wav file can't hold more than 4 GiB of data")
+
+type Format struct {
+	SampleRate int
+	Channels   int
+	Encoding   Encoding
+}
+
+func (f Format) bytesPerSample() int {
+	switch f.Encoding {
+	case PCM24:
+		return 3
+	case Float32:
+		return 4
+	}
+	return 2
+}
+
+func (f Format) blockAlign() int {
+	return f.Channels * f.bytesPerSample()
+}
+
+func (f Format) formatTag() uint16 {
+	if f.Encoding == Float32 {
+		return formatFloat
+	}
+	return formatPCM
+}
+
+func (f Format) validate() error {
+	if f.SampleRate <= 0 {
+		return fmt.Errorf("invalid sample rate %d", f.SampleRate)
+	}
+	if f.Channels <= 0 {
+		return fmt.Errorf("invalid channel count %d", f.Channels)
+	}
+	if f.Encoding > Float32 {
+		return fmt.Errorf("invalid encoding %d", f.Encoding)
+	}
+	return nil
+}
+
+type fmtChunk struct {
+	Tag           uint16
+	Channels      uint16
+	SampleRate    uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+}
+
+func (c fmtChunk) format() (Format, error) {
+	format := Format{
+		SampleRate: int(c.SampleRate),
+		Channels:   int(c.Channels),
+	}
+
+	switch {
+	case c.Tag == formatPCM && c.BitsPerSample == 16:
+		format.Encoding = PCM16
+	case c.Tag == formatPCM && c.BitsPerSample == 24:
+		format.Encoding = PCM24
+	case c.Tag == formatFloat && c.BitsPerSample == 32:
+		format.Encoding = Float32
+	default:
+		return Format{}, fmt.Errorf("unsupported wav format %d with %d bits", c.Tag, c.BitsPerSample)
+	}
+
+	return format, format.validate()
+}
+
+func decode(raw []byte, enc Encoding, out []float32) {
+	switch enc {
+	case Float32:
+		for i := range out {
+			out[i] = math.Float32frombits(binary.LittleEndian.Uint32(raw[i*4:]))
+		}
+	case PCM24:
+		for i := range out {
+			v := int32(raw[i*3]) | int32(raw[i*3+1])<<8 | int32(int8(raw[i*3+2]))<<16
+			out[i] = float32(v) / (1 << 23)
+		}
+	default:
+		for i := range out {
+			out[i] = float32(int16(binary.LittleEndian.Uint16(raw[i*2:]))) / (1 << 15)
+		}
+	}
+}
+
+func quantize(s float32, bits uint) int32 {
+	scale := float64(int64(1) << (bits - 1))
+	return int32(max(-scale, min(scale-1, math.Round(float64(s)*scale))))
+}
+
+func encode(samples []float32, enc Encoding, out []byte) {
+	switch enc {
+	case Float32:
+		for i, s := range samples {
+			binary.LittleEndian.PutUint32(out[i*4:], math.Float32bits(s))
+		}
+	case PCM24:
+		for i, s := range samples {
+			v := quantize(s, 24)
+			out[i*3] = byte(v)
+			out[i*3+1] = byte(v >> 8)
+			out[i*3+2] = byte(v >> 16)
+		}
+	default:
+		for i, s := range samples {
+			binary.LittleEndian.PutUint16(out[i*2:], uint16(int16(quantize(s, 16))))
+		}
+	}
+}
+
+// ReadFile reads a whole wav file, samples are interleaved and in [-1, 1]
+func ReadFile(path string) ([]float32, Format, error) {
+	r, err := Open(path)
+	if err != nil {
+		return nil, Format{}, err
+	}
+	defer r.Close()
+
+	samples, err := r.ReadAll()
+	return samples, r.Format(), err
+}
+
+// WriteFile writes interleaved samples to a new wav file
+func WriteFile(path string, samples []float32, format Format) error {
+	w, err := Create(path, format)
+	if err != nil {
+		return err
+	}
+
+	if err := w.Write(samples); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
@@ -0,0 +1,224 @@
+package wav
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func sine(frames, channels int) []float32 {
+	samples := make([]float32, frames*channels)
+	for i := range samples {
+		samples[i] = float32(0.8 * math.Sin(float64(i)*0.01*float64(1+i%channels)))
+	}
+	return samples
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		enc Encoding
+		tol float64
+	}{
+		{PCM16, 1.0 / (1 << 15)},
+		{PCM24, 1.0 / (1 << 23)},
+		{Float32, 0},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "a.wav")
+		format := Format{SampleRate: 44100, Channels: 2, Encoding: tt.enc}
+		in := sine(10000, 2)
+		// full scale must not wrap around
+		in[0], in[1] = 1, -1
+
+		if err := WriteFile(path, in, format); err != nil {
+			t.Fatal(err)
+		}
+		out, got, err := ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != format {
+			t.Errorf("encoding %d: format %+v, want %+v", tt.enc, got, format)
+		}
+		if len(out) != len(in) {
+			t.Fatalf("encoding %d: %d samples, want %d", tt.enc, len(out), len(in))
+		}
+		for i := range in {
+			if math.Abs(float64(out[i]-in[i])) > tt.tol {
+				t.Fatalf("encoding %d: sample %d is %v, want %v", tt.enc, i, out[i], in[i])
+			}
+		}
+	}
+}
+
+// unfinished writes a file whose header was never updated, the way a crash leaves it
+func unfinished(t *testing.T, samples []float32, format Format) string {
+	path := filepath.Join(t.TempDir(), "crash.wav")
+	w, err := Create(path, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(samples); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	w.file.Close()
+	return path
+}
+
+func TestReadUnfinalized(t *testing.T) {
+	format := Format{SampleRate: 48000, Channels: 1, Encoding: Float32}
+	in := sine(48000, 1)
+	path := unfinished(t, in, format)
+
+	out, _, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(in) {
+		t.Fatalf("read %d samples of an unfinished file, want %d", len(out), len(in))
+	}
+}
+
+func TestRepair(t *testing.T) {
+	format := Format{SampleRate: 16000, Channels: 2, Encoding: PCM24}
+	in := sine(1000, 2)
+	path := unfinished(t, in, format)
+
+	// cut the last frame in half
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-4); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Repair(path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantData := (len(in) - 2) * 3
+	if len(data) != headerSize+wantData {
+		t.Fatalf("repaired file is %d bytes, want %d", len(data), headerSize+wantData)
+	}
+	if size := binary.LittleEndian.Uint32(data[4:]); size != uint32(headerSize-8+wantData) {
+		t.Errorf("RIFF size %d, want %d", size, headerSize-8+wantData)
+	}
+	if size := binary.LittleEndian.Uint32(data[headerSize-4:]); size != uint32(wantData) {
+		t.Errorf("data size %d, want %d", size, wantData)
+	}
+
+	out, _, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(in)-2 {
+		t.Errorf("read %d samples, want %d", len(out), len(in)-2)
+	}
+}
+
+func TestReadExtensible(t *testing.T) {
+	samples := []int16{0, 16384, -16384, 32767}
+
+	var b []byte
+	b = append(b, "RIFF"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(4+8+40+8+len(samples)*2))
+	b = append(b, "WAVEfmt "...)
+	b = binary.LittleEndian.AppendUint32(b, 40)
+	b = binary.LittleEndian.AppendUint16(b, formatExtensible)
+	b = binary.LittleEndian.AppendUint16(b, 1)
+	b = binary.LittleEndian.AppendUint32(b, 8000)
+	b = binary.LittleEndian.AppendUint32(b, 16000)
+	b = binary.LittleEndian.AppendUint16(b, 2)
+	b = binary.LittleEndian.AppendUint16(b, 16)
+	b = binary.LittleEndian.AppendUint16(b, 22)
+	b = binary.LittleEndian.AppendUint16(b, 16)
+	b = binary.LittleEndian.AppendUint32(b, 4)
+	// KSDATAFORMAT_SUBTYPE_PCM
+	b = append(b, 1, 0, 0, 0, 0, 0, 0x10, 0, 0x80, 0, 0, 0xaa, 0, 0x38, 0x9b, 0x71)
+	b = append(b, "data"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(samples)*2))
+	for _, s := range samples {
+		b = binary.LittleEndian.AppendUint16(b, uint16(s))
+	}
+
+	path := filepath.Join(t.TempDir(), "ext.wav")
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, format, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != (Format{SampleRate: 8000, Channels: 1, Encoding: PCM16}) {
+		t.Errorf("format %+v", format)
+	}
+	if len(out) != len(samples) || out[1] != 0.5 || out[2] != -0.5 {
+		t.Errorf("samples %v", out)
+	}
+}
+
+func TestWriteTooLarge(t *testing.T) {
+	w, err := Create(filepath.Join(t.TempDir(), "big.wav"), Format{SampleRate: 8000, Channels: 1, Encoding: PCM16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// pretend the file is almost full instead of writing 4 GiB
+	w.dataSize = maxDataSize - 2
+	if err := w.Write([]float32{0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write([]float32{0}); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("write past 4 GiB: %v, want ErrTooLarge", err)
+	}
+}
+
+func TestTrackPad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "track.wav")
+	format := Format{SampleRate: 8000, Channels: 2, Encoding: PCM16}
+	start := time.Now()
+
+	track, err := CreateTrack(path, format, start, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := track.Write(sine(10, 2)); err != nil {
+		t.Fatal(err)
+	}
+	// longer than one chunk of silence and not a multiple of it
+	frames := int64(3*padChunk + 7)
+	if err := track.Pad(frames); err != nil {
+		t.Fatal(err)
+	}
+	if err := track.Pad(frames - 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := track.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(out)) != frames*2 {
+		t.Fatalf("%d samples, want %d", len(out), frames*2)
+	}
+	for i, s := range out[20:] {
+		if s != 0 {
+			t.Fatalf("sample %d of the padding is %v", 20+i, s)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package wav
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// Writer streams samples into a wav file.
+// The header sizes are only correct after Flush or Close,
+// files left behind by a crash can be fixed with Repair.
+type Writer struct {
+	file   *os.File
+	w      *bufio.Writer
+	format Format
+
+	dataSize int64
+
+	raw []byte
+}
+
+// Create creates (or truncates) a wav file for writing
+func Create(path string, format Format) (*Writer, error) {
+	if err := format.validate(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		file:   file,
+		w:      bufio.NewWriter(file),
+		format: format,
+	}
+
+	if err := w.writeHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *Writer) Format() Format {
+	return w.format
+}
+
+// Samples returns the number of interleaved samples written so far
+func (w *Writer) Samples() int64 {
+	return w.dataSize / int64(w.format.bytesPerSample())
+}
+
+func header(format Format, dataSize int64) any {
+	return struct {
+		RiffID   [4]byte
+		RiffSize uint32
+		Wave     [4]byte
+
+		FmtID [4]byte
+		Size  uint32
+		fmtChunk
+
+		DataID   [4]byte
+		DataSize uint32
+	}{
+		RiffID:   [4]byte{'R', 'I', 'F', 'F'},
+		RiffSize: uint32(headerSize - 8 + dataSize),
+		Wave:     [4]byte{'W', 'A', 'V', 'E'},
+
+		FmtID: [4]byte{'f', 'm', 't', ' '},
+		Size:  16,
+		fmtChunk: fmtChunk{
+			Tag:           format.formatTag(),
+			Channels:      uint16(format.Channels),
+			SampleRate:    uint32(format.SampleRate),
+			ByteRate:      uint32(format.SampleRate * format.blockAlign()),
+			BlockAlign:    uint16(format.blockAlign()),
+			BitsPerSample: uint16(format.bytesPerSample() * 8),
+		},
+
+		DataID:   [4]byte{'d', 'a', 't', 'a'},
+		DataSize: uint32(dataSize),
+	}
+}
+
+func (w *Writer) writeHeader() error {
+	return binary.Write(w.w, binary.LittleEndian, header(w.format, w.dataSize))
+}
+
+// Write appends interleaved samples, returning ErrTooLarge
+// instead of writing past what the header can describe
+func (w *Writer) Write(samples []float32) error {
+	size := len(samples) * w.format.bytesPerSample()
+	if w.dataSize+int64(size) > maxDataSize {
+		return ErrTooLarge
+	}
+	if cap(w.raw) < size {
+		w.raw = make([]byte, size)
+	}
+	raw := w.raw[:size]
+
+	encode(samples, w.format.Encoding, raw)
+
+	n, err := w.w.Write(raw)
+	w.dataSize += int64(n)
+	return err
+}
+
+// Flush writes buffered samples and updates the header sizes
+// so the file is valid up to this point
+func (w *Writer) Flush() error {
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+
+	if err := writeSizes(w.file, w.dataSize); err != nil {
+		return err
+	}
+
+	_, err := w.file.Seek(0, io.SeekEnd)
+	return err
+}
+
+func (w *Writer) Close() error {
+	err := w.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeSizes patches the RIFF and data chunk sizes of a canonical header
+func writeSizes(file *os.File, dataSize int64) error {
+	var buf [4]byte
+
+	binary.LittleEndian.PutUint32(buf[:], uint32(headerSize-8+dataSize))
+	if _, err := file.WriteAt(buf[:], 4); err != nil {
+		return err
+	}
+
+	binary.LittleEndian.PutUint32(buf[:], uint32(dataSize))
+	_, err := file.WriteAt(buf[:], headerSize-4)
+	return err
+}
+
+// Repair fixes the header sizes of a file written by Writer
+// that was never closed, e.g. after a crash
+func Repair(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var h [headerSize]byte
+	if _, err := io.ReadFull(file, h[:]); err != nil {
+		return err
+	}
+	if string(h[0:4]) != "RIFF" || string(h[8:12]) != "WAVE" ||
+		string(h[12:16]) != "fmt " || string(h[36:40]) != "data" {
+		return errors.New("not a wav file written by this package")
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	blockAlign := int64(binary.LittleEndian.Uint16(h[32:]))
+	if blockAlign == 0 {
+		return errors.New("invalid block align")
+	}
+
+	// drop a partially written frame and anything the header can't describe
+	dataSize := min(info.Size()-headerSize, maxDataSize)
+	dataSize -= dataSize % blockAlign
+
+	if err := file.Truncate(headerSize + dataSize); err != nil {
+		return err
+	}
+
+	return writeSizes(file, dataSize)
+}